@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/dmuth/google-go-log4go"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+const (
+	ScopeRead    = "read"
+	ScopeOps     = "ops"
+	ScopeFinance = "finance"
+)
+
+const defaultAuditPage = 100
+
+type adminKeyCtx struct{}
+
+/* Keys are configured by SHA-256 of the key, additional keys are looked up in "admin:keys" hash of backend.
+ * Key is sent as "Authorization: Bearer <key>".
+ */
+type AdminConfig struct {
+	Enabled bool               `json:"enabled"`
+	Keys    []storage.AdminKey `json:"keys"`
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (s *ApiServer) registerAdmin(r *mux.Router) {
+	s.adminKeys = make(map[string]*storage.AdminKey)
+	for i, key := range s.config.Admin.Keys {
+		s.adminKeys[strings.ToLower(key.Hash)] = &s.config.Admin.Keys[i]
+	}
+	r.HandleFunc("/api/admin/nodes", s.admin(ScopeRead, s.AdminNodesIndex)).Methods("GET")
+	r.HandleFunc("/api/admin/status", s.admin(ScopeRead, s.AdminStatusIndex)).Methods("GET")
+	r.HandleFunc("/api/admin/bans", s.admin(ScopeRead, s.AdminBansIndex)).Methods("GET")
+	r.HandleFunc("/api/admin/audit", s.admin(ScopeRead, s.AdminAuditIndex)).Methods("GET")
+	r.HandleFunc("/api/admin/payments/pending", s.admin(ScopeFinance, s.AdminPendingPaymentsIndex)).Methods("GET")
+	r.HandleFunc("/api/admin/finances", s.admin(ScopeFinance, s.AdminFinancesIndex)).Methods("GET")
+	r.HandleFunc("/api/admin/modules/{module:unlocker|payouts}/resume", s.admin(ScopeOps, s.AdminResumeIndex)).Methods("POST")
+	r.HandleFunc("/api/admin/adjustments", s.admin(ScopeFinance, s.AdminAdjustmentsIndex)).Methods("GET")
+	r.HandleFunc("/api/admin/accounts/{login:0x[0-9a-fA-F]{40}}/adjustments", s.admin(ScopeFinance, s.AdminAdjustBalanceIndex)).Methods("POST")
+}
+
+// Config keys take precedence over backend ones
+func (s *ApiServer) adminKey(r *http.Request) (*storage.AdminKey, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	hash := storage.HashAdminKey(strings.TrimPrefix(auth, "Bearer "))
+	if key, ok := s.adminKeys[hash]; ok {
+		return key, nil
+	}
+	return s.backend.GetAdminKey(hash)
+}
+
+/* Checks key scope and writes every call of a known key, including forbidden ones, to audit log.
+ * Requests without valid key are only logged and counted, so they can't push operator calls out of the trimmed log.
+ */
+func (s *ApiServer) admin(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		key, err := s.adminKey(r)
+		name := ""
+		switch {
+		case err != nil:
+			log.Errorf("Failed to get admin key from backend: %v", err)
+			rec.WriteHeader(http.StatusInternalServerError)
+		case key == nil:
+			rec.WriteHeader(http.StatusUnauthorized)
+		case !util.StringInSlice(scope, key.Scopes):
+			name = key.Name
+			rec.WriteHeader(http.StatusForbidden)
+		default:
+			name = key.Name
+			handler(rec, r.WithContext(context.WithValue(r.Context(), adminKeyCtx{}, key)))
+		}
+
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if key == nil {
+			atomic.AddInt64(&s.adminRejects, 1)
+			log.Warnf("Admin API: %v %v rejected from %v: %v", r.Method, r.URL.RequestURI(), ip, rec.status)
+			return
+		}
+		entry := &storage.AdminAudit{
+			Timestamp: util.MakeTimestamp() / 1000,
+			Key:       name,
+			Ip:        ip,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Status:    rec.status,
+		}
+		log.Infof("Admin API: %v %v by %q from %v: %v", entry.Method, entry.Path, entry.Key, entry.Ip, entry.Status)
+		if err := s.backend.WriteAdminAudit(entry); err != nil {
+			log.Errorf("Failed to write admin audit to backend: %v", err)
+		}
+	}
+}
+
+func writeAdminReply(w http.ResponseWriter, reply interface{}, err error) {
+	if err != nil {
+		log.Errorf("Failed to fetch admin data from backend: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Errorf("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) AdminNodesIndex(w http.ResponseWriter, r *http.Request) {
+	nodes, err := s.backend.GetNodeStates()
+	writeAdminReply(w, map[string]interface{}{"nodes": nodes}, err)
+}
+
+// Halt state of unlocker and payouts modules, payouts lock and number of pending payments
+func (s *ApiServer) AdminStatusIndex(w http.ResponseWriter, r *http.Request) {
+	reply := make(map[string]interface{})
+	modules, err := s.backend.GetModuleStatuses()
+	if err != nil {
+		writeAdminReply(w, nil, err)
+		return
+	}
+	reply["modules"] = modules
+	locked, err := s.backend.IsPayoutsLocked()
+	if err != nil {
+		writeAdminReply(w, nil, err)
+		return
+	}
+	reply["payoutsLocked"] = locked
+	reply["pendingPayments"] = len(s.backend.GetPendingPayments())
+	reply["rejectedRequests"] = atomic.LoadInt64(&s.adminRejects)
+	writeAdminReply(w, reply, nil)
+}
+
+func (s *ApiServer) AdminPendingPaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	payments := s.backend.GetPendingPayments()
+	if payments == nil {
+		payments = []*storage.PendingPayment{}
+	}
+	writeAdminReply(w, map[string]interface{}{"payments": payments}, nil)
+}
+
+func (s *ApiServer) AdminFinancesIndex(w http.ResponseWriter, r *http.Request) {
+	finances, err := s.backend.GetFinances()
+	writeAdminReply(w, map[string]interface{}{"finances": finances}, err)
+}
+
+func (s *ApiServer) AdminBansIndex(w http.ResponseWriter, r *http.Request) {
+	reply := make(map[string]interface{})
+	bans, err := s.backend.GetBans()
+	if err != nil {
+		writeAdminReply(w, nil, err)
+		return
+	}
+	reply["bans"] = bans
+	if reply["blacklist"], err = s.backend.GetBlacklist(); err != nil {
+		writeAdminReply(w, nil, err)
+		return
+	}
+	if reply["whitelist"], err = s.backend.GetWhitelist(); err != nil {
+		writeAdminReply(w, nil, err)
+		return
+	}
+	writeAdminReply(w, reply, nil)
+}
+
+func (s *ApiServer) AdminAuditIndex(w http.ResponseWriter, r *http.Request) {
+	offset, limit, ok := parsePage(r, defaultAuditPage)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	entries, err := s.backend.GetAdminAudit(offset, limit)
+	writeAdminReply(w, map[string]interface{}{"audit": entries}, err)
+}
+
+// Module takes resume request on its next run and resumes only if its invariants hold, check status for result
+func (s *ApiServer) AdminResumeIndex(w http.ResponseWriter, r *http.Request) {
+	module := mux.Vars(r)["module"]
+	err := s.backend.RequestResume(module)
+	writeAdminReply(w, map[string]interface{}{"module": module, "requested": err == nil}, err)
+}
+
+func (s *ApiServer) AdminAdjustmentsIndex(w http.ResponseWriter, r *http.Request) {
+	offset, limit, ok := parsePage(r, defaultAuditPage)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	adjustments, err := s.backend.GetAdjustments(offset, limit)
+	writeAdminReply(w, map[string]interface{}{"adjustments": adjustments}, err)
+}
+
+type adjustmentReq struct {
+	// In Shannon, negative to debit
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// Operator of adjustment is the name of admin key
+func (s *ApiServer) AdminAdjustBalanceIndex(w http.ResponseWriter, r *http.Request) {
+	var req adjustmentReq
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	login := strings.ToLower(mux.Vars(r)["login"])
+	key := r.Context().Value(adminKeyCtx{}).(*storage.AdminKey)
+
+	adj, err := s.backend.AdjustBalance(login, req.Amount, strings.TrimSpace(req.Reason), key.Name)
+	switch err {
+	case storage.ErrInvalidAdjustment:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrUnknownMiner:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case storage.ErrInsufficientBalance, storage.ErrPayoutsInProgress, storage.ErrAdjustmentConflict:
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err == nil {
+		log.Warnf("Adjusted balance of %v by %v Shannon by %q: %v", login, adj.Amount, adj.Operator, adj.Reason)
+	}
+	writeAdminReply(w, map[string]interface{}{"adjustment": adj}, err)
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Backend is nil, so writing rejected request to audit log would panic
+func TestAdminRejectsWithoutAudit(t *testing.T) {
+	s := &ApiServer{config: &ApiConfig{}}
+	handler := s.admin(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Must not call handler without key")
+	})
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/api/admin/status", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Must reply 401 without key: %v", w.Code)
+		}
+	}
+	if s.adminRejects != 3 {
+		t.Errorf("Must count rejected requests: %v", s.adminRejects)
+	}
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	log "github.com/dmuth/google-go-log4go"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+type HistoryConfig struct {
+	Enabled bool          `json:"enabled"`
+	Tiers   []HistoryTier `json:"tiers"`
+}
+
+type HistoryTier struct {
+	Resolution string `json:"resolution"`
+	Retention  string `json:"retention"`
+}
+
+// Returns tiers sorted by resolution, the finest one defines snapshot interval
+func parseHistoryTiers(cfg []HistoryTier) []storage.SeriesTier {
+	var tiers []storage.SeriesTier
+	for _, v := range cfg {
+		tiers = append(tiers, storage.SeriesTier{
+			Resolution: util.MustParseDuration(v.Resolution),
+			Retention:  util.MustParseDuration(v.Retention),
+		})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Resolution < tiers[j].Resolution })
+	for _, tier := range tiers {
+		if tier.Resolution%tiers[0].Resolution != 0 {
+			log.Errorf("History resolution %v must be a multiple of %v", tier.Resolution, tiers[0].Resolution)
+		}
+		if tiers[0].Retention < tier.Resolution {
+			log.Errorf("History retention %v is too short to downsample into %v", tiers[0].Retention, tier.Resolution)
+		}
+	}
+	return tiers
+}
+
+func (s *ApiServer) startHistory() {
+	if len(s.historyTiers) == 0 {
+		log.Error("History is enabled, but no tiers configured")
+		return
+	}
+	intv := s.historyTiers[0].Resolution
+	timer := time.NewTimer(intv)
+	log.Infof("Set history snapshot interval to %v", intv)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				s.writeHistory()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+func (s *ApiServer) writeHistory() {
+	stats := s.getStats()
+	if stats == nil {
+		return
+	}
+	start := time.Now()
+	now := util.MakeTimestamp() / 1000
+
+	err := s.backend.WritePoolHistory(s.historyTiers, now, stats["hashrate"].(int64), int64(stats["minersTotal"].(int)), s.networkDifficulty())
+	if err != nil {
+		log.Errorf("Failed to write pool history to backend: %v", err)
+		return
+	}
+
+	miners := stats["miners"].(map[string]storage.Miner)
+	for login := range miners {
+		workers, err := s.backend.GetWorkersHashrate(login, s.hashrateWindow)
+		if err != nil {
+			log.Errorf("Failed to fetch workers hashrate of %v from backend: %v", login, err)
+			continue
+		}
+		err = s.backend.WriteMinerHistory(s.historyTiers, now, login, workers)
+		if err != nil {
+			log.Errorf("Failed to write history of %v to backend: %v", login, err)
+		}
+	}
+	log.Infof("History snapshot of %v miners finished %s", len(miners), time.Since(start))
+}
+
+// Difficulty reported by the most advanced node
+func (s *ApiServer) networkDifficulty() int64 {
+	nodes, err := s.backend.GetNodeStates()
+	if err != nil {
+		log.Errorf("Failed to get nodes stats from backend: %v", err)
+		return 0
+	}
+	var height, diff int64
+	for _, node := range nodes {
+		heightString, _ := node["height"].(string)
+		diffString, _ := node["difficulty"].(string)
+		h, _ := strconv.ParseInt(heightString, 10, 64)
+		if h >= height {
+			height = h
+			diff, _ = strconv.ParseInt(diffString, 10, 64)
+		}
+	}
+	return diff
+}
+
+// Pick tier by "resolution" query param, defaults to the finest one
+func (s *ApiServer) historyTier(r *http.Request) (storage.SeriesTier, bool) {
+	if len(s.historyTiers) == 0 {
+		return storage.SeriesTier{}, false
+	}
+	value := r.URL.Query().Get("resolution")
+	if len(value) == 0 {
+		return s.historyTiers[0], true
+	}
+	resolution, err := time.ParseDuration(value)
+	if err != nil {
+		return storage.SeriesTier{}, false
+	}
+	for _, tier := range s.historyTiers {
+		if tier.Resolution == resolution {
+			return tier, true
+		}
+	}
+	return storage.SeriesTier{}, false
+}
+
+func (s *ApiServer) StatsHistoryIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	tier, ok := s.historyTier(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	points, err := s.backend.GetPoolHistory(tier)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Infof("Failed to fetch history from backend: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["resolution"] = int64(tier.Resolution / time.Second)
+	reply["history"] = points
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Errorf("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) AccountHistoryIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	login := strings.ToLower(mux.Vars(r)["login"])
+	tier, ok := s.historyTier(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	reply, err := s.backend.GetMinerHistory(tier, login)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Infof("Failed to fetch history from backend: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	reply["resolution"] = int64(tier.Resolution / time.Second)
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Errorf("Error serializing API response: ", err)
+	}
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	log "github.com/dmuth/google-go-log4go"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+// Upper bound of cached query replies, cache is dropped as a whole once exceeded
+const maxQueryCache = 1000
+
+var queryParams = []string{"status", "fromHeight", "toHeight", "from", "to", "cursor", "limit", "login"}
+
+// Whether request asks for a direct query instead of collected stats
+func isQuery(r *http.Request) bool {
+	values := r.URL.Query()
+	for _, name := range queryParams {
+		if len(values.Get(name)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse optional int64 query params, stops on the first malformed one
+func parseInts(r *http.Request, names ...string) ([]int64, bool) {
+	result := make([]int64, len(names))
+	for i, name := range names {
+		v := r.URL.Query().Get(name)
+		if len(v) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		result[i] = n
+	}
+	return result, true
+}
+
+func (s *ApiServer) getCachedQuery(key string) (map[string]interface{}, bool) {
+	s.queriesMu.Lock()
+	defer s.queriesMu.Unlock()
+
+	entry, ok := s.queries[key]
+	if !ok || entry.updatedAt < util.MakeTimestamp()-int64(s.statsIntv/time.Millisecond) {
+		return nil, false
+	}
+	return entry.stats, true
+}
+
+func (s *ApiServer) setCachedQuery(key string, reply map[string]interface{}) {
+	s.queriesMu.Lock()
+	defer s.queriesMu.Unlock()
+
+	if len(s.queries) >= maxQueryCache {
+		s.queries = make(map[string]*Entry)
+	}
+	s.queries[key] = &Entry{stats: reply, updatedAt: util.MakeTimestamp()}
+}
+
+func (s *ApiServer) queryBlocks(r *http.Request) (map[string]interface{}, int) {
+	status := r.URL.Query().Get("status")
+	if len(status) == 0 {
+		status = "matured"
+	}
+	ints, ok := parseInts(r, "fromHeight", "toHeight", "from", "to")
+	if !ok {
+		return nil, http.StatusBadRequest
+	}
+	_, limit, ok := parsePage(r, s.config.Blocks)
+	if !ok {
+		return nil, http.StatusBadRequest
+	}
+	// Filter matches block finder, reject what can never match instead of returning an empty page
+	login := strings.ToLower(r.URL.Query().Get("login"))
+	if len(login) > 0 && !util.IsValidHexAddress(login) {
+		return nil, http.StatusBadRequest
+	}
+	query := &storage.BlocksQuery{
+		Status:     status,
+		Login:      login,
+		FromHeight: ints[0],
+		ToHeight:   ints[1],
+		From:       ints[2],
+		To:         ints[3],
+		Cursor:     r.URL.Query().Get("cursor"),
+		Limit:      limit,
+	}
+	blocks, next, err := s.backend.QueryBlocks(query)
+	if err == storage.ErrInvalidCursor || err == storage.ErrInvalidStatus {
+		return nil, http.StatusBadRequest
+	}
+	if err != nil {
+		log.Errorf("Failed to query blocks from backend: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	reply := make(map[string]interface{})
+	reply["blocks"] = blocks
+	reply["status"] = status
+	reply["next"] = next
+	reply["pageSize"] = limit
+	return reply, http.StatusOK
+}
+
+func (s *ApiServer) queryPayments(r *http.Request, login string) (map[string]interface{}, int) {
+	ints, ok := parseInts(r, "from", "to")
+	if !ok {
+		return nil, http.StatusBadRequest
+	}
+	_, limit, ok := parsePage(r, s.config.Payments)
+	if !ok {
+		return nil, http.StatusBadRequest
+	}
+	// Login is a part of the key, anything but address may point to a foreign key
+	if len(login) > 0 && !util.IsValidHexAddress(login) {
+		return nil, http.StatusBadRequest
+	}
+	query := &storage.PaymentsQuery{
+		Login:  login,
+		From:   ints[0],
+		To:     ints[1],
+		Cursor: r.URL.Query().Get("cursor"),
+		Limit:  limit,
+	}
+	payments, next, err := s.backend.QueryPayments(query)
+	if err == storage.ErrInvalidCursor {
+		return nil, http.StatusBadRequest
+	}
+	if err != nil {
+		log.Errorf("Failed to query payments from backend: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	reply := make(map[string]interface{})
+	reply["payments"] = payments
+	reply["next"] = next
+	reply["pageSize"] = limit
+	return reply, http.StatusOK
+}
+
+func (s *ApiServer) blockDetail(height int64, hash string) (map[string]interface{}, int) {
+	block, status, err := s.backend.GetBlock(height, hash)
+	if err != nil {
+		log.Errorf("Failed to fetch block from backend: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	if block == nil {
+		return nil, http.StatusNotFound
+	}
+	shares, credits, err := s.backend.GetBlockRewards(block)
+	if err != nil {
+		log.Errorf("Failed to fetch block rewards from backend: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+
+	rewards := make(map[string]map[string]interface{})
+	for login, amount := range credits {
+		reward := map[string]interface{}{"amount": amount}
+		if block.TotalShares > 0 {
+			reward["percent"] = float64(shares[login]) / float64(block.TotalShares) * 100
+		}
+		rewards[login] = reward
+	}
+
+	reply := make(map[string]interface{})
+	reply["block"] = block
+	reply["status"] = status
+	reply["roundShares"] = shares
+	reply["rewards"] = rewards
+	return reply, http.StatusOK
+}
+
+// Serve reply of fn, caching successful ones by request URI for stats collect interval
+func (s *ApiServer) serveQuery(w http.ResponseWriter, r *http.Request, fn func() (map[string]interface{}, int)) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	key := r.URL.RequestURI()
+	reply, ok := s.getCachedQuery(key)
+	if !ok {
+		var status int
+		reply, status = fn()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		s.setCachedQuery(key, reply)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Errorf("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) BlockIndex(w http.ResponseWriter, r *http.Request) {
+	height, _ := strconv.ParseInt(mux.Vars(r)["height"], 10, 64)
+	hash := strings.ToLower(mux.Vars(r)["hash"])
+	s.serveQuery(w, r, func() (map[string]interface{}, int) {
+		return s.blockDetail(height, hash)
+	})
+}
+
+func (s *ApiServer) AccountPaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(mux.Vars(r)["login"])
+	s.serveQuery(w, r, func() (map[string]interface{}, int) {
+		return s.queryPayments(r, login)
+	})
+}
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPaymentsQueryLogin(t *testing.T) {
+	s := &ApiServer{config: &ApiConfig{}}
+	for _, login := range []string{"pending", "lock", "0x1"} {
+		w := httptest.NewRecorder()
+		s.PaymentsIndex(w, httptest.NewRequest("GET", "/api/payments?login="+login, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Must reject login %v: %v", login, w.Code)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	log "github.com/dmuth/google-go-log4go"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -28,6 +29,11 @@ type ApiConfig struct {
 	Blocks               int64  `json:"blocks"`
 	PurgeOnly            bool   `json:"purgeOnly"`
 	PurgeInterval        string `json:"purgeInterval"`
+	MaxSubscriptions     int64  `json:"maxSubscriptions"`
+
+	History HistoryConfig `json:"history"`
+	Ws      WsConfig      `json:"ws"`
+	Admin   AdminConfig   `json:"admin"`
 }
 
 type ApiServer struct {
@@ -39,6 +45,14 @@ type ApiServer struct {
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
 	statsIntv           time.Duration
+	historyTiers        []storage.SeriesTier
+	queries             map[string]*Entry
+	queriesMu           sync.Mutex
+	ws                  *wsHub
+	wsPing              time.Duration
+	wsWriteTimeout      time.Duration
+	adminKeys           map[string]*storage.AdminKey
+	adminRejects        int64
 }
 
 type Entry struct {
@@ -55,6 +69,8 @@ func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
+		queries:             make(map[string]*Entry),
+		historyTiers:        parseHistoryTiers(cfg.History.Tiers),
 	}
 }
 
@@ -75,6 +91,10 @@ func (s *ApiServer) Start() {
 
 	sort.Ints(s.config.LuckWindow)
 
+	if s.config.Ws.Enabled && !s.config.PurgeOnly {
+		s.startWs()
+	}
+
 	if s.config.PurgeOnly {
 		s.purgeStale()
 	} else {
@@ -97,6 +117,10 @@ func (s *ApiServer) Start() {
 		}
 	}()
 
+	if s.config.History.Enabled && !s.config.PurgeOnly {
+		s.startHistory()
+	}
+
 	if !s.config.PurgeOnly {
 		s.listen()
 	}
@@ -107,9 +131,22 @@ func (s *ApiServer) listen() {
 	r.HandleFunc("/api/stats", s.StatsIndex)
 	r.HandleFunc("/api/miners", s.MinersIndex)
 	r.HandleFunc("/api/blocks", s.BlocksIndex)
+	r.HandleFunc("/api/blocks/{height:[0-9]+}/{hash:0x[0-9a-fA-F]+}", s.BlockIndex)
 	r.HandleFunc("/api/payments", s.PaymentsIndex)
 	r.HandleFunc("/api/config", s.ConfigIndex)
 	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
+	r.HandleFunc("/api/stats/history", s.StatsHistoryIndex)
+	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}/history", s.AccountHistoryIndex)
+	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}/rewards", s.AccountRewardsIndex)
+	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}/payments", s.AccountPaymentsIndex)
+	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}/subscriptions", s.AccountSubscriptionsIndex).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}/subscriptions/{id:[0-9a-f]{16}}", s.AccountSubscriptionsIndex).Methods("DELETE", "OPTIONS")
+	if s.ws != nil {
+		r.HandleFunc("/api/ws", s.WsIndex)
+	}
+	if s.config.Admin.Enabled {
+		s.registerAdmin(r)
+	}
 	r.NotFoundHandler = http.HandlerFunc(notFound)
 	err := http.ListenAndServe(s.config.Listen, r)
 	if err != nil {
@@ -130,7 +167,7 @@ func (s *ApiServer) purgeStale() {
 	if err != nil {
 		log.Errorf("Failed to purge stale data from backend:", err)
 	} else {
-		log.Infof("Purged stale stats from backend, %v shares affected, elapsed time %v", total, time.Since(start))
+		log.Infof("Purged stale stats from backend, %v gone miners removed, elapsed time %v", total, time.Since(start))
 	}
 }
 
@@ -150,6 +187,7 @@ func (s *ApiServer) collectStats() {
 	}
 	s.stats.Store(stats)
 	log.Infof("Stats collection finished %s", time.Since(start))
+	s.pushStats()
 }
 
 func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
@@ -165,6 +203,12 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	reply["nodes"] = nodes
 
+	submits, err := s.backend.GetSubmitStats()
+	if err != nil {
+		log.Infof("Failed to get submit stats from backend: %v", err)
+	}
+	reply["submits"] = submits
+
 	stats := s.getStats()
 	if stats != nil {
 		reply["now"] = util.MakeTimestamp()
@@ -204,6 +248,12 @@ func (s *ApiServer) MinersIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
+	if isQuery(r) {
+		s.serveQuery(w, r, func() (map[string]interface{}, int) {
+			return s.queryBlocks(r)
+		})
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -228,6 +278,12 @@ func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ApiServer) PaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	if isQuery(r) {
+		s.serveQuery(w, r, func() (map[string]interface{}, int) {
+			return s.queryPayments(r, strings.ToLower(r.URL.Query().Get("login")))
+		})
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -269,6 +325,26 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 
 	login := strings.ToLower(mux.Vars(r)["login"])
+	stats, exist, err := s.getMinerStats(login)
+	if !exist {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Infof("Failed to fetch stats from backend: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		log.Errorf("Error serializing API response: ", err)
+	}
+}
+
+// Cached account stats, refreshed once per stats interval. Returned map is shared and must not be modified.
+func (s *ApiServer) getMinerStats(login string) (map[string]interface{}, bool, error) {
 	s.minersMu.Lock()
 	defer s.minersMu.Unlock()
 
@@ -277,44 +353,109 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	cacheIntv := int64(s.statsIntv / time.Millisecond)
 	// Refresh stats if stale
 	if !ok || reply.updatedAt < now-cacheIntv {
-		exist, err := s.backend.IsMinerExists(login)
-		if !exist {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Infof("Failed to fetch stats from backend: %v", err)
-			return
+		stats, exist, err := s.fetchMinerStats(login)
+		if !exist || err != nil {
+			return nil, exist, err
 		}
-
-		stats, err := s.backend.GetMinerStats(login, s.config.Payments)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Infof("Failed to fetch stats from backend: %v", err)
-			return
-		}
-		workers, err := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Infof("Failed to fetch stats from backend: %v", err)
-			return
-		}
-		for key, value := range workers {
-			stats[key] = value
-		}
-		stats["pageSize"] = s.config.Payments
 		reply = &Entry{stats: stats, updatedAt: now}
 		s.miners[login] = reply
 	}
+	return reply.stats, true, nil
+}
 
+// Account stats with workers, exist is false for unknown miner
+func (s *ApiServer) fetchMinerStats(login string) (map[string]interface{}, bool, error) {
+	exist, err := s.backend.IsMinerExists(login)
+	if !exist {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	stats, err := s.backend.GetMinerStats(login, s.config.Payments)
+	if err != nil {
+		return nil, true, err
+	}
+	workers, err := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
+	if err != nil {
+		return nil, true, err
+	}
+	for key, value := range workers {
+		stats[key] = value
+	}
+	stats["pageSize"] = s.config.Payments
+	return stats, true, nil
+}
+
+var rewardsWindows = []time.Duration{24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour}
+var rewardsWindowNames = []string{"24h", "7d", "30d"}
+
+func (s *ApiServer) AccountRewardsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	login := strings.ToLower(mux.Vars(r)["login"])
+	offset, limit, ok := parsePage(r, s.config.Payments)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rewards, total, err := s.backend.GetRewards(login, offset, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Infof("Failed to fetch rewards from backend: %v", err)
+		return
+	}
+	sums, err := s.backend.GetRewardsSums(login, rewardsWindows)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Infof("Failed to fetch rewards from backend: %v", err)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	err := json.NewEncoder(w).Encode(reply.stats)
+
+	reply := make(map[string]interface{})
+	reply["rewards"] = rewards
+	reply["rewardsTotal"] = total
+	reply["offset"] = offset
+	reply["pageSize"] = limit
+	earnings := make(map[string]int64)
+	for i, name := range rewardsWindowNames {
+		earnings[name] = sums[i]
+	}
+	reply["earnings"] = earnings
+
+	err = json.NewEncoder(w).Encode(reply)
 	if err != nil {
 		log.Errorf("Error serializing API response: ", err)
 	}
 }
 
+// Parse "offset" and "limit" query params, limit can't exceed pageSize
+func parsePage(r *http.Request, pageSize int64) (int64, int64, bool) {
+	offset, limit := int64(0), pageSize
+	var err error
+	if v := r.URL.Query().Get("offset"); len(v) > 0 {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, false
+		}
+	}
+	if v := r.URL.Query().Get("limit"); len(v) > 0 {
+		limit, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || limit <= 0 {
+			return 0, 0, false
+		}
+		if limit > pageSize {
+			limit = pageSize
+		}
+	}
+	return offset, limit, true
+}
+
 func (s *ApiServer) getStats() map[string]interface{} {
 	stats := s.stats.Load()
 	if stats != nil {
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/dmuth/google-go-log4go"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+const defaultMaxSubscriptions = 5
+
+// Signed requests older or newer than this are refused
+const signatureMaxAge = 5 * time.Minute
+
+type subscriptionReq struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+}
+
+/* Webhooks must be http(s) URLs, emails plain addresses without display name.
+ * Webhook hosts resolving to private addresses are refused again by notifier when it connects.
+ */
+func validSubscription(req *subscriptionReq) bool {
+	switch req.Kind {
+	case storage.SubscriptionWebhook:
+		u, err := url.Parse(req.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Hostname()) == 0 {
+			return false
+		}
+		host := strings.ToLower(u.Hostname())
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip == nil || util.IsPublicIP(ip)
+	case storage.SubscriptionEmail:
+		addr, err := mail.ParseAddress(req.Target)
+		return err == nil && addr.Address == req.Target
+	}
+	return false
+}
+
+/* Message signed by login with personal_sign, binds signature to request and its time:
+ * "<METHOD> <path>\n<timestamp>\n<body>"
+ */
+func signedMessage(method, path string, ts int64, body []byte) []byte {
+	return []byte(fmt.Sprintf("%s %s\n%d\n%s", method, path, ts, body))
+}
+
+func signatureHash(msg []byte) []byte {
+	return crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(msg), msg)))
+}
+
+// Whether X-Signature of request recovers to login, it's the only proof of account ownership we have
+func verifyOwner(r *http.Request, login string, body []byte, now time.Time) bool {
+	ts, err := strconv.ParseInt(r.Header.Get("X-Signature-Timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > signatureMaxAge || age < -signatureMaxAge {
+		return false
+	}
+	sig, err := hexutil.Decode(r.Header.Get("X-Signature"))
+	if err != nil || len(sig) != 65 {
+		return false
+	}
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+	pub, err := crypto.SigToPub(signatureHash(signedMessage(r.Method, r.URL.Path, ts, body)), sig)
+	if err != nil {
+		return false
+	}
+	return strings.ToLower(crypto.PubkeyToAddress(*pub).Hex()) == login
+}
+
+/* GET lists notification subscriptions of account, POST {"kind": "webhook|email", "target": "..."} adds one,
+ * DELETE /api/accounts/{login}/subscriptions/{id} removes it.
+ * Subscriptions expose private targets, so every request must be signed by login, see verifyOwner.
+ */
+func (s *ApiServer) AccountSubscriptionsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Signature, X-Signature-Timestamp")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	login := strings.ToLower(mux.Vars(r)["login"])
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !verifyOwner(r, login, body, time.Now()) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var reply interface{}
+
+	switch r.Method {
+	case "GET":
+		subs, err := s.backend.GetSubscriptions(login)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Infof("Failed to fetch subscriptions from backend: %v", err)
+			return
+		}
+		reply = map[string]interface{}{"subscriptions": subs}
+	case "POST":
+		var req subscriptionReq
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil || !validSubscription(&req) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		max := s.config.MaxSubscriptions
+		if max <= 0 {
+			max = defaultMaxSubscriptions
+		}
+		sub, err := s.backend.AddSubscription(login, req.Kind, req.Target, max)
+		if err == storage.ErrTooManySubscriptions {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Infof("Failed to add subscription to backend: %v", err)
+			return
+		}
+		reply = sub
+	case "DELETE":
+		ok, err := s.backend.RemoveSubscription(login, mux.Vars(r)["id"])
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Infof("Failed to remove subscription from backend: %v", err)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reply = map[string]bool{"removed": true}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Errorf("Error serializing API response: ", err)
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestValidSubscription(t *testing.T) {
+	valid := []subscriptionReq{
+		{Kind: "webhook", Target: "https://example.net/hook"},
+		{Kind: "webhook", Target: "http://203.0.113.7:8080/"},
+		{Kind: "email", Target: "miner@example.net"},
+	}
+	for _, req := range valid {
+		if !validSubscription(&req) {
+			t.Errorf("Must accept %v", req)
+		}
+	}
+	invalid := []subscriptionReq{
+		{Kind: "webhook", Target: "ftp://example.net"},
+		{Kind: "webhook", Target: "http://localhost:6379/"},
+		{Kind: "webhook", Target: "http://127.0.0.1/"},
+		{Kind: "webhook", Target: "http://10.0.0.1/"},
+		{Kind: "webhook", Target: "http://169.254.169.254/latest/meta-data"},
+		{Kind: "webhook", Target: "http://[::1]/"},
+		{Kind: "email", Target: "Miner <miner@example.net>"},
+		{Kind: "sms", Target: "123"},
+	}
+	for _, req := range invalid {
+		if validSubscription(&req) {
+			t.Errorf("Must reject %v", req)
+		}
+	}
+}
+
+func TestVerifyOwner(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	login := strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+	path := "/api/accounts/" + login + "/subscriptions"
+	body := []byte(`{"kind":"email","target":"miner@example.net"}`)
+	now := time.Now()
+
+	request := func(method string, ts time.Time, signed []byte) bool {
+		sig, _ := crypto.Sign(signatureHash(signedMessage(method, path, ts.Unix(), signed)), key)
+		sig[64] += 27
+		r := httptest.NewRequest("POST", path, nil)
+		r.Header.Set("X-Signature", hexutil.Encode(sig))
+		r.Header.Set("X-Signature-Timestamp", strconv.FormatInt(ts.Unix(), 10))
+		return verifyOwner(r, login, body, now)
+	}
+
+	if !request("POST", now, body) {
+		t.Error("Must accept request signed by login")
+	}
+	if request("GET", now, body) {
+		t.Error("Must bind signature to method")
+	}
+	if request("POST", now, []byte(`{"kind":"email","target":"spam@example.net"}`)) {
+		t.Error("Must bind signature to body")
+	}
+	if request("POST", now.Add(-time.Hour), body) {
+		t.Error("Must refuse stale signature")
+	}
+	other, _ := crypto.GenerateKey()
+	otherLogin := strings.ToLower(crypto.PubkeyToAddress(other.PublicKey).Hex())
+	r := httptest.NewRequest("GET", path, nil)
+	if verifyOwner(r, otherLogin, nil, now) {
+		t.Error("Must refuse unsigned request")
+	}
+}
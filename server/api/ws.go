@@ -0,0 +1,468 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/dmuth/google-go-log4go"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+type WsConfig struct {
+	Enabled bool `json:"enabled"`
+	// 0 is unlimited
+	MaxClients int `json:"maxClients"`
+	// Max topics of a single client
+	MaxTopics    int    `json:"maxTopics"`
+	PingInterval string `json:"pingInterval"`
+	WriteTimeout string `json:"writeTimeout"`
+}
+
+const (
+	wsTopicStats   = "stats"
+	wsTopicBlocks  = "blocks"
+	wsTopicAccount = "account:"
+	wsTopicWorker  = "worker:"
+
+	wsQueueSize      = 64
+	wsMaxMessage     = 512
+	defaultMaxTopics = 16
+	// Max subscribe and unsubscribe ops of a client per wsOpsInterval
+	wsMaxOps      = 10
+	wsOpsInterval = time.Second
+
+	eventsReconnectDelay = 5 * time.Second
+)
+
+var (
+	loginPattern  = regexp.MustCompile("^0x[0-9a-f]{40}$")
+	workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_]{1,8}$")
+
+	errUnknownTopic  = errors.New("unknown topic")
+	errTooManyTopics = errors.New("too many topics")
+	errTooManyOps    = errors.New("too many requests")
+	errNotFound      = errors.New("not found")
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// API is served to any origin, same as Access-Control-Allow-Origin: *
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Client sends {"op": "subscribe|unsubscribe", "topic": "..."}
+type wsRequest struct {
+	Op    string `json:"op"`
+	Topic string `json:"topic"`
+}
+
+/* Snapshot carries full topic payload, diff only changed top-level keys and removed ones,
+ * event is a pool event as written to backend.
+ */
+type wsMessage struct {
+	Topic   string      `json:"topic,omitempty"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data,omitempty"`
+	Removed []string    `json:"removed,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+type wsClient struct {
+	conn   *websocket.Conn
+	out    chan []byte
+	quit   chan struct{}
+	topics map[string]bool
+	// Ops counted in current interval, only touched by reader of the client
+	ops      int
+	opsSince time.Time
+}
+
+// Every op may fetch account stats, so a client can't loop over subscribe and unsubscribe
+func (c *wsClient) allowOp(now time.Time) bool {
+	if now.Sub(c.opsSince) >= wsOpsInterval {
+		c.opsSince = now
+		c.ops = 0
+	}
+	c.ops++
+	return c.ops <= wsMaxOps
+}
+
+type wsHub struct {
+	sync.Mutex
+	clients map[*wsClient]bool
+	topics  map[string]map[*wsClient]bool
+	// Last payload of every topic with subscribers, diffs are computed against it
+	last map[string]map[string]interface{}
+}
+
+func newWsHub() *wsHub {
+	return &wsHub{
+		clients: make(map[*wsClient]bool),
+		topics:  make(map[string]map[*wsClient]bool),
+		last:    make(map[string]map[string]interface{}),
+	}
+}
+
+func (h *wsHub) register(c *wsClient, max int) bool {
+	h.Lock()
+	defer h.Unlock()
+	if max > 0 && len(h.clients) >= max {
+		return false
+	}
+	h.clients[c] = true
+	return true
+}
+
+func (h *wsHub) unregister(c *wsClient) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.clients, c)
+	for topic := range c.topics {
+		h.remove(c, topic)
+	}
+}
+
+/* Queues snapshot of the last payload under lock, so it can't be overtaken by a diff.
+ * Returns false if there is no payload yet and topic has to be fetched.
+ */
+func (h *wsHub) subscribe(c *wsClient, topic string, max int) (bool, error) {
+	h.Lock()
+	defer h.Unlock()
+	if !c.topics[topic] && len(c.topics) >= max {
+		return false, errTooManyTopics
+	}
+	c.topics[topic] = true
+	if h.topics[topic] == nil {
+		h.topics[topic] = make(map[*wsClient]bool)
+	}
+	h.topics[topic][c] = true
+	last, ok := h.last[topic]
+	if ok {
+		c.sendMessage(&wsMessage{Topic: topic, Type: "snapshot", Data: last})
+	}
+	return ok, nil
+}
+
+func (h *wsHub) unsubscribe(c *wsClient, topic string) {
+	h.Lock()
+	defer h.Unlock()
+	h.remove(c, topic)
+}
+
+func (h *wsHub) remove(c *wsClient, topic string) {
+	delete(c.topics, topic)
+	delete(h.topics[topic], c)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+		delete(h.last, topic)
+	}
+}
+
+func (h *wsHub) activeTopics() []string {
+	h.Lock()
+	defer h.Unlock()
+	result := make([]string, 0, len(h.topics))
+	for topic := range h.topics {
+		result = append(result, topic)
+	}
+	return result
+}
+
+func (h *wsHub) hasTopic(topic string) bool {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.topics[topic]) > 0
+}
+
+// Sends snapshot if topic has no previous payload, otherwise a diff if anything changed
+func (h *wsHub) publish(topic string, payload map[string]interface{}) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.topics[topic]) == 0 {
+		return
+	}
+	prev, ok := h.last[topic]
+	h.last[topic] = payload
+	msg := wsMessage{Topic: topic, Type: "snapshot", Data: payload}
+	if ok {
+		changed, removed := diffPayload(prev, payload)
+		if len(changed) == 0 && len(removed) == 0 {
+			return
+		}
+		msg = wsMessage{Topic: topic, Type: "diff", Data: changed, Removed: removed}
+	}
+	h.broadcast(topic, &msg)
+}
+
+func (h *wsHub) publishEvent(topic string, event *storage.Event) {
+	h.Lock()
+	defer h.Unlock()
+	h.broadcast(topic, &wsMessage{Topic: topic, Type: "event", Data: event})
+}
+
+func (h *wsHub) broadcast(topic string, msg *wsMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("Error serializing WebSocket message: %v", err)
+		return
+	}
+	for c := range h.topics[topic] {
+		c.send(data)
+	}
+}
+
+// Never blocks, slow client is disconnected once its queue is full
+func (c *wsClient) send(data []byte) {
+	select {
+	case c.out <- data:
+	default:
+		log.Warnf("WebSocket client %v is too slow, disconnecting", c.conn.RemoteAddr())
+		c.conn.Close()
+	}
+}
+
+func (c *wsClient) sendMessage(msg *wsMessage) {
+	data, err := json.Marshal(msg)
+	if err == nil {
+		c.send(data)
+	}
+}
+
+func diffPayload(prev, next map[string]interface{}) (map[string]interface{}, []string) {
+	changed := make(map[string]interface{})
+	var removed []string
+	for key, value := range next {
+		if old, ok := prev[key]; !ok || !reflect.DeepEqual(old, value) {
+			changed[key] = value
+		}
+	}
+	for key := range prev {
+		if _, ok := next[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	return changed, removed
+}
+
+// JSON round trip, so payloads are compared exactly as clients see them
+func toPayload(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+func validTopic(topic string) bool {
+	switch {
+	case topic == wsTopicStats, topic == wsTopicBlocks:
+		return true
+	case strings.HasPrefix(topic, wsTopicAccount):
+		return loginPattern.MatchString(strings.TrimPrefix(topic, wsTopicAccount))
+	case strings.HasPrefix(topic, wsTopicWorker):
+		parts := strings.SplitN(strings.TrimPrefix(topic, wsTopicWorker), ":", 2)
+		return len(parts) == 2 && loginPattern.MatchString(parts[0]) && workerPattern.MatchString(parts[1])
+	}
+	return false
+}
+
+func (s *ApiServer) startWs() {
+	cfg := &s.config.Ws
+	if cfg.MaxTopics <= 0 {
+		cfg.MaxTopics = defaultMaxTopics
+	}
+	s.wsPing = util.MustParseDuration(cfg.PingInterval)
+	s.wsWriteTimeout = util.MustParseDuration(cfg.WriteTimeout)
+	s.ws = newWsHub()
+	go s.relayEvents()
+}
+
+// Pool events published by proxy and payouts are pushed to blocks and account topics as they arrive
+func (s *ApiServer) relayEvents() {
+	for {
+		err := s.backend.SubscribeEvents(func(event *storage.Event) {
+			if strings.HasPrefix(event.Type, "block.") {
+				s.ws.publishEvent(wsTopicBlocks, event)
+			}
+			for _, key := range []string{"finder", "login"} {
+				if login, ok := event.Data[key].(string); ok && s.ws.hasTopic(wsTopicAccount+login) {
+					s.ws.publishEvent(wsTopicAccount+login, event)
+				}
+			}
+		})
+		log.Errorf("Events subscription failed: %v, reconnecting in %v", err, eventsReconnectDelay)
+		time.Sleep(eventsReconnectDelay)
+	}
+}
+
+// Refresh every topic that has subscribers, accounts are fetched once per login
+func (s *ApiServer) pushStats() {
+	if s.ws == nil {
+		return
+	}
+	accounts := make(map[string]map[string]interface{})
+	for _, topic := range s.ws.activeTopics() {
+		payload, err := s.topicPayload(topic, accounts)
+		if err != nil {
+			if err != errNotFound {
+				log.Errorf("Failed to fetch %v for WebSocket clients: %v", topic, err)
+			}
+			continue
+		}
+		s.ws.publish(topic, payload)
+	}
+}
+
+func (s *ApiServer) topicPayload(topic string, accounts map[string]map[string]interface{}) (map[string]interface{}, error) {
+	if topic == wsTopicStats || topic == wsTopicBlocks {
+		stats := s.getStats()
+		if stats == nil {
+			return nil, errNotFound
+		}
+		reply := make(map[string]interface{})
+		if topic == wsTopicStats {
+			for _, key := range []string{"stats", "hashrate", "minersTotal", "maturedTotal", "immatureTotal", "candidatesTotal"} {
+				reply[key] = stats[key]
+			}
+		} else {
+			for _, key := range []string{"matured", "maturedTotal", "immature", "immatureTotal", "candidates", "candidatesTotal", "luck"} {
+				reply[key] = stats[key]
+			}
+		}
+		return toPayload(reply)
+	}
+
+	var login, id string
+	if strings.HasPrefix(topic, wsTopicAccount) {
+		login = strings.TrimPrefix(topic, wsTopicAccount)
+	} else {
+		parts := strings.SplitN(strings.TrimPrefix(topic, wsTopicWorker), ":", 2)
+		login, id = parts[0], parts[1]
+	}
+	stats, ok := accounts[login]
+	if !ok {
+		var exist bool
+		var err error
+		stats, exist, err = s.getMinerStats(login)
+		if !exist {
+			return nil, errNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		accounts[login] = stats
+	}
+	if len(id) == 0 {
+		return toPayload(stats)
+	}
+	worker, ok := stats["workers"].(map[string]storage.Worker)[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return toPayload(worker)
+}
+
+/* Push API, clients subscribe to "stats", "blocks", "account:<login>" or "worker:<login>:<id>".
+ * Snapshot is sent on subscribe, diffs follow after every stats collection.
+ */
+func (s *ApiServer) WsIndex(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader has already replied with error
+		return
+	}
+	c := &wsClient{conn: conn, out: make(chan []byte, wsQueueSize), quit: make(chan struct{}), topics: make(map[string]bool)}
+	if !s.ws.register(c, s.config.Ws.MaxClients) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too many clients"), time.Now().Add(s.wsWriteTimeout))
+		conn.Close()
+		return
+	}
+	go s.writeWsClient(c)
+	s.readWsClient(c)
+	s.ws.unregister(c)
+	close(c.quit)
+}
+
+func (s *ApiServer) readWsClient(c *wsClient) {
+	defer c.conn.Close()
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(2 * s.wsPing))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(2 * s.wsPing))
+	})
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			return
+		}
+		s.handleWsRequest(c, &req)
+	}
+}
+
+func (s *ApiServer) handleWsRequest(c *wsClient, req *wsRequest) {
+	if !validTopic(req.Topic) {
+		c.sendMessage(&wsMessage{Topic: req.Topic, Type: "error", Error: errUnknownTopic.Error()})
+		return
+	}
+	if !c.allowOp(time.Now()) {
+		c.sendMessage(&wsMessage{Topic: req.Topic, Type: "error", Error: errTooManyOps.Error()})
+		return
+	}
+	switch req.Op {
+	case "subscribe":
+		ok, err := s.ws.subscribe(c, req.Topic, s.config.Ws.MaxTopics)
+		if err != nil {
+			c.sendMessage(&wsMessage{Topic: req.Topic, Type: "error", Error: err.Error()})
+			return
+		}
+		if ok {
+			return
+		}
+		payload, err := s.topicPayload(req.Topic, make(map[string]map[string]interface{}))
+		switch {
+		case err == nil:
+			s.ws.publish(req.Topic, payload)
+		case req.Topic == wsTopicStats || req.Topic == wsTopicBlocks:
+			// Stats are not collected yet, snapshot comes with the first collection
+		default:
+			s.ws.unsubscribe(c, req.Topic)
+			c.sendMessage(&wsMessage{Topic: req.Topic, Type: "error", Error: err.Error()})
+		}
+	case "unsubscribe":
+		s.ws.unsubscribe(c, req.Topic)
+	default:
+		c.sendMessage(&wsMessage{Topic: req.Topic, Type: "error", Error: "unknown op"})
+	}
+}
+
+func (s *ApiServer) writeWsClient(c *wsClient) {
+	ping := time.NewTicker(s.wsPing)
+	defer ping.Stop()
+	for {
+		select {
+		case data := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(s.wsWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.wsWriteTimeout)); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
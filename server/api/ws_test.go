@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testLogin = "0x0000000000000000000000000000000000000abc"
+
+func newTestWsClient(queue int) *wsClient {
+	return &wsClient{out: make(chan []byte, queue), quit: make(chan struct{}), topics: make(map[string]bool)}
+}
+
+func readWsMessage(t *testing.T, c *wsClient) *wsMessage {
+	select {
+	case data := <-c.out:
+		var msg wsMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Must queue valid JSON: %v", err)
+		}
+		return &msg
+	default:
+		return nil
+	}
+}
+
+func TestDiffPayload(t *testing.T) {
+	prev := map[string]interface{}{"hashrate": 1.0, "workers": map[string]interface{}{"rig": 1.0}, "gone": true}
+	next := map[string]interface{}{"hashrate": 2.0, "workers": map[string]interface{}{"rig": 1.0}, "new": "x"}
+	changed, removed := diffPayload(prev, next)
+	expected := map[string]interface{}{"hashrate": 2.0, "new": "x"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Must return only changed and added keys: %v", changed)
+	}
+	if !reflect.DeepEqual(removed, []string{"gone"}) {
+		t.Errorf("Must return removed keys: %v", removed)
+	}
+	changed, removed = diffPayload(next, next)
+	if len(changed) != 0 || len(removed) != 0 {
+		t.Errorf("Must return empty diff for equal payloads: %v %v", changed, removed)
+	}
+}
+
+func TestValidTopic(t *testing.T) {
+	valid := []string{"stats", "blocks", "account:" + testLogin, "worker:" + testLogin + ":rig-1"}
+	for _, topic := range valid {
+		if !validTopic(topic) {
+			t.Errorf("Must accept %v", topic)
+		}
+	}
+	invalid := []string{"", "miners", "account:0x1", "account:" + strings.ToUpper(testLogin), "worker:" + testLogin, "worker:" + testLogin + ":too-long-id"}
+	for _, topic := range invalid {
+		if validTopic(topic) {
+			t.Errorf("Must reject %v", topic)
+		}
+	}
+}
+
+func TestWsHubSnapshotThenDiff(t *testing.T) {
+	h := newWsHub()
+	c := newTestWsClient(wsQueueSize)
+	h.register(c, 0)
+
+	ok, err := h.subscribe(c, wsTopicStats, 1)
+	if ok || err != nil {
+		t.Fatalf("Must ask to fetch topic without payload: %v %v", ok, err)
+	}
+	if _, err := h.subscribe(c, wsTopicBlocks, 1); err != errTooManyTopics {
+		t.Errorf("Must limit topics per client: %v", err)
+	}
+
+	h.publish(wsTopicStats, map[string]interface{}{"hashrate": 1.0, "minersTotal": 1.0})
+	msg := readWsMessage(t, c)
+	if msg == nil || msg.Type != "snapshot" || msg.Topic != wsTopicStats {
+		t.Fatalf("Must send snapshot first: %v", msg)
+	}
+
+	h.publish(wsTopicStats, map[string]interface{}{"hashrate": 1.0, "minersTotal": 1.0})
+	if msg := readWsMessage(t, c); msg != nil {
+		t.Errorf("Must not send empty diff: %v", msg)
+	}
+
+	h.publish(wsTopicStats, map[string]interface{}{"hashrate": 2.0})
+	msg = readWsMessage(t, c)
+	if msg == nil || msg.Type != "diff" || !reflect.DeepEqual(msg.Data, map[string]interface{}{"hashrate": 2.0}) || !reflect.DeepEqual(msg.Removed, []string{"minersTotal"}) {
+		t.Fatalf("Must send diff after snapshot: %v", msg)
+	}
+
+	other := newTestWsClient(wsQueueSize)
+	ok, _ = h.subscribe(other, wsTopicStats, 1)
+	msg = readWsMessage(t, other)
+	if !ok || msg == nil || msg.Type != "snapshot" || !reflect.DeepEqual(msg.Data, map[string]interface{}{"hashrate": 2.0}) {
+		t.Errorf("Must send last payload as snapshot to new subscriber: %v", msg)
+	}
+
+	h.unregister(c)
+	h.unsubscribe(other, wsTopicStats)
+	if h.hasTopic(wsTopicStats) || len(h.last) != 0 {
+		t.Error("Must drop topic without subscribers")
+	}
+}
+
+func TestWsClientOpsLimit(t *testing.T) {
+	c := newTestWsClient(1)
+	now := time.Now()
+	for i := 0; i < wsMaxOps; i++ {
+		if !c.allowOp(now) {
+			t.Fatalf("Must allow %v ops per interval", wsMaxOps)
+		}
+	}
+	if c.allowOp(now) {
+		t.Error("Must refuse ops above limit")
+	}
+	if !c.allowOp(now.Add(wsOpsInterval)) {
+		t.Error("Must allow ops again in the next interval")
+	}
+}
+
+func TestWsSlowClientDisconnect(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Must connect: %v", err)
+	}
+	defer client.Close()
+
+	c := newTestWsClient(1)
+	c.conn = <-conns
+	c.send([]byte("{}"))
+	c.send([]byte("{}"))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Error("Must disconnect client with full queue")
+	}
+}
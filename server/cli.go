@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/dmuth/google-go-log4go"
+
+	"bitbucket.org/vdidenko/dwarf/server/payouts"
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+)
+
+// Admin command working against backend of config file, which follows command arguments
+type command struct {
+	usage string
+	args  int
+	run   func(args []string) error
+}
+
+// Commands without action are registered with empty action
+var commands = map[string]map[string]command{
+	"miner": {
+		"show": {"miner show <login>", 1, showMiner},
+	},
+	"payouts": {
+		"pending": {"payouts pending", 0, showPendingPayments},
+		"resolve": {"payouts resolve [-force]", 0, resolvePayouts},
+		"retry":   {"payouts retry", 0, retryPayouts},
+	},
+	"blocks": {
+		"candidates": {"blocks candidates", 0, showCandidates},
+		"immature":   {"blocks immature", 0, showImmatureBlocks},
+	},
+	"ban": {
+		"add":  {"ban add <address>", 1, addBan},
+		"rm":   {"ban rm <address>", 1, removeBan},
+		"list": {"ban list", 0, showBans},
+	},
+	"balance": {
+		"credit": {"balance credit <login> <shannon> <operator> <reason>", 4, creditBalance},
+		"debit":  {"balance debit <login> <shannon> <operator> <reason>", 4, debitBalance},
+		"log":    {"balance log", 0, showAdjustments},
+	},
+	"bgsave": {
+		"": {"bgsave", 0, bgSave},
+	},
+	"finances": {
+		"": {"finances", 0, showFinances},
+	},
+}
+
+// Skips safety checks of commands which can't prove nothing else is running
+var force bool
+
+// Usage: <command> [action] [-force] [args...] [config.json]
+func runCommand(args []string) {
+	actions := commands[args[0]]
+	action, rest := "", args[1:]
+	if len(rest) > 0 {
+		if _, ok := actions[rest[0]]; ok {
+			action, rest = rest[0], rest[1:]
+		}
+	}
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.BoolVar(&force, "force", false, "Skip safety checks")
+	flags.Parse(rest)
+	rest = flags.Args()
+
+	c, ok := actions[action]
+	if !ok || len(rest) < c.args {
+		printUsage(actions)
+		os.Exit(2)
+	}
+
+	readConfig(&cfg, configPath(rest[c.args:]))
+	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+
+	if err := c.run(rest[:c.args]); err != nil {
+		log.Errorf("%v failed: %v", c.usage, err)
+		os.Exit(1)
+	}
+}
+
+func printUsage(actions map[string]command) {
+	var usage []string
+	for _, c := range actions {
+		usage = append(usage, c.usage)
+	}
+	sort.Strings(usage)
+	for _, u := range usage {
+		log.Errorf("Usage: %v [config.json]", u)
+	}
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func showMiner(args []string) error {
+	login := strings.ToLower(args[0])
+	exist, err := backend.IsMinerExists(login)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return fmt.Errorf("miner %v not found", login)
+	}
+	stats, err := backend.GetMinerStats(login, cfg.Api.Payments)
+	if err != nil {
+		return err
+	}
+	return printJSON(stats)
+}
+
+func showPendingPayments(args []string) error {
+	locked, err := backend.IsPayoutsLocked()
+	if err != nil {
+		return err
+	}
+	payments := backend.GetPendingPayments()
+	if payments == nil {
+		payments = []*storage.PendingPayment{}
+	}
+	return printJSON(map[string]interface{}{"locked": locked, "payments": payments})
+}
+
+/* Same as RESOLVE_PAYOUT=1. Rolling back a payment whose transaction is in flight pays twice,
+ * so it's refused unless payouts are known to be stopped: no instance holds the leader lease.
+ * Halted status may be left by a previous process, without leader election operator has to confirm it with -force.
+ */
+func resolvePayouts(args []string) error {
+	if cfg.Payouts.Leader.Enabled {
+		holder, err := backend.GetLeaseHolder("payouts")
+		if err != nil {
+			return err
+		}
+		if len(holder) > 0 {
+			return fmt.Errorf("payouts are running on %v, stop them first", holder)
+		}
+	} else if !force {
+		return fmt.Errorf("can't tell whether payouts are running without leader election, stop them and rerun with -force")
+	}
+	return payouts.NewPayoutsProcessor(&cfg.Payouts, backend).ResolvePayouts()
+}
+
+func retryPayouts(args []string) error {
+	if err := backend.RequestResume("payouts"); err != nil {
+		return err
+	}
+	log.Info("Requested resume of payouts, they will be resumed on the next run if checks pass")
+	return nil
+}
+
+func showCandidates(args []string) error {
+	blocks, err := backend.GetCandidates(math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]interface{}{"candidates": blocks})
+}
+
+func showImmatureBlocks(args []string) error {
+	blocks, err := backend.GetImmatureBlocks(math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]interface{}{"immature": blocks})
+}
+
+func addBan(args []string) error {
+	address := strings.ToLower(args[0])
+	if err := backend.AddBlacklist(address); err != nil {
+		return err
+	}
+	log.Infof("Blacklisted %v, proxies will ban it on next policy refresh", address)
+	return nil
+}
+
+func removeBan(args []string) error {
+	address := strings.ToLower(args[0])
+	removed, err := backend.RemoveBlacklist(address)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("%v is not blacklisted", address)
+	}
+	log.Infof("Removed %v from blacklist", address)
+	return nil
+}
+
+func showBans(args []string) error {
+	blacklist, err := backend.GetBlacklist()
+	if err != nil {
+		return err
+	}
+	bans, err := backend.GetBans()
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]interface{}{"blacklist": blacklist, "bans": bans})
+}
+
+func bgSave(args []string) error {
+	result, err := backend.BgSave()
+	if err != nil {
+		return err
+	}
+	log.Infof("Saving backend state to disk: %v", result)
+	return nil
+}
+
+func showFinances(args []string) error {
+	finances, err := backend.GetFinances()
+	if err != nil {
+		return err
+	}
+	return printJSON(finances)
+}
+
+func creditBalance(args []string) error {
+	return adjustBalance(args, 1)
+}
+
+func debitBalance(args []string) error {
+	return adjustBalance(args, -1)
+}
+
+func adjustBalance(args []string, sign int64) error {
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || amount <= 0 {
+		return fmt.Errorf("amount must be a positive number of Shannon: %v", args[1])
+	}
+	adj, err := backend.AdjustBalance(strings.ToLower(args[0]), sign*amount, strings.TrimSpace(args[3]), args[2])
+	if err != nil {
+		return err
+	}
+	log.Infof("Adjusted balance of %v by %v Shannon", adj.Login, adj.Amount)
+	return printJSON(adj)
+}
+
+func showAdjustments(args []string) error {
+	adjustments, err := backend.GetAdjustments(0, 100)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]interface{}{"adjustments": adjustments})
+}
@@ -0,0 +1,251 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/dmuth/google-go-log4go"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+type Endpoint struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Secret string `json:"secret"`
+	// Event types to deliver, empty list means all
+	Events []string `json:"events"`
+}
+
+type Config struct {
+	Enabled   bool       `json:"enabled"`
+	Endpoints []Endpoint `json:"endpoints"`
+	Interval  string     `json:"interval"`
+	Timeout   string     `json:"timeout"`
+	// Failed delivery is moved to dead letter list after this many retries
+	Retries         int    `json:"retries"`
+	RetryBackoff    string `json:"retryBackoff"`
+	MaxRetryBackoff string `json:"maxRetryBackoff"`
+}
+
+const retryBatch = 100
+
+// Single event for a single endpoint, kept in retry set and dead letter list as JSON
+type delivery struct {
+	Endpoint string         `json:"endpoint"`
+	Attempt  int            `json:"attempt"`
+	Error    string         `json:"error,omitempty"`
+	Event    *storage.Event `json:"event"`
+}
+
+type Dispatcher struct {
+	config          *Config
+	backend         *storage.RedisClient
+	client          *http.Client
+	interval        time.Duration
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	endpoints       map[string]*Endpoint
+}
+
+func NewDispatcher(cfg *Config, backend *storage.RedisClient) *Dispatcher {
+	d := &Dispatcher{config: cfg, backend: backend, endpoints: make(map[string]*Endpoint)}
+	d.interval = util.MustParseDuration(cfg.Interval)
+	d.retryBackoff = util.MustParseDuration(cfg.RetryBackoff)
+	d.maxRetryBackoff = util.MustParseDuration(cfg.MaxRetryBackoff)
+	d.client = &http.Client{Timeout: util.MustParseDuration(cfg.Timeout)}
+	for i, e := range cfg.Endpoints {
+		if len(e.Name) == 0 {
+			panic(fmt.Sprintf("events: Endpoint %v must have a name", e.Url))
+		}
+		if _, ok := d.endpoints[e.Name]; ok {
+			panic(fmt.Sprintf("events: Duplicate endpoint name %v", e.Name))
+		}
+		d.endpoints[e.Name] = &cfg.Endpoints[i]
+	}
+	return d
+}
+
+func (d *Dispatcher) Start() {
+	log.Info("Starting event dispatcher")
+	if n, err := d.backend.RecoverEvents(); err != nil {
+		log.Errorf("Failed to recover unfinished events: %v", err)
+	} else if n > 0 {
+		log.Warnf("Recovered %v unfinished events, they will be delivered again", n)
+	}
+	timer := time.NewTimer(d.interval)
+	log.Infof("Set event dispatch interval to %v", d.interval)
+
+	d.dispatch(time.Now())
+	timer.Reset(d.interval)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				d.dispatch(time.Now())
+				timer.Reset(d.interval)
+			}
+		}
+	}()
+}
+
+func (d *Dispatcher) dispatch(now time.Time) {
+	d.drainOutbox()
+	d.processRetries(now)
+}
+
+// Event is removed from processing only when every endpoint got it or has it scheduled for retry
+func (d *Dispatcher) drainOutbox() {
+	for {
+		raw, event, err := d.backend.PopEvent()
+		if err != nil && len(raw) > 0 {
+			log.Errorf("Dropping malformed event %v: %v", raw, err)
+			d.backend.AckEvent(raw)
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to pop event from outbox: %v", err)
+			return
+		}
+		if event == nil {
+			return
+		}
+		var wg sync.WaitGroup
+		for name, e := range d.endpoints {
+			if !e.accepts(event.Type) {
+				continue
+			}
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				d.attempt(&delivery{Endpoint: name, Event: event}, time.Now())
+			}(name)
+		}
+		wg.Wait()
+		if err := d.backend.AckEvent(raw); err != nil {
+			log.Errorf("Failed to ack event %v: %v", event.Id, err)
+		}
+	}
+}
+
+func (d *Dispatcher) processRetries(now time.Time) {
+	due, err := d.backend.PopEventRetries(now.Unix(), retryBatch)
+	if err != nil {
+		log.Errorf("Failed to get event retries from backend: %v", err)
+	}
+	var wg sync.WaitGroup
+	for _, raw := range due {
+		var v delivery
+		if err := json.Unmarshal([]byte(raw), &v); err != nil {
+			log.Errorf("Dropping malformed event delivery %v: %v", raw, err)
+			continue
+		}
+		wg.Add(1)
+		go func(v *delivery) {
+			defer wg.Done()
+			d.attempt(v, now)
+		}(&v)
+	}
+	wg.Wait()
+}
+
+// Failed delivery is rescheduled with exponential backoff, or moved to dead letters once retries are exhausted
+func (d *Dispatcher) attempt(v *delivery, now time.Time) {
+	e, ok := d.endpoints[v.Endpoint]
+	if !ok {
+		log.Warnf("Dropping event %v for removed endpoint %v", v.Event.Id, v.Endpoint)
+		return
+	}
+	err := d.send(e, v.Event)
+	if err == nil {
+		return
+	}
+	v.Attempt++
+	v.Error = err.Error()
+	data, _ := json.Marshal(v)
+	if v.Attempt > d.config.Retries {
+		log.Errorf("Giving up on %v event %v for %v after %v attempts: %v", v.Event.Type, v.Event.Id, v.Endpoint, v.Attempt, err)
+		if err := d.backend.WriteDeadEvent(string(data)); err != nil {
+			log.Errorf("Failed to write dead event to backend: %v", err)
+		}
+		return
+	}
+	at := now.Add(d.backoff(v.Attempt))
+	log.Warnf("Failed to deliver %v event %v to %v: %v, retrying at %v", v.Event.Type, v.Event.Id, v.Endpoint, err, at)
+	if err := d.backend.ScheduleEventRetry(string(data), at.Unix()); err != nil {
+		log.Errorf("Failed to schedule event retry: %v", err)
+	}
+}
+
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	backoff := d.retryBackoff
+	for i := 1; i < attempt && backoff < d.maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.maxRetryBackoff {
+		backoff = d.maxRetryBackoff
+	}
+	return backoff
+}
+
+func (d *Dispatcher) send(e *Endpoint, event *storage.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pool-Event", event.Type)
+	req.Header.Set("X-Pool-Delivery", strconv.FormatInt(event.Id, 10))
+	if len(e.Secret) > 0 {
+		req.Header.Set("X-Pool-Signature", Sign(e.Secret, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint replied with %v", resp.Status)
+	}
+	return nil
+}
+
+func (e *Endpoint) accepts(kind string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, v := range e.Events {
+		if v == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Value of X-Pool-Signature header, receivers compute HMAC-SHA256 of raw body with shared secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Write event to outbox, failures are only logged as events must never break the caller
+func Emit(backend *storage.RedisClient, kind string, data map[string]interface{}) {
+	if _, err := backend.WriteEvent(kind, data); err != nil {
+		log.Errorf("Failed to write %v event to backend: %v", kind, err)
+	}
+}
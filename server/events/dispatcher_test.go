@@ -0,0 +1,96 @@
+package events
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+)
+
+func newTestDispatcher(url string, retries int) *Dispatcher {
+	backend := storage.NewRedisClient(&storage.Config{Endpoint: "127.0.0.1:6379"}, "eventstest")
+	return NewDispatcher(&Config{
+		Endpoints:       []Endpoint{{Name: "test", Url: url, Secret: "secret"}},
+		Interval:        "1s",
+		Timeout:         "1s",
+		Retries:         retries,
+		RetryBackoff:    "1s",
+		MaxRetryBackoff: "4s",
+	}, backend)
+}
+
+func TestSignedDelivery(t *testing.T) {
+	var received *storage.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Pool-Signature") != Sign("secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher(server.URL, 0)
+	Emit(d.backend, storage.EventBlockCandidate, map[string]interface{}{"height": 1})
+	d.dispatch(time.Now())
+	if received == nil || received.Type != storage.EventBlockCandidate || received.Data["height"] != 1.0 {
+		t.Errorf("Must deliver signed event: %v", received)
+	}
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher(server.URL, 1)
+	event, err := d.backend.WriteEvent(storage.EventPayoutsHalted, nil)
+	if err != nil {
+		t.Fatalf("Must write event: %v", err)
+	}
+	now := time.Now()
+	d.dispatch(now)
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("Must try delivery once: %v", requests)
+	}
+	d.dispatch(now)
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Error("Must not retry before backoff")
+	}
+	d.dispatch(now.Add(2 * time.Second))
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("Must retry after backoff: %v", requests)
+	}
+
+	dead, _ := d.backend.GetDeadEvents(1)
+	var v delivery
+	if len(dead) == 0 || json.Unmarshal([]byte(dead[0]), &v) != nil || v.Event.Id != event.Id || v.Attempt != 2 {
+		t.Errorf("Must move delivery to dead letters once retries are exhausted: %v", dead)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{retryBackoff: time.Second, maxRetryBackoff: 5 * time.Second}
+	if d.backoff(1) != time.Second || d.backoff(3) != 4*time.Second || d.backoff(10) != 5*time.Second {
+		t.Error("Must double backoff up to max")
+	}
+}
+
+func TestEndpointFilter(t *testing.T) {
+	e := &Endpoint{Events: []string{storage.EventBlockOrphaned}}
+	if !e.accepts(storage.EventBlockOrphaned) || e.accepts(storage.EventPaymentSent) {
+		t.Error("Must deliver only listed events")
+	}
+	if !(&Endpoint{}).accepts(storage.EventPaymentSent) {
+		t.Error("Must deliver everything if no events are listed")
+	}
+}
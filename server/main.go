@@ -14,6 +14,8 @@ import (
     log "github.com/dmuth/google-go-log4go"
 
 	"bitbucket.org/vdidenko/dwarf/server/api"
+	"bitbucket.org/vdidenko/dwarf/server/events"
+	"bitbucket.org/vdidenko/dwarf/server/notify"
 	"bitbucket.org/vdidenko/dwarf/server/payouts"
 	"bitbucket.org/vdidenko/dwarf/server/proxy"
 	"bitbucket.org/vdidenko/dwarf/server/storage"
@@ -42,6 +44,16 @@ func startPayoutsProcessor() {
 	u.Start()
 }
 
+func startNotifier() {
+	n := notify.NewNotifier(&cfg.Notifier, backend)
+	n.Start()
+}
+
+func startEventDispatcher() {
+	d := events.NewDispatcher(&cfg.Events, backend)
+	d.Start()
+}
+
 func startNewrelic() {
 	if cfg.NewrelicEnabled {
 		nr := gorelic.NewAgent()
@@ -52,11 +64,15 @@ func startNewrelic() {
 	}
 }
 
-func readConfig(cfg *proxy.Config) {
-	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+// Config file is the first positional argument, "config.json" by default
+func configPath(args []string) string {
+	if len(args) > 0 {
+		return args[0]
 	}
+	return "config.json"
+}
+
+func readConfig(cfg *proxy.Config, configFileName string) {
 	configFileName, _ = filepath.Abs(configFileName)
 
 	log.Infof("Loading config: %v", configFileName)
@@ -75,7 +91,21 @@ func readConfig(cfg *proxy.Config) {
 func main() {
 	log.SetLevel(log.InfoLevel)
 	log.SetDisplayTime(true)
-	readConfig(&cfg)
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "resume" {
+		runResume(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	readConfig(&cfg, configPath(os.Args[1:]))
 	rand.Seed(time.Now().UnixNano())
 
 	if cfg.Threads > 0 {
@@ -105,6 +135,12 @@ func main() {
 	if cfg.Payouts.Enabled {
 		go startPayoutsProcessor()
 	}
+	if cfg.Notifier.Enabled {
+		go startNotifier()
+	}
+	if cfg.Events.Enabled {
+		go startEventDispatcher()
+	}
 	quit := make(chan bool)
 	<-quit
 }
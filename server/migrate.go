@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"sort"
+
+	log "github.com/dmuth/google-go-log4go"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+)
+
+// Usage: migrate [-dry-run] [config.json]
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only count legacy records, do not rewrite them")
+	flags.Parse(args)
+
+	readConfig(&cfg, configPath(flags.Args()))
+	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+
+	result, err := backend.MigrateRecords(*dryRun)
+	var keys []string
+	for key := range result {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	total := int64(0)
+	for _, key := range keys {
+		total += result[key]
+		log.Infof("%v: %v legacy records", key, result[key])
+	}
+	if err != nil {
+		log.Errorf("Migration failed: %v", err)
+		os.Exit(1)
+	}
+	if *dryRun {
+		log.Infof("Dry run, %v legacy records in %v keys left intact", total, len(keys))
+	} else {
+		log.Infof("Migrated %v legacy records in %v keys", total, len(keys))
+	}
+}
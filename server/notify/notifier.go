@@ -0,0 +1,285 @@
+package notify
+
+import (
+	"time"
+
+	log "github.com/dmuth/google-go-log4go"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+type SmtpConfig struct {
+	// host:port of mail server
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+type Config struct {
+	Enabled             bool   `json:"enabled"`
+	Interval            string `json:"interval"`
+	HashrateWindow      string `json:"hashrateWindow"`
+	HashrateLargeWindow string `json:"hashrateLargeWindow"`
+	// Worker state must hold this long to be reported
+	Debounce string `json:"debounce"`
+	// Report drop of current hashrate below large window one by this percent, 0 disables
+	DropPercent float64 `json:"dropPercent"`
+	// Max notifications per subscription in rateInterval, 0 is unlimited
+	RateLimit    int        `json:"rateLimit"`
+	RateInterval string     `json:"rateInterval"`
+	Retries      int        `json:"retries"`
+	RetryBackoff string     `json:"retryBackoff"`
+	Timeout      string     `json:"timeout"`
+	Smtp         SmtpConfig `json:"smtp"`
+}
+
+const (
+	EventOffline           = "offline"
+	EventOnline            = "online"
+	EventHashrateDrop      = "hashrateDrop"
+	EventHashrateRecovered = "hashrateRecovered"
+)
+
+const (
+	stateOnline = iota
+	stateOffline
+	stateDropped
+)
+
+const (
+	deliveryWorkers = 4
+	deliveryQueue   = 1024
+)
+
+type Notification struct {
+	Login       string `json:"login"`
+	Worker      string `json:"worker"`
+	Event       string `json:"event"`
+	Hashrate    int64  `json:"hashrate"`
+	AvgHashrate int64  `json:"avgHashrate"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+type workerState struct {
+	stable  int
+	pending int
+	since   time.Time
+	seen    bool
+}
+
+type delivery struct {
+	sub          *storage.Subscription
+	notification Notification
+}
+
+type Notifier struct {
+	config       *Config
+	backend      *storage.RedisClient
+	interval     time.Duration
+	sWindow      time.Duration
+	lWindow      time.Duration
+	debounce     time.Duration
+	retryBackoff time.Duration
+	states       map[string]*workerState
+	limiter      *rateLimiter
+	queue        chan delivery
+	senders      map[string]sender
+}
+
+func NewNotifier(cfg *Config, backend *storage.RedisClient) *Notifier {
+	n := &Notifier{config: cfg, backend: backend, states: make(map[string]*workerState), queue: make(chan delivery, deliveryQueue)}
+	n.interval = util.MustParseDuration(cfg.Interval)
+	n.sWindow = util.MustParseDuration(cfg.HashrateWindow)
+	n.lWindow = util.MustParseDuration(cfg.HashrateLargeWindow)
+	n.debounce = util.MustParseDuration(cfg.Debounce)
+	n.retryBackoff = util.MustParseDuration(cfg.RetryBackoff)
+	n.limiter = newRateLimiter(cfg.RateLimit, util.MustParseDuration(cfg.RateInterval))
+	n.senders = map[string]sender{
+		storage.SubscriptionWebhook: newWebhookSender(util.MustParseDuration(cfg.Timeout)),
+		storage.SubscriptionEmail:   &emailSender{config: cfg.Smtp},
+	}
+	return n
+}
+
+func (n *Notifier) Start() {
+	log.Info("Starting notifier")
+	for i := 0; i < deliveryWorkers; i++ {
+		go n.deliverLoop()
+	}
+	timer := time.NewTimer(n.interval)
+	log.Infof("Set notifier check interval to %v", n.interval)
+
+	n.check(time.Now())
+	timer.Reset(n.interval)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				n.check(time.Now())
+				timer.Reset(n.interval)
+			}
+		}
+	}()
+}
+
+func (n *Notifier) check(now time.Time) {
+	logins, err := n.backend.GetSubscribers()
+	if err != nil {
+		log.Errorf("Failed to get subscribers from backend: %v", err)
+		return
+	}
+	for _, state := range n.states {
+		state.seen = false
+	}
+	for _, login := range logins {
+		stats, err := n.backend.CollectWorkersStats(n.sWindow, n.lWindow, login)
+		if err != nil {
+			log.Errorf("Failed to get workers stats of %v from backend: %v", login, err)
+			continue
+		}
+		for id, worker := range stats["workers"].(map[string]storage.Worker) {
+			event := n.observe(login+":"+id, n.classify(worker), now)
+			if len(event) == 0 {
+				continue
+			}
+			n.notify(Notification{
+				Login:       login,
+				Worker:      id,
+				Event:       event,
+				Hashrate:    worker.HR,
+				AvgHashrate: worker.TotalHR,
+				Timestamp:   now.Unix(),
+			})
+		}
+	}
+	// Forget workers gone from stats
+	for key, state := range n.states {
+		if !state.seen {
+			delete(n.states, key)
+		}
+	}
+}
+
+func (n *Notifier) classify(worker storage.Worker) int {
+	if worker.Offline {
+		return stateOffline
+	}
+	limit := float64(worker.TotalHR) * (1 - n.config.DropPercent/100)
+	if n.config.DropPercent > 0 && worker.TotalHR > 0 && float64(worker.HR) < limit {
+		return stateDropped
+	}
+	return stateOnline
+}
+
+/* Returns event once a new state of worker holds for debounce time.
+ * The first observation is a baseline, so restart doesn't notify about every offline worker.
+ */
+func (n *Notifier) observe(key string, state int, now time.Time) string {
+	s, ok := n.states[key]
+	if !ok {
+		n.states[key] = &workerState{stable: state, pending: state, seen: true}
+		return ""
+	}
+	s.seen = true
+	if state == s.stable {
+		s.pending = state
+		return ""
+	}
+	if state != s.pending {
+		s.pending = state
+		s.since = now
+	}
+	if now.Sub(s.since) < n.debounce {
+		return ""
+	}
+	from := s.stable
+	s.stable = state
+	switch {
+	case state == stateOffline:
+		return EventOffline
+	case from == stateOffline:
+		return EventOnline
+	case state == stateDropped:
+		return EventHashrateDrop
+	}
+	return EventHashrateRecovered
+}
+
+func (n *Notifier) notify(notification Notification) {
+	subs, err := n.backend.GetSubscriptions(notification.Login)
+	if err != nil {
+		log.Errorf("Failed to get subscriptions of %v from backend: %v", notification.Login, err)
+		return
+	}
+	for _, sub := range subs {
+		if !n.limiter.allow(sub.Id, time.Unix(notification.Timestamp, 0)) {
+			log.Warnf("Notification %v for %v.%v to %v is rate limited", notification.Event, notification.Login, notification.Worker, sub.Id)
+			continue
+		}
+		select {
+		case n.queue <- delivery{sub: sub, notification: notification}:
+		default:
+			log.Errorf("Notification queue is full, dropping %v for %v", notification.Event, notification.Login)
+		}
+	}
+}
+
+func (n *Notifier) deliverLoop() {
+	for d := range n.queue {
+		if err := n.deliver(d); err != nil {
+			log.Errorf("Failed to deliver %v notification for %v to %v: %v", d.notification.Event, d.notification.Login, d.sub.Kind, err)
+		}
+	}
+}
+
+// Retries with exponential backoff
+func (n *Notifier) deliver(d delivery) error {
+	s, ok := n.senders[d.sub.Kind]
+	if !ok {
+		return errUnknownKind
+	}
+	backoff := n.retryBackoff
+	var err error
+	for attempt := 0; attempt <= n.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = s.send(d.sub.Target, d.notification); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Sliding window limit of notifications per subscription, used from check loop only
+type rateLimiter struct {
+	limit    int
+	interval time.Duration
+	sent     map[string][]time.Time
+}
+
+func newRateLimiter(limit int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, interval: interval, sent: make(map[string][]time.Time)}
+}
+
+func (l *rateLimiter) allow(id string, now time.Time) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	recent := l.sent[id][:0]
+	for _, ts := range l.sent[id] {
+		if now.Sub(ts) < l.interval {
+			recent = append(recent, ts)
+		}
+	}
+	if len(recent) >= l.limit {
+		l.sent[id] = recent
+		return false
+	}
+	l.sent[id] = append(recent, now)
+	return true
+}
@@ -0,0 +1,172 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+)
+
+func TestObserveDebounce(t *testing.T) {
+	n := &Notifier{states: make(map[string]*workerState), debounce: 5 * time.Minute}
+	now := time.Now()
+
+	if n.observe("x:rig", stateOffline, now) != "" {
+		t.Error("Must take first observation as a baseline")
+	}
+	if n.observe("x:rig", stateOnline, now) != "" {
+		t.Error("Must not report before debounce time")
+	}
+	if n.observe("x:rig", stateOffline, now.Add(time.Minute)) != "" || n.observe("x:rig", stateOnline, now.Add(2*time.Minute)) != "" {
+		t.Error("Must restart debounce when state flaps")
+	}
+	if e := n.observe("x:rig", stateOnline, now.Add(7*time.Minute)); e != EventOnline {
+		t.Errorf("Must report state held for debounce time: %v", e)
+	}
+	n.observe("x:rig", stateDropped, now.Add(8*time.Minute))
+	if e := n.observe("x:rig", stateDropped, now.Add(13*time.Minute)); e != EventHashrateDrop {
+		t.Errorf("Must report hashrate drop: %v", e)
+	}
+	n.observe("x:rig", stateOnline, now.Add(14*time.Minute))
+	if e := n.observe("x:rig", stateOnline, now.Add(19*time.Minute)); e != EventHashrateRecovered {
+		t.Errorf("Must report hashrate recovery: %v", e)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	n := &Notifier{config: &Config{DropPercent: 50}}
+	if n.classify(storage.Worker{Miner: storage.Miner{HR: 40}, TotalHR: 100}) != stateDropped {
+		t.Error("Must detect hashrate drop")
+	}
+	if n.classify(storage.Worker{Miner: storage.Miner{HR: 60}, TotalHR: 100}) != stateOnline {
+		t.Error("Must tolerate drop below threshold")
+	}
+	if n.classify(storage.Worker{Miner: storage.Miner{HR: 100, Offline: true}, TotalHR: 100}) != stateOffline {
+		t.Error("Must detect offline worker")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, time.Hour)
+	now := time.Now()
+	if !l.allow("a", now) || !l.allow("a", now) || l.allow("a", now) {
+		t.Error("Must allow only limit notifications in interval")
+	}
+	if !l.allow("b", now) {
+		t.Error("Must limit each subscription separately")
+	}
+	if !l.allow("a", now.Add(time.Hour)) {
+		t.Error("Must allow again after interval")
+	}
+}
+
+func TestDeliverWebhookWithRetries(t *testing.T) {
+	var requests int32
+	var received Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	// Local sink is private, so it's reached without the public address check
+	n := &Notifier{config: &Config{Retries: 2}, retryBackoff: time.Millisecond, senders: map[string]sender{
+		storage.SubscriptionWebhook: &webhookSender{client: server.Client()},
+	}}
+	sub := &storage.Subscription{Kind: storage.SubscriptionWebhook, Target: server.URL}
+	err := n.deliver(delivery{sub: sub, notification: Notification{Login: "x", Worker: "rig", Event: EventOffline}})
+	if err != nil {
+		t.Fatalf("Must deliver after retry: %v", err)
+	}
+	if requests != 2 || received.Login != "x" || received.Event != EventOffline {
+		t.Errorf("Must post notification: %v %v", requests, received)
+	}
+}
+
+func TestWebhookRefusesPrivateTarget(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	err := newWebhookSender(time.Second).send(server.URL, Notification{Login: "x"})
+	if err == nil || atomic.LoadInt32(&requests) != 0 {
+		t.Errorf("Must not connect to loopback webhook: %v", err)
+	}
+}
+
+// Accepts a single message and returns its data
+func smtpStandIn(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost\r\n"))
+		var body []string
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case inData && line == ".":
+				inData = false
+				data <- strings.Join(body, "\n")
+				conn.Write([]byte("250 OK\r\n"))
+			case inData:
+				body = append(body, line)
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				conn.Write([]byte("354 Go ahead\r\n"))
+			case strings.HasPrefix(line, "QUIT"):
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return l.Addr().String(), data
+}
+
+func TestDeliverEmail(t *testing.T) {
+	addr, data := smtpStandIn(t)
+	n := &Notifier{config: &Config{}, senders: map[string]sender{
+		storage.SubscriptionEmail: &emailSender{config: SmtpConfig{Address: addr, From: "pool@example.net"}},
+	}}
+	sub := &storage.Subscription{Kind: storage.SubscriptionEmail, Target: "miner@example.net"}
+	err := n.deliver(delivery{sub: sub, notification: Notification{Login: "x", Worker: "rig", Event: EventOffline}})
+	if err != nil {
+		t.Fatalf("Must send email: %v", err)
+	}
+	select {
+	case msg := <-data:
+		if !strings.Contains(msg, "To: miner@example.net") || !strings.Contains(msg, "Subject: Worker rig is offline") {
+			t.Errorf("Wrong message: %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("Mail server must receive message")
+	}
+}
@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"syscall"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+var errUnknownKind = errors.New("unknown subscription kind")
+var errPrivateTarget = errors.New("webhook target is not a public address")
+
+type sender interface {
+	send(target string, notification Notification) error
+}
+
+type webhookSender struct {
+	client *http.Client
+}
+
+/* Anyone can register a webhook, so every connection including redirects is checked after DNS resolution
+ * and internal hosts of the pool are never reached.
+ */
+func newWebhookSender(timeout time.Duration) *webhookSender {
+	dialer := &net.Dialer{Timeout: timeout, Control: publicOnly}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	return &webhookSender{client: &http.Client{Timeout: timeout, Transport: transport}}
+}
+
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !util.IsPublicIP(ip) {
+		return errPrivateTarget
+	}
+	return nil
+}
+
+func (s *webhookSender) send(target string, notification Notification) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(target, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook replied with status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+type emailSender struct {
+	config SmtpConfig
+}
+
+func (s *emailSender) send(target string, notification Notification) error {
+	if len(s.config.Address) == 0 {
+		return errors.New("SMTP is not configured")
+	}
+	var auth smtp.Auth
+	if len(s.config.Username) > 0 {
+		host, _, _ := net.SplitHostPort(s.config.Address)
+		auth = smtp.PlainAuth("", s.config.Username, s.config.Password, host)
+	}
+	msg := strings.Join([]string{
+		"From: " + s.config.From,
+		"To: " + target,
+		"Subject: " + notification.Subject(),
+		"Date: " + time.Unix(notification.Timestamp, 0).UTC().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		notification.Text(),
+	}, "\r\n")
+	return smtp.SendMail(s.config.Address, auth, s.config.From, []string{target}, []byte(msg))
+}
+
+func (n Notification) Subject() string {
+	switch n.Event {
+	case EventOffline:
+		return fmt.Sprintf("Worker %s is offline", n.Worker)
+	case EventOnline:
+		return fmt.Sprintf("Worker %s is back online", n.Worker)
+	case EventHashrateDrop:
+		return fmt.Sprintf("Hashrate of worker %s dropped", n.Worker)
+	}
+	return fmt.Sprintf("Hashrate of worker %s recovered", n.Worker)
+}
+
+func (n Notification) Text() string {
+	return fmt.Sprintf("%s.\r\n\r\nAccount: %s\r\nWorker: %s\r\nCurrent hashrate: %d H/s\r\nAverage hashrate: %d H/s\r\n",
+		n.Subject(), n.Login, n.Worker, n.Hashrate, n.AvgHashrate)
+}
@@ -0,0 +1,186 @@
+package payouts
+
+import (
+	"fmt"
+	log "github.com/dmuth/google-go-log4go"
+	"io"
+	"net"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/events"
+	"bitbucket.org/vdidenko/dwarf/server/rpc"
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+type RetryConfig struct {
+	// First retry delay after a transient failure, doubled on each failure in a row
+	Backoff    string `json:"backoff"`
+	MaxBackoff string `json:"maxBackoff"`
+	// Halt after this many transient failures in a row, 0 retries forever
+	MaxFailures int `json:"maxFailures"`
+}
+
+const (
+	defaultRetryBackoff    = 30 * time.Second
+	defaultMaxRetryBackoff = 10 * time.Minute
+)
+
+// Error which is known to go away by itself, like node lagging behind
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string {
+	return e.err.Error()
+}
+
+// Node and backend connectivity errors are transient, anything else needs operator
+func isTransient(err error) bool {
+	switch err.(type) {
+	case transientError, net.Error:
+		return true
+	}
+	return err == rpc.ErrCircuitOpen || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+/* Failure state of unlocker or payouts. Critical failure halts module until resume is requested,
+ * transient one postpones the next run with exponential backoff.
+ */
+type haltState struct {
+	module      string
+	event       string
+	backend     *storage.RedisClient
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxFailures int
+
+	halted   bool
+	lastFail error
+	failures int
+	retryAt  time.Time
+	// Set by a failure in the current run
+	failed   bool
+	reported bool
+}
+
+func newHaltState(module, event string, cfg RetryConfig, backend *storage.RedisClient) *haltState {
+	s := &haltState{module: module, event: event, backend: backend, maxFailures: cfg.MaxFailures}
+	s.backoff, s.maxBackoff = defaultRetryBackoff, defaultMaxRetryBackoff
+	if len(cfg.Backoff) > 0 {
+		s.backoff = util.MustParseDuration(cfg.Backoff)
+	}
+	if len(cfg.MaxBackoff) > 0 {
+		s.maxBackoff = util.MustParseDuration(cfg.MaxBackoff)
+	}
+	return s
+}
+
+// Returns false if module must skip this run
+func (s *haltState) ready(now time.Time) bool {
+	if s.halted {
+		log.Warnf("%v suspended due to last critical error: %v", s.module, s.lastFail)
+		return false
+	}
+	if now.Before(s.retryAt) {
+		log.Warnf("%v postponed until %v due to last error: %v", s.module, s.retryAt.Format(time.RFC3339), s.lastFail)
+		return false
+	}
+	return true
+}
+
+// Deposed leader does not halt, new leader continues from the last fenced write
+func (s *haltState) critical(err error) {
+	if err == storage.ErrLeaseLost {
+		log.Warnf("%v write rejected, lease was taken over by another instance", s.module)
+		return
+	}
+	s.halted = true
+	s.lastFail = err
+	s.failed = true
+}
+
+func (s *haltState) fail(err error, now time.Time) {
+	if !isTransient(err) {
+		s.critical(err)
+		return
+	}
+	s.lastFail = err
+	s.failed = true
+	s.failures++
+	if s.maxFailures > 0 && s.failures >= s.maxFailures {
+		s.halted = true
+		s.lastFail = fmt.Errorf("%v transient failures in a row, last: %v", s.failures, err)
+		return
+	}
+	backoff := s.backoff
+	for i := 1; i < s.failures && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.maxBackoff {
+		backoff = s.maxBackoff
+	}
+	s.retryAt = now.Add(backoff)
+}
+
+// Called after every run, a run without failures resets backoff
+func (s *haltState) finish() {
+	if !s.failed && !s.halted && !s.retryAt.After(time.Now()) {
+		s.failures = 0
+		if s.lastFail != nil {
+			log.Infof("%v recovered from: %v", s.module, s.lastFail)
+		}
+		s.lastFail = nil
+	}
+	s.failed = false
+	s.report()
+}
+
+// Status is shared with admin API, halt event is emitted once per halt
+func (s *haltState) report() {
+	status := &storage.ModuleStatus{Name: s.module, Halted: s.halted, Failures: s.failures}
+	if s.lastFail != nil {
+		status.LastFail = s.lastFail.Error()
+	}
+	if s.retryAt.After(time.Now()) {
+		status.RetryAt = s.retryAt.Unix()
+	}
+	if err := s.backend.WriteModuleStatus(status); err != nil {
+		log.Errorf("Failed to write %v status to backend: %v", s.module, err)
+	}
+	if s.halted && !s.reported {
+		s.reported = true
+		events.Emit(s.backend, s.event, map[string]interface{}{"error": s.lastFail.Error()})
+	}
+}
+
+/* Resume is requested through admin API or CLI and taken by the module on its next run.
+ * Module is resumed only if check of its invariants passes.
+ */
+func (s *haltState) checkResume(check func() error) {
+	requested, err := s.backend.TakeResumeRequest(s.module)
+	if err != nil {
+		log.Errorf("Failed to check %v resume request: %v", s.module, err)
+		return
+	}
+	if !requested {
+		return
+	}
+	if !s.halted && s.failures == 0 {
+		log.Infof("%v is not halted, ignoring resume request", s.module)
+		return
+	}
+	if err := check(); err != nil {
+		log.Errorf("%v resume rejected: %v", s.module, err)
+		s.lastFail = fmt.Errorf("resume rejected: %v", err)
+		s.report()
+		return
+	}
+	log.Warnf("Resuming %v after: %v", s.module, s.lastFail)
+	s.halted = false
+	s.reported = false
+	s.failures = 0
+	s.retryAt = time.Time{}
+	s.lastFail = nil
+	s.report()
+}
@@ -0,0 +1,91 @@
+package payouts
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/rpc"
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+)
+
+func newTestHaltState(maxFailures int) *haltState {
+	backend := storage.NewRedisClient(&storage.Config{Endpoint: "127.0.0.1:6379"}, "halttest")
+	backend.Client().FlushAll()
+	cfg := RetryConfig{Backoff: "10s", MaxBackoff: "30s", MaxFailures: maxFailures}
+	return newHaltState("unlocker", storage.EventUnlockerHalted, cfg, backend)
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, err := range []error{io.EOF, rpc.ErrCircuitOpen, transientError{errors.New("lag")}} {
+		if !isTransient(err) {
+			t.Errorf("Error must be transient: %v", err)
+		}
+	}
+	if isTransient(errors.New("bad block")) {
+		t.Error("Unknown error must be critical")
+	}
+}
+
+func TestHaltBackoff(t *testing.T) {
+	s := newTestHaltState(0)
+	now := time.Now()
+
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, backoff := range expected {
+		s.fail(io.EOF, now)
+		if s.halted {
+			t.Fatal("Transient error must not halt module")
+		}
+		if s.retryAt.Sub(now) != backoff {
+			t.Errorf("Backoff after %v failures must be %v, got %v", i+1, backoff, s.retryAt.Sub(now))
+		}
+	}
+	if s.ready(now) {
+		t.Error("Module must be postponed until retry time")
+	}
+	if !s.ready(now.Add(time.Minute)) {
+		t.Error("Module must run after retry time")
+	}
+}
+
+func TestHaltMaxFailures(t *testing.T) {
+	s := newTestHaltState(2)
+	s.fail(io.EOF, time.Now())
+	s.fail(io.EOF, time.Now())
+	if !s.halted {
+		t.Error("Module must halt after max transient failures")
+	}
+}
+
+func TestHaltResume(t *testing.T) {
+	s := newTestHaltState(0)
+	s.fail(errors.New("bad block"), time.Now())
+	s.finish()
+	if !s.halted || s.ready(time.Now()) {
+		t.Fatal("Critical error must halt module")
+	}
+
+	// No request, no resume
+	s.checkResume(func() error { return nil })
+	if !s.halted {
+		t.Fatal("Module must stay halted without resume request")
+	}
+
+	s.backend.RequestResume("unlocker")
+	s.checkResume(func() error { return errors.New("node is unavailable") })
+	if !s.halted {
+		t.Fatal("Module must stay halted if checks fail")
+	}
+
+	s.backend.RequestResume("unlocker")
+	s.checkResume(func() error { return nil })
+	if s.halted || !s.ready(time.Now()) {
+		t.Fatal("Module must be resumed")
+	}
+	statuses, _ := s.backend.GetModuleStatuses()
+	if len(statuses) != 1 || statuses[0].Halted {
+		t.Errorf("Resumed status must be reported: %v", statuses)
+	}
+}
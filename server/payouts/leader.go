@@ -0,0 +1,87 @@
+package payouts
+
+import (
+	"fmt"
+	log "github.com/dmuth/google-go-log4go"
+	"os"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+/* Hot standby of unlocker or payouts. Only the instance holding the lease runs the module,
+ * standby takes lease over within lease time after leader stops renewing it.
+ */
+type LeaderConfig struct {
+	Enabled bool   `json:"enabled"`
+	Lease   string `json:"lease"`
+	// Unique instance name, hostname and pid by default
+	Id string `json:"id"`
+}
+
+const defaultLeaderLease = 30 * time.Second
+
+type elector struct {
+	enabled bool
+	backend *storage.RedisClient
+	lease   *storage.Lease
+	ttl     time.Duration
+	leader  bool
+}
+
+func newElector(module string, cfg LeaderConfig, backend *storage.RedisClient) *elector {
+	e := &elector{enabled: cfg.Enabled, backend: backend, ttl: defaultLeaderLease}
+	if len(cfg.Lease) > 0 {
+		e.ttl = util.MustParseDuration(cfg.Lease)
+	}
+	id := cfg.Id
+	if len(id) == 0 {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	e.lease = storage.NewLease(module, id)
+	return e
+}
+
+// Client for module writes, rejected once lease is taken over
+func (e *elector) client() *storage.RedisClient {
+	if !e.enabled {
+		return e.backend
+	}
+	return e.backend.WithLease(e.lease)
+}
+
+// Lease is renewed 3 times per lease time
+func (e *elector) start() {
+	if !e.enabled {
+		return
+	}
+	log.Infof("Using %v lease of %v as %v", e.lease.Module, e.ttl, e.lease.Owner)
+	e.renew()
+
+	go func() {
+		ticker := time.NewTicker(e.ttl / 3)
+		for range ticker.C {
+			e.renew()
+		}
+	}()
+}
+
+func (e *elector) renew() {
+	ok, err := e.backend.AcquireLease(e.lease, e.ttl)
+	if err != nil {
+		log.Errorf("Failed to renew %v lease: %v", e.lease.Module, err)
+		ok = e.lease.Token() > 0
+	}
+	if ok && !e.leader {
+		log.Warnf("Became %v leader with fencing token %v", e.lease.Module, e.lease.Token())
+	} else if !ok && e.leader {
+		log.Warnf("Lost %v lease, running as standby", e.lease.Module)
+	}
+	e.leader = ok
+}
+
+func (e *elector) isLeader() bool {
+	return !e.enabled || e.lease.Token() > 0
+}
@@ -1,6 +1,7 @@
 package payouts
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/dmuth/google-go-log4go"
 	"math/big"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
 
+	"bitbucket.org/vdidenko/dwarf/server/events"
 	"bitbucket.org/vdidenko/dwarf/server/rpc"
 	"bitbucket.org/vdidenko/dwarf/server/storage"
 	"bitbucket.org/vdidenko/dwarf/server/util"
@@ -30,6 +32,10 @@ type PayoutsConfig struct {
 	// In Shannon
 	Threshold int64 `json:"threshold"`
 	BgSave    bool  `json:"bgsave"`
+
+	Rpc    rpc.Config   `json:"rpc"`
+	Retry  RetryConfig  `json:"retry"`
+	Leader LeaderConfig `json:"leader"`
 }
 
 func (self PayoutsConfig) GasHex() string {
@@ -43,16 +49,21 @@ func (self PayoutsConfig) GasPriceHex() string {
 }
 
 type PayoutsProcessor struct {
-	config   *PayoutsConfig
-	backend  *storage.RedisClient
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config  *PayoutsConfig
+	backend *storage.RedisClient
+	rpc     *rpc.RPCClient
+	state   *haltState
+	elector *elector
+	// Payout state is checked once leadership is taken
+	leading bool
 }
 
 func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
 	u := &PayoutsProcessor{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
+	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout, &cfg.Rpc)
+	u.elector = newElector("payouts", cfg.Leader, backend)
+	u.backend = u.elector.client()
+	u.state = newHaltState("payouts", storage.EventPayoutsHalted, cfg.Retry, backend)
 	return u
 }
 
@@ -61,7 +72,7 @@ func (u *PayoutsProcessor) Start() {
 
 	if u.mustResolvePayout() {
 		log.Info("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
-		u.resolvePayouts()
+		u.ResolvePayouts()
 		log.Info("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
 		return
 	}
@@ -69,42 +80,75 @@ func (u *PayoutsProcessor) Start() {
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Infof("Set payouts interval to %v", intv)
-
-	payments := u.backend.GetPendingPayments()
-	if len(payments) > 0 {
-		log.Warnf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
-			formatPendingPayments(payments))
-		return
-	}
-
-	locked, err := u.backend.IsPayoutsLocked()
-	if err != nil {
-		log.Warnf("Unable to start payouts:", err)
-		return
-	}
-	if locked {
-		log.Warn("Unable to start payouts because they are locked")
-		return
-	}
+	u.elector.start()
 
 	// Immediately process payouts after start
-	u.process()
+	u.run()
 	timer.Reset(intv)
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				u.process()
+				u.run()
 				timer.Reset(intv)
 			}
 		}
 	}()
 }
 
+func (u *PayoutsProcessor) run() {
+	if !u.elector.isLeader() {
+		u.leading = false
+		log.Info("Payouts are on standby, lease is held by another instance")
+		return
+	}
+	// Stay halted until failed payout is resolved and resume is requested
+	if !u.leading {
+		u.leading = true
+		if err := u.checkPayoutState(); err != nil {
+			log.Warnf("Unable to start payouts: %v", err)
+			u.state.critical(err)
+		}
+	}
+	u.state.checkResume(u.checkInvariants)
+	// Halted status left by a previous process must not outlive the start of sending
+	u.state.report()
+	u.process()
+	u.state.finish()
+}
+
+// Previous payout must be resolved, otherwise balances are inconsistent
+func (u *PayoutsProcessor) checkPayoutState() error {
+	payments := u.backend.GetPendingPayments()
+	if len(payments) > 0 {
+		return fmt.Errorf("previous payout failed, you have to resolve it. List of failed payments:\n%v", formatPendingPayments(payments))
+	}
+	locked, err := u.backend.IsPayoutsLocked()
+	if err != nil {
+		return err
+	}
+	if locked {
+		return errors.New("payouts are locked")
+	}
+	return nil
+}
+
+func (u *PayoutsProcessor) checkInvariants() error {
+	if _, err := u.backend.Check(); err != nil {
+		return fmt.Errorf("backend is unavailable: %v", err)
+	}
+	if err := u.checkPayoutState(); err != nil {
+		return err
+	}
+	if _, err := u.rpc.GetBalance(u.config.Address); err != nil {
+		return fmt.Errorf("node is unavailable: %v", err)
+	}
+	return nil
+}
+
 func (u *PayoutsProcessor) process() {
-	if u.halt {
-		log.Errorf("Payments suspended due to last critical error:", u.lastFail)
+	if !u.state.ready(time.Now()) {
 		return
 	}
 	mustPay := 0
@@ -140,15 +184,15 @@ func (u *PayoutsProcessor) process() {
 		// Check if we have enough funds
 		poolBalance, err := u.rpc.GetBalance(u.config.Address)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			log.Errorf("Failed to get pool balance: %v", err)
+			u.state.fail(err, time.Now())
 			break
 		}
 		if poolBalance.Cmp(amountInWei) < 0 {
 			err := fmt.Errorf("Not enough balance for payment, need %s Wei, pool has %s Wei",
 				amountInWei.String(), poolBalance.String())
-			u.halt = true
-			u.lastFail = err
+			log.Errorf("%v", err)
+			u.state.critical(err)
 			break
 		}
 
@@ -156,18 +200,26 @@ func (u *PayoutsProcessor) process() {
 		err = u.backend.LockPayouts(login, amount)
 		if err != nil {
 			log.Errorf("Failed to lock payment for %s: %v", login, err)
-			u.halt = true
-			u.lastFail = err
+			u.state.critical(err)
 			break
 		}
 		log.Infof("Locked payment for %s, %v Shannon", login, amount)
 
 		// Debit miner's balance and update stats
 		err = u.backend.UpdateBalance(login, amount)
+		if err == storage.ErrInsufficientBalance {
+			// Balance was debited by adjustment after it was read, nothing is sent
+			log.Warnf("Balance of %s is less than %v Shannon, skipping payment", login, amount)
+			if err = u.backend.UnlockPayouts(); err != nil {
+				log.Errorf("Failed to unlock payouts: %v", err)
+				u.state.critical(err)
+				break
+			}
+			continue
+		}
 		if err != nil {
 			log.Errorf("Failed to update balance for %s, %v Shannon: %v", login, amount, err)
-			u.halt = true
-			u.lastFail = err
+			u.state.critical(err)
 			break
 		}
 
@@ -176,8 +228,7 @@ func (u *PayoutsProcessor) process() {
 		if err != nil {
 			log.Errorf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
 				login, amount, err, login)
-			u.halt = true
-			u.lastFail = err
+			u.state.critical(err)
 			break
 		}
 
@@ -185,14 +236,14 @@ func (u *PayoutsProcessor) process() {
 		err = u.backend.WritePayment(login, txHash, amount)
 		if err != nil {
 			log.Errorf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", login, amount, txHash, err)
-			u.halt = true
-			u.lastFail = err
+			u.state.critical(err)
 			break
 		}
 
 		minersPaid++
 		totalAmount.Add(totalAmount, big.NewInt(amount))
 		log.Infof("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
+		events.Emit(u.backend, storage.EventPaymentSent, map[string]interface{}{"login": login, "tx": txHash, "amount": amount})
 
 		// Wait for TX confirmation before further payouts
 		for {
@@ -207,6 +258,7 @@ func (u *PayoutsProcessor) process() {
 			}
 		}
 		log.Infof("Payout tx for %s confirmed: %s", login, txHash)
+		events.Emit(u.backend, storage.EventPaymentConfirmed, map[string]interface{}{"login": login, "tx": txHash, "amount": amount})
 	}
 
 	if mustPay > 0 {
@@ -265,7 +317,8 @@ func (self PayoutsProcessor) bgSave() {
 	log.Infof("Saving backend state to disk:", result)
 }
 
-func (self PayoutsProcessor) resolvePayouts() {
+// Credits pending payments back to miners and unlocks payouts, payouts must not be running
+func (self PayoutsProcessor) ResolvePayouts() error {
 	payments := self.backend.GetPendingPayments()
 
 	if len(payments) > 0 {
@@ -275,14 +328,14 @@ func (self PayoutsProcessor) resolvePayouts() {
 			err := self.backend.RollbackBalance(v.Address, v.Amount)
 			if err != nil {
 				log.Errorf("Failed to credit %v Shannon back to %s, error is: %v", v.Amount, v.Address, err)
-				return
+				return err
 			}
 			log.Infof("Credited %v Shannon back to %s", v.Amount, v.Address)
 		}
 		err := self.backend.UnlockPayouts()
 		if err != nil {
 			log.Errorf("Failed to unlock payouts:", err)
-			return
+			return err
 		}
 	} else {
 		log.Warn("No pending payments to resolve")
@@ -292,6 +345,7 @@ func (self PayoutsProcessor) resolvePayouts() {
 		self.bgSave()
 	}
 	log.Info("Payouts unlocked")
+	return nil
 }
 
 func (self PayoutsProcessor) mustResolvePayout() bool {
@@ -0,0 +1,180 @@
+package payouts
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+const (
+	// Uncle gets (uncleHeight + 8 - height) / 8 of block reward
+	uncleFormulaDepth = "depth"
+	// Uncle gets block reward / uncleDivisor
+	uncleFormulaFixed = "fixed"
+	// ECIP-1017: depth formula in the first era, fixed one afterwards
+	uncleFormulaEcip1017 = "ecip1017"
+)
+
+type RewardFork struct {
+	Height int64  `json:"height"`
+	Reward string `json:"reward"`
+}
+
+type RewardConfig struct {
+	// Built-in schedule: "ethereum" or "classic", other options override it
+	Preset string       `json:"preset"`
+	Forks  []RewardFork `json:"forks"`
+	// Reward is multiplied by eraReduction once per eraLength blocks, "4/5" or "0.8"
+	EraLength    int64  `json:"eraLength"`
+	EraReduction string `json:"eraReduction"`
+	// Reward for including an uncle is block reward / inclusionDivisor
+	InclusionDivisor int64  `json:"inclusionDivisor"`
+	UncleFormula     string `json:"uncleFormula"`
+	UncleDivisor     int64  `json:"uncleDivisor"`
+}
+
+var rewardPresets = map[string]RewardConfig{
+	// Frontier, Byzantium (EIP-649) and Constantinople (EIP-1234)
+	"ethereum": {
+		Forks: []RewardFork{
+			{Height: 0, Reward: "5000000000000000000"},
+			{Height: 4370000, Reward: "3000000000000000000"},
+			{Height: 7280000, Reward: "2000000000000000000"},
+		},
+		InclusionDivisor: 32,
+		UncleFormula:     uncleFormulaDepth,
+	},
+	// ECIP-1017 monetary policy, 20% reduction every 5M blocks
+	"classic": {
+		Forks:            []RewardFork{{Height: 0, Reward: "5000000000000000000"}},
+		EraLength:        5000000,
+		EraReduction:     "4/5",
+		InclusionDivisor: 32,
+		UncleFormula:     uncleFormulaEcip1017,
+		UncleDivisor:     32,
+	},
+}
+
+type rewardFork struct {
+	height int64
+	reward *big.Int
+}
+
+type rewardSchedule struct {
+	forks            []rewardFork
+	eraLength        int64
+	eraReduction     *big.Rat
+	inclusionDivisor *big.Int
+	uncleFormula     string
+	uncleDivisor     *big.Int
+}
+
+// Panics on invalid config, like other config errors on start
+func newRewardSchedule(cfg RewardConfig) *rewardSchedule {
+	if len(cfg.Preset) == 0 && len(cfg.Forks) == 0 {
+		cfg.Preset = "ethereum"
+	}
+	if len(cfg.Preset) > 0 {
+		preset, ok := rewardPresets[cfg.Preset]
+		if !ok {
+			panic(fmt.Sprintf("payouts: Unknown reward preset %q", cfg.Preset))
+		}
+		cfg = mergeRewardConfig(preset, cfg)
+	}
+
+	s := &rewardSchedule{eraLength: cfg.EraLength, uncleFormula: cfg.UncleFormula}
+	for _, fork := range cfg.Forks {
+		s.forks = append(s.forks, rewardFork{height: fork.Height, reward: math.MustParseBig256(fork.Reward)})
+	}
+	sort.Slice(s.forks, func(i, j int) bool { return s.forks[i].height < s.forks[j].height })
+	if len(s.forks) == 0 || s.forks[0].height != 0 {
+		panic("payouts: Reward schedule must start at height 0")
+	}
+	if s.eraLength > 0 {
+		var ok bool
+		s.eraReduction, ok = new(big.Rat).SetString(cfg.EraReduction)
+		if !ok || s.eraReduction.Sign() <= 0 {
+			panic(fmt.Sprintf("payouts: Invalid era reduction %q", cfg.EraReduction))
+		}
+	}
+	if cfg.InclusionDivisor <= 0 {
+		panic("payouts: Uncle inclusion divisor must be positive")
+	}
+	s.inclusionDivisor = big.NewInt(cfg.InclusionDivisor)
+	switch s.uncleFormula {
+	case uncleFormulaDepth:
+	case uncleFormulaFixed, uncleFormulaEcip1017:
+		if cfg.UncleDivisor <= 0 {
+			panic("payouts: Uncle divisor must be positive")
+		}
+		s.uncleDivisor = big.NewInt(cfg.UncleDivisor)
+	default:
+		panic(fmt.Sprintf("payouts: Unknown uncle formula %q", s.uncleFormula))
+	}
+	return s
+}
+
+func mergeRewardConfig(preset, cfg RewardConfig) RewardConfig {
+	if len(cfg.Forks) > 0 {
+		preset.Forks = cfg.Forks
+	}
+	if cfg.EraLength > 0 {
+		preset.EraLength = cfg.EraLength
+	}
+	if len(cfg.EraReduction) > 0 {
+		preset.EraReduction = cfg.EraReduction
+	}
+	if cfg.InclusionDivisor > 0 {
+		preset.InclusionDivisor = cfg.InclusionDivisor
+	}
+	if len(cfg.UncleFormula) > 0 {
+		preset.UncleFormula = cfg.UncleFormula
+	}
+	if cfg.UncleDivisor > 0 {
+		preset.UncleDivisor = cfg.UncleDivisor
+	}
+	return preset
+}
+
+// ECIP-1017 counts eras from block 1, so block 5000000 still belongs to era 0
+func (s *rewardSchedule) era(height int64) int64 {
+	if s.eraLength <= 0 || height <= 0 {
+		return 0
+	}
+	return (height - 1) / s.eraLength
+}
+
+// Static block reward at height, without uncle inclusion rewards and tx fees
+func (s *rewardSchedule) blockReward(height int64) *big.Int {
+	reward := new(big.Int)
+	for _, fork := range s.forks {
+		if fork.height > height {
+			break
+		}
+		reward.Set(fork.reward)
+	}
+	// Reduce era by era with integer division, as nodes do
+	for i := int64(0); i < s.era(height); i++ {
+		reward.Mul(reward, s.eraReduction.Num())
+		reward.Div(reward, s.eraReduction.Denom())
+	}
+	return reward
+}
+
+// Reward of block miner for including a single uncle
+func (s *rewardSchedule) inclusionReward(height int64) *big.Int {
+	reward := s.blockReward(height)
+	return reward.Div(reward, s.inclusionDivisor)
+}
+
+// Reward of uncle miner, height is the height of block including the uncle
+func (s *rewardSchedule) uncleReward(uHeight, height int64) *big.Int {
+	reward := s.blockReward(height)
+	if s.uncleFormula == uncleFormulaFixed || (s.uncleFormula == uncleFormulaEcip1017 && s.era(height) > 0) {
+		return reward.Div(reward, s.uncleDivisor)
+	}
+	reward.Mul(big.NewInt(uHeight+8-height), reward)
+	return reward.Div(reward, big.NewInt(8))
+}
@@ -8,37 +8,38 @@ import (
 	"strings"
 	"time"
 	"encoding/json"
-	"github.com/ethereum/go-ethereum/common/math"
 
+	"bitbucket.org/vdidenko/dwarf/server/events"
 	"bitbucket.org/vdidenko/dwarf/server/rpc"
 	"bitbucket.org/vdidenko/dwarf/server/storage"
 	"bitbucket.org/vdidenko/dwarf/server/util"
 )
 
 type UnlockerConfig struct {
-	Enabled        bool    `json:"enabled"`
-	PoolFee        float64 `json:"poolFee"`
-	PoolFeeAddress string  `json:"poolFeeAddress"`
-	Depth          int64   `json:"depth"`
-	ImmatureDepth  int64   `json:"immatureDepth"`
-	KeepTxFees     bool    `json:"keepTxFees"`
-	Interval       string  `json:"interval"`
-	Daemon         string  `json:"daemon"`
-	Timeout        string  `json:"timeout"`
+	Enabled        bool         `json:"enabled"`
+	PoolFee        float64      `json:"poolFee"`
+	PoolFeeAddress string       `json:"poolFeeAddress"`
+	Depth          int64        `json:"depth"`
+	ImmatureDepth  int64        `json:"immatureDepth"`
+	KeepTxFees     bool         `json:"keepTxFees"`
+	Interval       string       `json:"interval"`
+	Daemon         string       `json:"daemon"`
+	Timeout        string       `json:"timeout"`
+	Rpc            rpc.Config   `json:"rpc"`
+	Rewards        RewardConfig `json:"rewards"`
+	Retry          RetryConfig  `json:"retry"`
+	Leader         LeaderConfig `json:"leader"`
 }
 
 const minDepth = 16
 
-var constReward = math.MustParseBig256("314000000000000000000")
-var uncleReward = new(big.Int).Div(constReward, new(big.Int).SetInt64(32))
-
-
 type BlockUnlocker struct {
-	config   *UnlockerConfig
-	backend  *storage.RedisClient
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config  *UnlockerConfig
+	backend *storage.RedisClient
+	rpc     *rpc.RPCClient
+	rewards *rewardSchedule
+	state   *haltState
+	elector *elector
 }
 
 func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
@@ -52,33 +53,58 @@ func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockU
 		log.Errorf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
 	}
 	u := &BlockUnlocker{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
+	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout, &cfg.Rpc)
+	u.rewards = newRewardSchedule(cfg.Rewards)
+	u.elector = newElector("unlocker", cfg.Leader, backend)
+	u.backend = u.elector.client()
+	u.state = newHaltState("unlocker", storage.EventUnlockerHalted, cfg.Retry, backend)
 	return u
 }
 
 func (u *BlockUnlocker) Start() {
 	log.Info("Starting block unlocker")
+	u.elector.start()
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Infof("Set block unlock interval to %v", intv)
 
 	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
+	u.run()
 	timer.Reset(intv)
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				u.unlockPendingBlocks()
-				u.unlockAndCreditMiners()
+				u.run()
 				timer.Reset(intv)
 			}
 		}
 	}()
 }
 
+func (u *BlockUnlocker) run() {
+	if !u.elector.isLeader() {
+		log.Info("Unlocker is on standby, lease is held by another instance")
+		return
+	}
+	u.state.checkResume(u.checkInvariants)
+	u.unlockPendingBlocks()
+	u.unlockAndCreditMiners()
+	u.state.finish()
+}
+
+// Node and backend must be reachable before unlocking is resumed
+func (u *BlockUnlocker) checkInvariants() error {
+	if _, err := u.backend.Check(); err != nil {
+		return fmt.Errorf("backend is unavailable: %v", err)
+	}
+	if _, err := u.rpc.GetPendingBlock(); err != nil {
+		return fmt.Errorf("node is unavailable: %v", err)
+	}
+	return nil
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
@@ -110,15 +136,19 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 		/* Search for a normal block with wrong height here by traversing 16 blocks back and forward.
 		 * Also we are searching for a block that can include this one as uncle.
 		 */
+		var heights []int64
 		for i := int64(minDepth * -1); i < minDepth; i++ {
-			height := candidate.Height + i
-			block, err := u.rpc.GetBlockByHeight(height)
-			if err != nil {
-				log.Infof("Error while retrieving block %v from node: %v", height, err)
-				return nil, err
-			}
+			heights = append(heights, candidate.Height+i)
+		}
+		blocks, err := u.rpc.GetBlocksByHeight(heights)
+		if err != nil {
+			log.Infof("Error while retrieving blocks %v-%v from node: %v", heights[0], heights[len(heights)-1], err)
+			return nil, err
+		}
+		for i, block := range blocks {
+			height := heights[i]
 			if block == nil {
-				return nil, fmt.Errorf("Error while retrieving block %v from node, wrong node height", height)
+				return nil, transientError{fmt.Errorf("Error while retrieving block %v from node, wrong node height", height)}
 			}
 
 			if matchCandidate(block, candidate) {
@@ -127,8 +157,6 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 
 				err = u.handleBlock(block, candidate)
 				if err != nil {
-					u.halt = true
-					u.lastFail = err
 					return nil, err
 				}
 				result.maturedBlocks = append(result.maturedBlocks, candidate)
@@ -144,10 +172,13 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 			for uncleIndex, uncleHash := range block.Uncles {
 				uncle, err := u.rpc.GetUncleByBlockNumberAndIndex(height, uncleIndex)
 				if err != nil {
+					if isTransient(err) {
+						return nil, err
+					}
 					return nil, fmt.Errorf("Error while retrieving uncle of block %v from node: %v", uncleHash, err)
 				}
 				if uncle == nil {
-					return nil, fmt.Errorf("Error while retrieving uncle of block %v from node", height)
+					return nil, transientError{fmt.Errorf("Error while retrieving uncle of block %v from node", height)}
 				}
 
 				// Found uncle
@@ -155,10 +186,8 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 					orphan = false
 					result.uncles++
 
-					err := handleUncle(height, uncle, candidate)
+					err := u.handleUncle(height, uncle, candidate)
 					if err != nil {
-						u.halt = true
-						u.lastFail = err
 						return nil, err
 					}
 					result.maturedBlocks = append(result.maturedBlocks, candidate)
@@ -200,15 +229,15 @@ func matchCandidate(block *rpc.GetBlockReply, candidate *storage.BlockData) bool
 }
 
 func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage.BlockData) error {
-	// Initial 5 Ether static reward
-	reward := new(big.Int).Set(constReward)
-
 	correctHeight, err := strconv.ParseInt(strings.Replace(block.Number, "0x", "", -1), 16, 64)
 	if err != nil {
 		return err
 	}
 	candidate.Height = correctHeight
 
+	// Static reward by schedule
+	reward := u.rewards.blockReward(correctHeight)
+
 	// Add TX fees
 	extraTxReward, err := u.getExtraRewardForTx(block)
 	if err != nil {
@@ -221,7 +250,7 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 	}
 
 	// Add reward for including uncles
-	rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
+	rewardForUncles := big.NewInt(0).Mul(u.rewards.inclusionReward(correctHeight), big.NewInt(int64(len(block.Uncles))))
 	reward.Add(reward, rewardForUncles)
 
 	candidate.Orphan = false
@@ -230,12 +259,12 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 	return nil
 }
 
-func handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.BlockData) error {
+func (u *BlockUnlocker) handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.BlockData) error {
 	uncleHeight, err := strconv.ParseInt(strings.Replace(uncle.Number, "0x", "", -1), 16, 64)
 	if err != nil {
 		return err
 	}
-	reward := getUncleReward(uncleHeight, height)
+	reward := u.rewards.uncleReward(uncleHeight, height)
 	candidate.Height = height
 	candidate.UncleHeight = uncleHeight
 	candidate.Orphan = false
@@ -245,30 +274,26 @@ func handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.Bloc
 }
 
 func (u *BlockUnlocker) unlockPendingBlocks() {
-	if u.halt {
-		log.Warnf("Unlocking suspended due to last critical error:", u.lastFail)
+	if !u.state.ready(time.Now()) {
 		return
 	}
 
 	current, err := u.rpc.GetPendingBlock()
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.fail(err, time.Now())
 		log.Errorf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
 	currentHeight, err := strconv.ParseInt(strings.Replace(current.Number, "0x", "", -1), 16, 64)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.critical(err)
 		log.Errorf("Can't parse pending block number: %v", err)
 		return
 	}
 
 	candidates, err := u.backend.GetCandidates(currentHeight - u.config.ImmatureDepth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.fail(err, time.Now())
 		log.Errorf("Failed to get block candidates from backend: %v", err)
 		return
 	}
@@ -280,8 +305,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 	result, err := u.unlockCandidates(candidates)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.fail(err, time.Now())
 		log.Errorf("Failed to unlock blocks: %v", err)
 		return
 	}
@@ -289,33 +313,35 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 	err = u.backend.WritePendingOrphans(result.orphanedBlocks)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.critical(err)
 		log.Errorf("Failed to insert orphaned blocks into backend: %v", err)
 		return
 	} else {
 		log.Infof("Inserted %v orphaned blocks to backend", result.orphans)
 	}
+	for _, block := range result.orphanedBlocks {
+		events.Emit(u.backend, storage.EventBlockOrphaned, blockEvent(block))
+	}
 
 	totalRevenue := new(big.Rat)
 	totalMinersProfit := new(big.Rat)
 	totalPoolProfit := new(big.Rat)
 
 	for _, block := range result.maturedBlocks {
-		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
+		roundShares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
-			log.Errorf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
+			u.state.fail(err, time.Now())
+			log.Errorf("Failed to get shares for round %v: %v", block.RoundKey(), err)
 			return
 		}
-		err = u.backend.WriteImmatureBlock(block, roundRewards)
+		revenue, minersProfit, poolProfit, roundRewards := u.calculateRewards(block, roundShares)
+		err = u.backend.WriteImmatureBlock(block, roundRewards, roundShares)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.state.critical(err)
 			log.Errorf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
+		events.Emit(u.backend, storage.EventBlockImmature, blockEvent(block))
 		totalRevenue.Add(totalRevenue, revenue)
 		totalMinersProfit.Add(totalMinersProfit, minersProfit)
 		totalPoolProfit.Add(totalPoolProfit, poolProfit)
@@ -343,30 +369,26 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 }
 
 func (u *BlockUnlocker) unlockAndCreditMiners() {
-	if u.halt {
-		log.Warnf("Unlocking suspended due to last critical error:", u.lastFail)
+	if !u.state.ready(time.Now()) {
 		return
 	}
 
 	current, err := u.rpc.GetPendingBlock()
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.fail(err, time.Now())
 		log.Errorf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
 	currentHeight, err := strconv.ParseInt(strings.Replace(current.Number, "0x", "", -1), 16, 64)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.critical(err)
 		log.Errorf("Can't parse pending block number: %v", err)
 		return
 	}
 
 	immature, err := u.backend.GetImmatureBlocks(currentHeight - u.config.Depth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.fail(err, time.Now())
 		log.Errorf("Failed to get block candidates from backend: %v", err)
 		return
 	}
@@ -378,8 +400,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 	result, err := u.unlockCandidates(immature)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.state.fail(err, time.Now())
 		log.Errorf("Failed to unlock blocks: %v", err)
 		return
 	}
@@ -388,11 +409,11 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	for _, block := range result.orphanedBlocks {
 		err = u.backend.WriteOrphan(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.state.critical(err)
 			log.Errorf("Failed to insert orphaned block into backend: %v", err)
 			return
 		}
+		events.Emit(u.backend, storage.EventBlockOrphaned, blockEvent(block))
 	}
 	log.Infof("Inserted %v orphaned blocks to backend", result.orphans)
 
@@ -401,20 +422,20 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	totalPoolProfit := new(big.Rat)
 
 	for _, block := range result.maturedBlocks {
-		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
+		roundShares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
-			log.Errorf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
+			u.state.fail(err, time.Now())
+			log.Errorf("Failed to get shares for round %v: %v", block.RoundKey(), err)
 			return
 		}
-		err = u.backend.WriteMaturedBlock(block, roundRewards)
+		revenue, minersProfit, poolProfit, roundRewards := u.calculateRewards(block, roundShares)
+		err = u.backend.WriteMaturedBlock(block, roundRewards, roundShares)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.state.critical(err)
 			log.Errorf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
+		events.Emit(u.backend, storage.EventBlockMatured, blockEvent(block))
 		totalRevenue.Add(totalRevenue, revenue)
 		totalMinersProfit.Add(totalMinersProfit, minersProfit)
 		totalPoolProfit.Add(totalPoolProfit, poolProfit)
@@ -441,15 +462,27 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	)
 }
 
-func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
+func blockEvent(block *storage.BlockData) map[string]interface{} {
+	data := map[string]interface{}{
+		"height":      block.Height,
+		"hash":        block.Hash,
+		"uncle":       block.Uncle,
+		"uncleHeight": block.UncleHeight,
+		"orphan":      block.Orphan,
+		"roundHeight": block.RoundHeight,
+		"finder":      block.Finder,
+		"worker":      block.Worker,
+	}
+	if block.Reward != nil {
+		data["reward"] = block.Reward.String()
+	}
+	return data
+}
+
+func (u *BlockUnlocker) calculateRewards(block *storage.BlockData, shares map[string]int64) (*big.Rat, *big.Rat, *big.Rat, map[string]int64) {
 	revenue := new(big.Rat).SetInt(block.Reward)
 	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
 
-	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
-	if err != nil {
-		return nil, nil, nil, nil, err
-	}
-
 	rewards := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
 
 	if block.ExtraReward != nil {
@@ -463,7 +496,7 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
 		rewards[address] += weiToShannonInt64(poolProfit)
 	}
 
-	return revenue, minersProfit, poolProfit, rewards, nil
+	return revenue, minersProfit, poolProfit, rewards
 }
 
 func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
@@ -491,21 +524,19 @@ func weiToShannonInt64(wei *big.Rat) int64 {
 	return value
 }
 
-func getUncleReward(uHeight, height int64) *big.Int {
-	reward := new(big.Int).Set(constReward)
-	reward.Mul(big.NewInt(uHeight+8-height), reward)
-	reward.Div(reward, big.NewInt(8))
-	return reward
-}
-
 func (u *BlockUnlocker) getExtraRewardForTx(block *rpc.GetBlockReply) (*big.Int, error) {
 	amount := new(big.Int)
 
-	for _, tx := range block.Transactions {
-		receipt, err := u.rpc.GetTxReceipt(tx.Hash)
-		if err != nil {
-			return nil, err
-		}
+	hashes := make([]string, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.Hash
+	}
+	receipts, err := u.rpc.GetTxReceipts(hashes)
+	if err != nil {
+		return nil, err
+	}
+	for i, tx := range block.Transactions {
+		receipt := receipts[i]
 		if receipt != nil {
 			gasUsed := util.String2Big(receipt.GasUsed)
 			gasPrice := util.String2Big(tx.GasPrice)
@@ -76,8 +76,9 @@ func TestGetUncleReward(t *testing.T) {
 		5: "1875000000000000000",
 		6: "1250000000000000000",
 	}
+	schedule := newRewardSchedule(RewardConfig{Preset: "ethereum"})
 	for i := int64(1); i < 7; i++ {
-		rewards[i] = getUncleReward(1, i+1).String()
+		rewards[i] = schedule.uncleReward(1, i+1).String()
 	}
 	for i, reward := range rewards {
 		if expectedRewards[i] != rewards[i] {
@@ -86,6 +87,44 @@ func TestGetUncleReward(t *testing.T) {
 	}
 }
 
+func TestRewardSchedules(t *testing.T) {
+	tests := []struct {
+		preset                  string
+		uncleHeight, height     int64
+		block, inclusion, uncle string
+	}{
+		// Frontier, uncle 46 of block 47
+		{"ethereum", 46, 47, "5000000000000000000", "156250000000000000", "4375000000000000000"},
+		// First Byzantium block
+		{"ethereum", 4369999, 4370000, "3000000000000000000", "93750000000000000", "2625000000000000000"},
+		// First Constantinople block with uncle of depth 2
+		{"ethereum", 7279998, 7280000, "2000000000000000000", "62500000000000000", "1500000000000000000"},
+		// Last block of ETC era 1 still pays depth based uncle reward
+		{"classic", 4999999, 5000000, "5000000000000000000", "156250000000000000", "4375000000000000000"},
+		// ETC era 2
+		{"classic", 5000000, 5000001, "4000000000000000000", "125000000000000000", "125000000000000000"},
+		// ETC era 3
+		{"classic", 10000000, 10000001, "3200000000000000000", "100000000000000000", "100000000000000000"},
+	}
+	for _, test := range tests {
+		schedule := newRewardSchedule(RewardConfig{Preset: test.preset})
+		if reward := schedule.blockReward(test.height).String(); reward != test.block {
+			t.Errorf("Wrong %v block reward at %v: %v", test.preset, test.height, reward)
+		}
+		if reward := schedule.inclusionReward(test.height).String(); reward != test.inclusion {
+			t.Errorf("Wrong %v uncle inclusion reward at %v: %v", test.preset, test.height, reward)
+		}
+		if reward := schedule.uncleReward(test.uncleHeight, test.height).String(); reward != test.uncle {
+			t.Errorf("Wrong %v uncle reward at %v: %v", test.preset, test.height, reward)
+		}
+	}
+
+	custom := newRewardSchedule(RewardConfig{Preset: "classic", Forks: []RewardFork{{Height: 0, Reward: "1000"}}, EraLength: 10})
+	if reward := custom.blockReward(21).String(); reward != "640" {
+		t.Errorf("Must override preset with custom options: %v", reward)
+	}
+}
+
 func TestMatchCandidate(t *testing.T) {
 	gethBlock := &rpc.GetBlockReply{Hash: "0x12345A", Nonce: "0x1A"}
 	parityBlock := &rpc.GetBlockReply{Hash: "0x12345A", SealFields: []string{"0x0A", "0x1A"}}
@@ -37,6 +37,14 @@ type Banning struct {
 	MalformedLimit int32   `json:"malformedLimit"`
 }
 
+// Reasons of bans as reported to backend
+const (
+	banFlood         = "flood"
+	banBlacklist     = "blacklist"
+	banMalformed     = "malformed"
+	banInvalidShares = "invalidShares"
+)
+
 type Stats struct {
 	sync.Mutex
 	// We are using atomic with LastBeat,
@@ -182,7 +190,7 @@ func (s *PolicyServer) Get(ip string) *Stats {
 
 func (s *PolicyServer) BanClient(ip string) {
 	x := s.Get(ip)
-	s.forceBan(x, ip)
+	s.forceBan(x, ip, banFlood)
 }
 
 func (s *PolicyServer) IsBanned(ip string) bool {
@@ -204,7 +212,7 @@ func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
 func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
 	if s.InBlackList(addy) {
 		x := s.Get(ip)
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, banBlacklist)
 		return false
 	}
 	return true
@@ -214,7 +222,7 @@ func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
 	x := s.Get(ip)
 	n := x.incrMalformed()
 	if n >= s.config.Banning.MalformedLimit {
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, banMalformed)
 		return false
 	}
 	return true
@@ -246,7 +254,7 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 	ratio := invalidShares / validShares
 
 	if ratio >= s.config.Banning.InvalidPercent/100.0 {
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, banInvalidShares)
 		return false
 	}
 	return true
@@ -257,13 +265,17 @@ func (x *Stats) resetShares() {
 	x.InvalidShares = 0
 }
 
-func (s *PolicyServer) forceBan(x *Stats, ip string) {
+func (s *PolicyServer) forceBan(x *Stats, ip, reason string) {
 	if !s.config.Banning.Enabled || s.InWhiteList(ip) {
 		return
 	}
 	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
 
 	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+		// Shared with other proxies for admin API
+		if err := s.storage.WriteBan(ip, reason, s.config.Banning.Timeout); err != nil {
+			log.Errorf("Failed to write ban of %v to backend: %v", ip, err)
+		}
 		if len(s.config.Banning.IPSet) > 0 {
 			s.banChannel <- ip
 		} else {
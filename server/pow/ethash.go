@@ -0,0 +1,290 @@
+package pow
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/big"
+	"sync"
+	"time"
+
+	log "github.com/dmuth/google-go-log4go"
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	datasetInitBytes   = 1 << 30
+	datasetGrowthBytes = 1 << 23
+	cacheInitBytes     = 1 << 24
+	cacheGrowthBytes   = 1 << 17
+	epochLength        = 30000
+	mixBytes           = 128
+	hashBytes          = 64
+	hashWords          = 16
+	datasetParents     = 256
+	cacheRounds        = 3
+	loopAccesses       = 64
+
+	// Tiny sizes for tests, as in go-ethereum test mode
+	testCacheBytes   = 1024
+	testDatasetBytes = 32 * 1024
+
+	// Verification caches kept in memory: previous epoch for stale shares, current and next one
+	maxCaches = 3
+	// Start generating cache of the next epoch this number of blocks before boundary
+	prepareDistance = 1000
+)
+
+var two256 = new(big.Int).Exp(big.NewInt(2), big.NewInt(256), nil)
+
+type cache struct {
+	epoch uint64
+	once  sync.Once
+	data  []uint32
+}
+
+/* Light ethash verifier. Epoch length changes to newEpochLength at activation height,
+ * that is ECIP-1099 for ETChash. Seed hashes stay those of original 30000 blocks epochs.
+ */
+type Ethash struct {
+	newEpochLength uint64
+	activation     uint64
+	test           bool
+
+	mu     sync.Mutex
+	caches map[uint64]*cache
+}
+
+func NewEthash(newEpochLength, activation uint64, test bool) *Ethash {
+	return &Ethash{newEpochLength: newEpochLength, activation: activation, test: test, caches: make(map[uint64]*cache)}
+}
+
+func (e *Ethash) epochLength(height uint64) uint64 {
+	if e.newEpochLength != epochLength && height >= e.activation {
+		return e.newEpochLength
+	}
+	return epochLength
+}
+
+func (e *Ethash) Epoch(height uint64) uint64 {
+	return height / e.epochLength(height)
+}
+
+// Caches are keyed by seed number, epoch numbers restart at ETChash activation
+func (e *Ethash) seedNumber(height uint64) uint64 {
+	return (e.Epoch(height)*e.epochLength(height) + 1) / epochLength
+}
+
+func (e *Ethash) SeedHash(height uint64) common.Hash {
+	return seedHash(e.seedNumber(height))
+}
+
+func (e *Ethash) Prepare(height uint64) {
+	for _, h := range []uint64{height, height + prepareDistance} {
+		e.mu.Lock()
+		_, ok := e.caches[e.seedNumber(h)]
+		e.mu.Unlock()
+		if !ok {
+			go e.cache(h)
+		}
+	}
+}
+
+func (e *Ethash) Verify(block Block) bool {
+	if block.Difficulty().Sign() <= 0 {
+		return false
+	}
+	mix, result := e.Compute(block.NumberU64(), block.HashNoNonce(), block.Nonce())
+	if mix != block.MixDigest() {
+		return false
+	}
+	target := new(big.Int).Div(two256, block.Difficulty())
+	return result.Big().Cmp(target) <= 0
+}
+
+// Mix digest and result of hashimoto for header at height
+func (e *Ethash) Compute(height uint64, hashNoNonce common.Hash, nonce uint64) (common.Hash, common.Hash) {
+	epoch := e.Epoch(height)
+	c := e.cache(height)
+	size := uint64(testDatasetBytes)
+	if !e.test {
+		size = datasetSize(epoch)
+	}
+	return hashimotoLight(size, c.data, hashNoNonce.Bytes(), nonce)
+}
+
+// Returns verification cache of height, generating it once, and evicts the oldest ones
+func (e *Ethash) cache(height uint64) *cache {
+	epoch, n := e.Epoch(height), e.seedNumber(height)
+	e.mu.Lock()
+	c, ok := e.caches[n]
+	if !ok {
+		c = &cache{epoch: epoch}
+		e.caches[n] = c
+		for len(e.caches) > maxCaches {
+			oldest := n
+			for k := range e.caches {
+				if k < oldest {
+					oldest = k
+				}
+			}
+			delete(e.caches, oldest)
+		}
+	}
+	e.mu.Unlock()
+
+	c.once.Do(func() {
+		size := uint64(testCacheBytes)
+		if !e.test {
+			size = cacheSize(epoch)
+		}
+		start := time.Now()
+		c.data = generateCache(size, e.SeedHash(height).Bytes())
+		log.Infof("Generated ethash verification cache for epoch %v in %v", epoch, time.Since(start))
+	})
+	return c
+}
+
+func cacheSize(epoch uint64) uint64 {
+	size := cacheInitBytes + cacheGrowthBytes*epoch - hashBytes
+	for !new(big.Int).SetUint64(size / hashBytes).ProbablyPrime(1) {
+		size -= 2 * hashBytes
+	}
+	return size
+}
+
+func datasetSize(epoch uint64) uint64 {
+	size := datasetInitBytes + datasetGrowthBytes*epoch - mixBytes
+	for !new(big.Int).SetUint64(size / mixBytes).ProbablyPrime(1) {
+		size -= 2 * mixBytes
+	}
+	return size
+}
+
+type hasher func(dest []byte, data []byte)
+
+func makeHasher(h hash.Hash) hasher {
+	return func(dest []byte, data []byte) {
+		h.Reset()
+		h.Write(data)
+		copy(dest, h.Sum(nil))
+	}
+}
+
+// Seed of the n-th 30000 blocks epoch
+func seedHash(n uint64) common.Hash {
+	seed := make([]byte, 32)
+	keccak256 := makeHasher(sha3.NewLegacyKeccak256())
+	for i := uint64(0); i < n; i++ {
+		keccak256(seed, seed)
+	}
+	return common.BytesToHash(seed)
+}
+
+func generateCache(size uint64, seed []byte) []uint32 {
+	cache := make([]byte, size)
+	rows := int(size) / hashBytes
+	keccak512 := makeHasher(sha3.NewLegacyKeccak512())
+
+	// Sequentially produce the initial dataset
+	keccak512(cache, seed)
+	for offset := uint64(hashBytes); offset < size; offset += hashBytes {
+		keccak512(cache[offset:], cache[offset-hashBytes:offset])
+	}
+	// Low-round version of randmemohash
+	temp := make([]byte, hashBytes)
+	for i := 0; i < cacheRounds; i++ {
+		for j := 0; j < rows; j++ {
+			src := ((j - 1 + rows) % rows) * hashBytes
+			dst := j * hashBytes
+			xor := int(binary.LittleEndian.Uint32(cache[dst:])%uint32(rows)) * hashBytes
+			for k := 0; k < hashBytes; k++ {
+				temp[k] = cache[src+k] ^ cache[xor+k]
+			}
+			keccak512(cache[dst:], temp)
+		}
+	}
+
+	words := make([]uint32, size/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(cache[i*4:])
+	}
+	return words
+}
+
+func fnv(a, b uint32) uint32 {
+	return a*0x01000193 ^ b
+}
+
+func fnvHash(mix []uint32, data []uint32) {
+	for i := 0; i < len(mix); i++ {
+		mix[i] = mix[i]*0x01000193 ^ data[i]
+	}
+}
+
+func generateDatasetItem(cache []uint32, index uint32, keccak512 hasher) []uint32 {
+	rows := uint32(len(cache) / hashWords)
+
+	mix := make([]byte, hashBytes)
+	binary.LittleEndian.PutUint32(mix, cache[(index%rows)*hashWords]^index)
+	for i := 1; i < hashWords; i++ {
+		binary.LittleEndian.PutUint32(mix[i*4:], cache[(index%rows)*hashWords+uint32(i)])
+	}
+	keccak512(mix, mix)
+
+	intMix := make([]uint32, hashWords)
+	for i := range intMix {
+		intMix[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+	for i := uint32(0); i < datasetParents; i++ {
+		parent := fnv(index^i, intMix[i%16]) % rows
+		fnvHash(intMix, cache[parent*hashWords:])
+	}
+	for i, val := range intMix {
+		binary.LittleEndian.PutUint32(mix[i*4:], val)
+	}
+	keccak512(mix, mix)
+
+	for i := range intMix {
+		intMix[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+	return intMix
+}
+
+func hashimotoLight(size uint64, cache []uint32, hash []byte, nonce uint64) (common.Hash, common.Hash) {
+	keccak512 := makeHasher(sha3.NewLegacyKeccak512())
+	rows := uint32(size / mixBytes)
+
+	// Combine header+nonce into a 64 byte seed
+	header := make([]byte, 40)
+	copy(header, hash)
+	binary.LittleEndian.PutUint64(header[32:], nonce)
+	seed := make([]byte, hashBytes)
+	keccak512(seed, header)
+	seedHead := binary.LittleEndian.Uint32(seed)
+
+	mix := make([]uint32, mixBytes/4)
+	for i := range mix {
+		mix[i] = binary.LittleEndian.Uint32(seed[i%16*4:])
+	}
+	temp := make([]uint32, len(mix))
+	for i := 0; i < loopAccesses; i++ {
+		parent := fnv(uint32(i)^seedHead, mix[i%len(mix)]) % rows
+		for j := uint32(0); j < mixBytes/hashBytes; j++ {
+			copy(temp[j*hashWords:], generateDatasetItem(cache, 2*parent+j, keccak512))
+		}
+		fnvHash(mix, temp)
+	}
+	// Compress mix
+	for i := 0; i < len(mix); i += 4 {
+		mix[i/4] = fnv(fnv(fnv(mix[i], mix[i+1]), mix[i+2]), mix[i+3])
+	}
+	digest := make([]byte, common.HashLength)
+	for i, val := range mix[:len(mix)/4] {
+		binary.LittleEndian.PutUint32(digest[i*4:], val)
+	}
+
+	result := make([]byte, 32)
+	makeHasher(sha3.NewLegacyKeccak256())(result, append(seed, digest...))
+	return common.BytesToHash(digest), common.BytesToHash(result)
+}
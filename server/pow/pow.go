@@ -0,0 +1,52 @@
+package pow
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type Config struct {
+	// "ethash", "etchash" or "test"
+	Algorithm string `json:"algorithm"`
+	// ETChash: height where epoch length doubles, 11700000 on ETC mainnet
+	EtchashActivation uint64 `json:"etchashActivation"`
+}
+
+// Same as ethash.Block, so shares are passed as is
+type Block interface {
+	Difficulty() *big.Int
+	HashNoNonce() common.Hash
+	Nonce() uint64
+	MixDigest() common.Hash
+	NumberU64() uint64
+}
+
+type Verifier interface {
+	// Checks mix digest and that result meets block difficulty
+	Verify(block Block) bool
+	Epoch(height uint64) uint64
+	SeedHash(height uint64) common.Hash
+	// Generates verification data for height and, near epoch boundary, for the next epoch in background
+	Prepare(height uint64)
+}
+
+const defaultEtchashActivation = 11700000
+
+// Panics on unknown algorithm, like other config errors on start
+func NewVerifier(cfg Config) Verifier {
+	switch cfg.Algorithm {
+	case "", "ethash":
+		return NewEthash(epochLength, 0, false)
+	case "etchash":
+		activation := cfg.EtchashActivation
+		if activation == 0 {
+			activation = defaultEtchashActivation
+		}
+		return NewEthash(epochLength*2, activation, false)
+	case "test":
+		return NewEthash(epochLength, 0, true)
+	}
+	panic(fmt.Sprintf("pow: Unknown algorithm %q", cfg.Algorithm))
+}
@@ -0,0 +1,108 @@
+package pow
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type testBlock struct {
+	difficulty  *big.Int
+	hashNoNonce common.Hash
+	nonce       uint64
+	mixDigest   common.Hash
+	number      uint64
+}
+
+func (b testBlock) Difficulty() *big.Int     { return b.difficulty }
+func (b testBlock) HashNoNonce() common.Hash { return b.hashNoNonce }
+func (b testBlock) Nonce() uint64            { return b.nonce }
+func (b testBlock) MixDigest() common.Hash   { return b.mixDigest }
+func (b testBlock) NumberU64() uint64        { return b.number }
+
+func TestHashimoto(t *testing.T) {
+	// Vector of go-ethereum test mode
+	cache := generateCache(testCacheBytes, make([]byte, 32))
+	hash := common.HexToHash("0xc9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+	digest, result := hashimotoLight(testDatasetBytes, cache, hash.Bytes(), 0)
+	if digest != common.HexToHash("0xe4073cffaef931d37117cefd9afd27ea0f1cad6a981dd2605c4a1ac97c519800") {
+		t.Errorf("Wrong digest: %x", digest)
+	}
+	if result != common.HexToHash("0xd3539235ee2e6f8db665c0a72169f55b7f6c605712330b778ec3944f0eb5a557") {
+		t.Errorf("Wrong result: %x", result)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	if cacheSize(0) != 16776896 || datasetSize(0) != 1073739904 {
+		t.Errorf("Wrong sizes of epoch 0: %v %v", cacheSize(0), datasetSize(0))
+	}
+}
+
+func TestEpochAndSeedHash(t *testing.T) {
+	ethash := NewVerifier(Config{Algorithm: "ethash"})
+	etchash := NewVerifier(Config{Algorithm: "etchash"})
+
+	if ethash.SeedHash(29999) != (common.Hash{}) {
+		t.Error("Seed of the first epoch must be zero")
+	}
+	if ethash.SeedHash(30000) != common.HexToHash("0x290decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e563") {
+		t.Errorf("Wrong seed of the second epoch: %x", ethash.SeedHash(30000))
+	}
+	if etchash.Epoch(11699999) != 389 || etchash.Epoch(11700000) != 195 || etchash.Epoch(11760000) != 196 {
+		t.Error("Must double epoch length at ETChash activation")
+	}
+	if etchash.SeedHash(11700000) != ethash.SeedHash(11700000) || etchash.SeedHash(11760000) != ethash.SeedHash(11760000) {
+		t.Error("Must keep seed hashes of original epochs")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	verifier := NewVerifier(Config{Algorithm: "test"}).(*Ethash)
+	block := testBlock{difficulty: big.NewInt(16), hashNoNonce: common.HexToHash("0x01"), number: 1}
+	target := new(big.Int).Div(two256, block.difficulty)
+	for ; ; block.nonce++ {
+		mix, result := verifier.Compute(block.number, block.hashNoNonce, block.nonce)
+		if result.Big().Cmp(target) <= 0 {
+			block.mixDigest = mix
+			break
+		}
+	}
+	if !verifier.Verify(block) {
+		t.Error("Must accept valid share")
+	}
+	block.difficulty = new(big.Int).Lsh(big.NewInt(1), 250)
+	if verifier.Verify(block) {
+		t.Error("Must reject share below difficulty")
+	}
+	block.difficulty = big.NewInt(16)
+	block.mixDigest = common.Hash{}
+	if verifier.Verify(block) {
+		t.Error("Must reject share with wrong mix digest")
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	verifier := NewVerifier(Config{Algorithm: "test"}).(*Ethash)
+	verifier.Prepare(29000)
+	for i := 0; i < 100; i++ {
+		verifier.mu.Lock()
+		n := len(verifier.caches)
+		verifier.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if verifier.caches[0] == nil || verifier.caches[1] == nil {
+		t.Fatal("Must generate caches of current and next epochs")
+	}
+
+	verifier.cache(60000)
+	verifier.cache(90000)
+	if len(verifier.caches) != maxCaches || verifier.caches[0] != nil {
+		t.Error("Must evict cache of the oldest epoch")
+	}
+}
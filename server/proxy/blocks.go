@@ -65,6 +65,10 @@ func (proxyServer *ProxyServer) fetchBlockTemplate() {
 	}
 
 	pendingReply.Difficulty = util.ToHex(proxyServer.config.Proxy.Difficulty)
+	proxyServer.verifier.Prepare(height)
+	if seed := proxyServer.verifier.SeedHash(height); !strings.EqualFold(seed.Hex(), reply[1]) {
+		log.Errorf("Seed hash %s of %s at height %d doesn't match %s of epoch %d, check pow algorithm", reply[1], rpc.Name, height, seed.Hex(), proxyServer.verifier.Epoch(height))
+	}
 
 	newTemplate := BlockTemplate{
 		Header:               reply[0],
@@ -2,8 +2,12 @@ package proxy
 
 import (
 	"bitbucket.org/vdidenko/dwarf/server/api"
+	"bitbucket.org/vdidenko/dwarf/server/events"
+	"bitbucket.org/vdidenko/dwarf/server/notify"
 	"bitbucket.org/vdidenko/dwarf/server/payouts"
 	"bitbucket.org/vdidenko/dwarf/server/policy"
+	"bitbucket.org/vdidenko/dwarf/server/pow"
+	"bitbucket.org/vdidenko/dwarf/server/rpc"
 	"bitbucket.org/vdidenko/dwarf/server/storage"
 )
 
@@ -13,14 +17,21 @@ type Config struct {
 	Api                   api.ApiConfig `json:"api"`
 	Upstream              []Upstream    `json:"upstream"`
 	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
+	UpstreamPolicy        string        `json:"upstreamPolicy"`
+	UpstreamMaxLag        int64         `json:"upstreamMaxLag"`
+	UpstreamMinPeers      int64         `json:"upstreamMinPeers"`
+	UpstreamSwitchAfter   int           `json:"upstreamSwitchAfter"`
 
 	Threads int `json:"threads"`
 
 	Coin  string         `json:"coin"`
+	Pow   pow.Config     `json:"pow"`
 	Redis storage.Config `json:"redis"`
 
 	BlockUnlocker payouts.UnlockerConfig `json:"unlocker"`
 	Payouts       payouts.PayoutsConfig  `json:"payouts"`
+	Notifier      notify.Config          `json:"notifier"`
+	Events        events.Config          `json:"events"`
 
 	NewrelicName    string `json:"newrelicName"`
 	NewrelicKey     string `json:"newrelicKey"`
@@ -35,7 +46,11 @@ type Proxy struct {
 	LimitBodySize        int64  `json:"limitBodySize"`
 	BehindReverseProxy   bool   `json:"behindReverseProxy"`
 	BlockRefreshInterval string `json:"blockRefreshInterval"`
+	BlockPollInterval    string `json:"blockPollInterval"`
+	WorkNotifyListen     string `json:"workNotifyListen"`
 	Difficulty           int64  `json:"difficulty"`
+	VerifyWorkers        int    `json:"verifyWorkers"`
+	VerifyQueue          int    `json:"verifyQueue"`
 	StateUpdateInterval  string `json:"stateUpdateInterval"`
 	HashrateExpiration   string `json:"hashrateExpiration"`
 
@@ -55,7 +70,9 @@ type Stratum struct {
 }
 
 type Upstream struct {
-	Name    string `json:"name"`
-	Url     string `json:"url"`
-	Timeout string `json:"timeout"`
+	Name      string     `json:"name"`
+	Url       string     `json:"url"`
+	Timeout   string     `json:"timeout"`
+	Subscribe string     `json:"subscribe"`
+	Rpc       rpc.Config `json:"rpc"`
 }
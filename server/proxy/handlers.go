@@ -3,9 +3,11 @@ package proxy
 import (
 	log "github.com/dmuth/google-go-log4go"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"bitbucket.org/vdidenko/dwarf/server/rpc"
+	"bitbucket.org/vdidenko/dwarf/server/storage"
 	"bitbucket.org/vdidenko/dwarf/server/util"
 )
 
@@ -14,6 +16,9 @@ var noncePattern = regexp.MustCompile("^0x[0-9a-f]{16}$")
 var hashPattern = regexp.MustCompile("^0x[0-9a-f]{64}$")
 var workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_]{1,8}$")
 
+// Hashrate is a quantity, some miners pad it to 32 bytes
+var hashratePattern = regexp.MustCompile("^0x[0-9a-f]{1,64}$")
+
 // Stratum
 func (proxyServer *ProxyServer) handleLoginRPC(clintSession *Session, params []string, workerId string) (bool, *ErrorReply) {
 	if len(params) == 0 {
@@ -82,6 +87,7 @@ func (proxyServer *ProxyServer) handleSubmitRPC(clintSession *Session, params []
 	if !noncePattern.MatchString(params[0]) || !hashPattern.MatchString(params[1]) || !hashPattern.MatchString(params[2]) {
 		proxyServer.policy.ApplyMalformedPolicy(clintSession.ip)
 		log.Infof("Malformed PoW result from %s@%s %v", clintSession.login, clintSession.ip, params)
+		proxyServer.writeShareStat(clintSession.login, clintSession.worker, storage.ShareInvalid)
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
 	t := proxyServer.currentBlockTemplate()
@@ -109,6 +115,38 @@ func (proxyServer *ProxyServer) handleSubmitRPC(clintSession *Session, params []
 	return true, nil
 }
 
+func (proxyServer *ProxyServer) handleSubmitHashrateRPC(clintSession *Session, params []string) (bool, *ErrorReply) {
+	if len(clintSession.login) == 0 {
+		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
+	}
+	if len(params) != 2 {
+		proxyServer.policy.ApplyMalformedPolicy(clintSession.ip)
+		log.Infof("Malformed hashrate params from %s@%s %v", clintSession.login, clintSession.ip, params)
+		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
+	}
+	hashrateHex := strings.ToLower(params[0])
+	clientId := strings.ToLower(params[1])
+	if !hashratePattern.MatchString(hashrateHex) || !hashPattern.MatchString(clientId) {
+		proxyServer.policy.ApplyMalformedPolicy(clintSession.ip)
+		log.Infof("Malformed hashrate from %s@%s %v", clintSession.login, clintSession.ip, params)
+		return false, &ErrorReply{Code: -1, Message: "Malformed hashrate"}
+	}
+	digits := strings.TrimLeft(hashrateHex[2:], "0")
+	if len(digits) == 0 {
+		digits = "0"
+	}
+	hashrate, err := strconv.ParseInt(digits, 16, 64)
+	if err != nil {
+		return false, &ErrorReply{Code: -1, Message: "Malformed hashrate"}
+	}
+
+	err = proxyServer.backend.WriteReportedHashrate(clintSession.login, clintSession.worker, hashrate, clientId, proxyServer.hashrateExpiration)
+	if err != nil {
+		log.Errorf("Failed to write reported hashrate to backend: %v", err)
+	}
+	return true, nil
+}
+
 func (proxyServer *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReplyPart {
 	t := proxyServer.currentBlockTemplate()
 	var reply *rpc.GetBlockReplyPart
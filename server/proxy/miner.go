@@ -6,11 +6,11 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/ethereum/ethash"
 	"github.com/ethereum/go-ethereum/common"
-)
 
-var hasher = ethash.New()
+	"bitbucket.org/vdidenko/dwarf/server/events"
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+)
 
 func (proxyServer *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string) (bool, bool) {
 	nonceHex := params[0]
@@ -22,6 +22,7 @@ func (proxyServer *ProxyServer) processShare(login, id, ip string, t *BlockTempl
 	h, ok := t.headers[hashNoNonce]
 	if !ok {
 		log.Infof("Stale share from %v@%v", login, ip)
+		proxyServer.writeShareStat(login, id, storage.ShareStale)
 		return false, false
 	}
 
@@ -41,12 +42,18 @@ func (proxyServer *ProxyServer) processShare(login, id, ip string, t *BlockTempl
 		mixDigest:   common.HexToHash(mixDigest),
 	}
 
-	if !hasher.Verify(share) {
+	var validShare, validBlock bool
+	proxyServer.verifyPool.do(func() {
+		validShare = proxyServer.verifier.Verify(share)
+		validBlock = validShare && proxyServer.verifier.Verify(block)
+	})
+	if !validShare {
+		proxyServer.writeShareStat(login, id, storage.ShareInvalid)
 		return false, false
 	}
 
-	if hasher.Verify(block) {
-		ok, err := proxyServer.rpc().SubmitBlock(params)
+	if validBlock {
+		ok, err := proxyServer.submitBlock(params, h.height)
 		if err != nil {
 			log.Infof("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
 		} else if !ok {
@@ -56,18 +63,27 @@ func (proxyServer *ProxyServer) processShare(login, id, ip string, t *BlockTempl
 			proxyServer.fetchBlockTemplate()
 			exist, err := proxyServer.backend.WriteBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, proxyServer.hashrateExpiration)
 			if exist {
+				proxyServer.writeShareStat(login, id, storage.ShareDuplicate)
 				return true, false
 			}
 			if err != nil {
 				log.Errorf("Failed to insert block candidate into backend:", err)
 			} else {
 				log.Infof("Inserted block %v to backend", h.height)
+				events.Emit(proxyServer.backend, storage.EventBlockCandidate, map[string]interface{}{
+					"height":     h.height,
+					"nonce":      nonceHex,
+					"difficulty": h.diff.String(),
+					"finder":     login,
+					"worker":     id,
+				})
 			}
 			log.Errorf("Block found by miner %v@%v at height %d", login, ip, h.height)
 		}
 	} else {
 		exist, err := proxyServer.backend.WriteShare(login, id, params, shareDiff, h.height, proxyServer.hashrateExpiration)
 		if exist {
+			proxyServer.writeShareStat(login, id, storage.ShareDuplicate)
 			return true, false
 		}
 		if err != nil {
@@ -76,3 +92,10 @@ func (proxyServer *ProxyServer) processShare(login, id, ip string, t *BlockTempl
 	}
 	return false, true
 }
+
+func (proxyServer *ProxyServer) writeShareStat(login, id, kind string) {
+	err := proxyServer.backend.WriteShareStat(login, id, kind, proxyServer.hashrateExpiration)
+	if err != nil {
+		log.Errorf("Failed to write share stats to backend: %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	log "github.com/dmuth/google-go-log4go"
 	"net"
 	"net/http"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,6 +15,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"bitbucket.org/vdidenko/dwarf/server/policy"
+	"bitbucket.org/vdidenko/dwarf/server/pow"
 	"bitbucket.org/vdidenko/dwarf/server/rpc"
 	"bitbucket.org/vdidenko/dwarf/server/storage"
 	"bitbucket.org/vdidenko/dwarf/server/util"
@@ -24,11 +26,19 @@ type ProxyServer struct {
 	blockTemplate      atomic.Value
 	upstream           int32
 	upstreams          []*rpc.RPCClient
+	verifier           pow.Verifier
+	verifyPool         *verifyPool
+	selector           upstreamSelector
 	backend            *storage.RedisClient
 	diff               string
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
+	droppedSessions    int64
+	refresh            chan struct{}
+	refreshIntv        time.Duration
+	pollIntv           time.Duration
+	pushed             int32
 
 	// Stratum
 	sessionsMu sync.RWMutex
@@ -41,24 +51,38 @@ type Session struct {
 	enc *json.Encoder
 
 	// Stratum
-	sync.Mutex
-	conn  *net.TCPConn
-	login string
+	conn   *net.TCPConn
+	login  string
 	worker string
+	// Replies and the latest job, written by session's own writer
+	out  chan interface{}
+	job  chan interface{}
+	quit chan struct{}
 }
 
 func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		log.Error("You must set instance name")
 	}
+	mustValidateUpstreamPolicy(cfg.UpstreamPolicy)
 	policy := policy.Start(&cfg.Proxy.Policy, backend)
 
-	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
+	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy, refresh: make(chan struct{}, 1)}
 	proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
+	proxy.verifier = pow.NewVerifier(cfg.Pow)
+	workers, queue := cfg.Proxy.VerifyWorkers, cfg.Proxy.VerifyQueue
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queue <= 0 {
+		queue = workers * 64
+	}
+	proxy.verifyPool = newVerifyPool(workers, queue)
+	log.Infof("Verifying shares with %v workers, queue size %v", workers, queue)
 
 	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
 	for i, v := range cfg.Upstream {
-		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
+		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout, &cfg.Upstream[i].Rpc)
 		log.Infof("Upstream: %s => %s", v.Name, v.Url)
 	}
 	log.Infof("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
@@ -72,9 +96,10 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 
 	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
 
-	refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
-	refreshTimer := time.NewTimer(refreshIntv)
-	log.Infof("Set block refresh every %v", refreshIntv)
+	proxy.refreshIntv = util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
+	if len(cfg.Proxy.BlockPollInterval) > 0 {
+		proxy.pollIntv = util.MustParseDuration(cfg.Proxy.BlockPollInterval)
+	}
 
 	checkIntv := util.MustParseDuration(cfg.UpstreamCheckInterval)
 	checkTimer := time.NewTimer(checkIntv)
@@ -82,15 +107,8 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	stateUpdateIntv := util.MustParseDuration(cfg.Proxy.StateUpdateInterval)
 	stateUpdateTimer := time.NewTimer(stateUpdateIntv)
 
-	go func() {
-		for {
-			select {
-			case <-refreshTimer.C:
-				proxy.fetchBlockTemplate()
-				refreshTimer.Reset(refreshIntv)
-			}
-		}
-	}()
+	proxy.startRefresh()
+	proxy.startSubscriptions()
 
 	go func() {
 		for {
@@ -109,6 +127,11 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 				t := proxy.currentBlockTemplate()
 				if t != nil {
 					err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty)
+					if err == nil {
+						metrics := proxy.verifyPool.metrics()
+						metrics["droppedSessions"] = atomic.LoadInt64(&proxy.droppedSessions)
+						err = backend.WriteNodeMetrics(cfg.Name, metrics)
+					}
 					if err != nil {
 						log.Errorf("Failed to write node state to backend: %v", err)
 						proxy.markSick()
@@ -129,6 +152,9 @@ func (proxyServer *ProxyServer) Start() {
 	r := mux.NewRouter()
 	r.Handle("/{login:0x[0-9a-fA-F]{40}}/{id:[0-9a-zA-Z-_]{1,8}}", proxyServer)
 	r.Handle("/{login:0x[0-9a-fA-F]{40}}", proxyServer)
+	if len(proxyServer.config.Proxy.WorkNotifyListen) > 0 {
+		go proxyServer.listenWorkNotify()
+	}
 	srv := &http.Server{
 		Addr:           proxyServer.config.Proxy.Listen,
 		Handler:        r,
@@ -145,23 +171,6 @@ func (proxyServer *ProxyServer) rpc() *rpc.RPCClient {
 	return proxyServer.upstreams[i]
 }
 
-func (proxyServer *ProxyServer) checkUpstreams() {
-	candidate := int32(0)
-	backup := false
-
-	for i, v := range proxyServer.upstreams {
-		if v.Check() && !backup {
-			candidate = int32(i)
-			backup = true
-		}
-	}
-
-	if proxyServer.upstream != candidate {
-		log.Infof("Switching to %v upstream", proxyServer.upstreams[candidate].Name)
-		atomic.StoreInt32(&proxyServer.upstream, candidate)
-	}
-}
-
 func (proxyServer *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		proxyServer.writeError(w, 405, "rpc: POST method required, received "+r.Method)
@@ -229,6 +238,11 @@ func (clintSession *Session) handleMessage(s *ProxyServer, r *http.Request, req
 		clintSession.sendError(req.Id, errReply)
 		return
 	}
+	clintSession.login = login
+	clintSession.worker = vars["id"]
+	if !workerPattern.MatchString(clintSession.worker) {
+		clintSession.worker = "0"
+	}
 
 	// Handle RPC methods
 	switch req.Method {
@@ -263,7 +277,19 @@ func (clintSession *Session) handleMessage(s *ProxyServer, r *http.Request, req
 		reply := s.handleGetBlockByNumberRPC()
 		clintSession.sendResult(req.Id, reply)
 	case "eth_submitHashrate":
-		clintSession.sendResult(req.Id, true)
+		var params []string
+		if req.Params == nil || json.Unmarshal(*req.Params, &params) != nil {
+			s.policy.ApplyMalformedPolicy(clintSession.ip)
+			errReply := &ErrorReply{Code: -1, Message: "Malformed request"}
+			clintSession.sendError(req.Id, errReply)
+			break
+		}
+		reply, errReply := s.handleSubmitHashrateRPC(clintSession, params)
+		if errReply != nil {
+			clintSession.sendError(req.Id, errReply)
+			break
+		}
+		clintSession.sendResult(req.Id, reply)
 	default:
 		errReply := s.handleUnknownRPC(clintSession, req.Method)
 		clintSession.sendError(req.Id, errReply)
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	log "github.com/dmuth/google-go-log4go"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Subscribe to new heads on every upstream which has a push endpoint, only the active one triggers refresh
+func (proxyServer *ProxyServer) startSubscriptions() {
+	for i, v := range proxyServer.config.Upstream {
+		if len(v.Subscribe) == 0 {
+			continue
+		}
+		client := proxyServer.upstreams[i]
+		log.Infof("Upstream %s pushes new heads from %s", v.Name, v.Subscribe)
+		go client.SubscribeNewHeads(v.Subscribe, func() {
+			if proxyServer.rpc() == client {
+				proxyServer.requestRefresh()
+			}
+		})
+	}
+}
+
+// Never blocks, requests coming while refresh is pending are merged into it
+func (proxyServer *ProxyServer) requestRefresh() {
+	atomic.StoreInt32(&proxyServer.pushed, 1)
+	select {
+	case proxyServer.refresh <- struct{}{}:
+	default:
+	}
+}
+
+/* Node may still return previous work right after a new head, so poll fast until work changes.
+ * Otherwise slow polling is enough while active upstream pushes heads.
+ */
+func (proxyServer *ProxyServer) refreshInterval(changed bool) time.Duration {
+	if changed {
+		atomic.StoreInt32(&proxyServer.pushed, 0)
+	}
+	if proxyServer.pollIntv > 0 && proxyServer.rpc().Subscribed() && atomic.LoadInt32(&proxyServer.pushed) == 0 {
+		return proxyServer.pollIntv
+	}
+	return proxyServer.refreshIntv
+}
+
+func (proxyServer *ProxyServer) startRefresh() {
+	timer := time.NewTimer(proxyServer.refreshIntv)
+	log.Infof("Set block refresh every %v", proxyServer.refreshIntv)
+	if proxyServer.pollIntv > 0 {
+		log.Infof("Set block refresh every %v while upstream pushes new heads", proxyServer.pollIntv)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+			case <-proxyServer.refresh:
+				if !timer.Stop() {
+					<-timer.C
+				}
+			}
+			t := proxyServer.currentBlockTemplate()
+			proxyServer.fetchBlockTemplate()
+			timer.Reset(proxyServer.refreshInterval(t != proxyServer.currentBlockTemplate()))
+		}
+	}()
+}
+
+// Notifications are not authenticated, so they are served apart from miners on a private address
+func (proxyServer *ProxyServer) listenWorkNotify() {
+	addr := proxyServer.config.Proxy.WorkNotifyListen
+	log.Infof("Listening for work notifications on %v", addr)
+	r := http.NewServeMux()
+	r.HandleFunc("/notify", proxyServer.handleWorkNotify)
+	err := http.ListenAndServe(addr, r)
+	if err != nil {
+		log.Errorf("Failed to listen for work notifications: %v", err)
+	}
+}
+
+// Work package pushed by geth --miner.notify, payload is not trusted and only triggers refresh
+func (proxyServer *ProxyServer) handleWorkNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	proxyServer.requestRefresh()
+	w.WriteHeader(http.StatusOK)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	log "github.com/dmuth/google-go-log4go"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"bitbucket.org/vdidenko/dwarf/server/util"
@@ -14,8 +15,14 @@ import (
 
 const (
 	MaxReqSize = 1024
+	// Replies pending to a single session, session is dropped on overflow
+	sessionQueueSize = 32
+	// Session is dropped if a single message can't be written in this time
+	sessionWriteTimeout = 10 * time.Second
 )
 
+var errSessionQueueFull = errors.New("session queue is full")
+
 func (proxyServer *ProxyServer) ListenTCP() {
 	timeout := util.MustParseDuration(proxyServer.config.Proxy.Stratum.Timeout)
 	proxyServer.timeout = timeout
@@ -64,6 +71,20 @@ func (proxyServer *ProxyServer) ListenTCP() {
 
 func (proxyServer *ProxyServer) handleTCPClient(cs *Session) error {
 	cs.enc = json.NewEncoder(cs.conn)
+	cs.out = make(chan interface{}, sessionQueueSize)
+	cs.job = make(chan interface{}, 1)
+	cs.quit = make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		proxyServer.writeTCPClient(cs)
+		close(written)
+	}()
+	// Let writer flush replies, error reply in particular, before connection is closed
+	defer func() {
+		close(cs.quit)
+		<-written
+	}()
+
 	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
 	proxyServer.setDeadline(cs.conn)
 
@@ -93,7 +114,11 @@ func (proxyServer *ProxyServer) handleTCPClient(cs *Session) error {
 			}
 			proxyServer.setDeadline(cs.conn)
 			err = cs.handleTCPMessage(proxyServer, &req)
-			if err != nil {
+			if err == errSessionQueueFull {
+				log.Infof("Dropping slow session %v@%v", cs.login, cs.ip)
+				atomic.AddInt64(&proxyServer.droppedSessions, 1)
+				return err
+			} else if err != nil {
 				return err
 			}
 		}
@@ -135,43 +160,111 @@ func (clintSession *Session) handleTCPMessage(proxyServer *ProxyServer, request
 		}
 		return clintSession.sendTCPResult(request.Id, &reply)
 	case "eth_submitHashrate":
-		return clintSession.sendTCPResult(request.Id, true)
+		var params []string
+		if request.Params == nil {
+			return clintSession.sendTCPError(request.Id, &ErrorReply{Code: -1, Message: "Invalid params"})
+		}
+		err := json.Unmarshal(*request.Params, &params)
+		if err != nil {
+			log.Infof("Malformed stratum request params from", clintSession.ip)
+			return err
+		}
+		reply, errReply := proxyServer.handleSubmitHashrateRPC(clintSession, params)
+		if errReply != nil {
+			return clintSession.sendTCPError(request.Id, errReply)
+		}
+		return clintSession.sendTCPResult(request.Id, reply)
 	default:
 		errReply := proxyServer.handleUnknownRPC(clintSession, request.Method)
 		return clintSession.sendTCPError(request.Id, errReply)
 	}
 }
 
-func (clintSession *Session) sendTCPResult(id *json.RawMessage, result interface{}) error {
-	clintSession.Lock()
-	defer clintSession.Unlock()
+// Writes queued replies and jobs until session ends, slow or broken sessions are dropped
+func (proxyServer *ProxyServer) writeTCPClient(cs *Session) {
+	for {
+		var message interface{}
+		isJob := false
+		select {
+		case <-cs.quit:
+			proxyServer.flushTCPClient(cs)
+			return
+		case message = <-cs.out:
+		case message = <-cs.job:
+			isJob = true
+		}
+		cs.conn.SetWriteDeadline(time.Now().Add(sessionWriteTimeout))
+		if err := cs.enc.Encode(message); err != nil {
+			log.Infof("Transmit error to %v@%v: %v", cs.login, cs.ip, err)
+			proxyServer.dropSession(cs)
+			return
+		}
+		if isJob {
+			proxyServer.setDeadline(cs.conn)
+		}
+	}
+}
+
+func (proxyServer *ProxyServer) flushTCPClient(cs *Session) {
+	for {
+		select {
+		case message := <-cs.out:
+			cs.conn.SetWriteDeadline(time.Now().Add(sessionWriteTimeout))
+			if err := cs.enc.Encode(message); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (proxyServer *ProxyServer) dropSession(cs *Session) {
+	atomic.AddInt64(&proxyServer.droppedSessions, 1)
+	proxyServer.removeSession(cs)
+	cs.conn.Close()
+}
+
+func (clintSession *Session) enqueue(message interface{}) error {
+	select {
+	case clintSession.out <- message:
+		return nil
+	default:
+		return errSessionQueueFull
+	}
+}
 
+func (clintSession *Session) sendTCPResult(id *json.RawMessage, result interface{}) error {
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: nil, Result: result}
-	return clintSession.enc.Encode(&message)
+	return clintSession.enqueue(&message)
 }
 
-func (clintSession *Session) pushNewJob(result interface{}) error {
-	clintSession.Lock()
-	defer clintSession.Unlock()
+// Never blocks, job still waiting to be written is stale and replaced
+func (clintSession *Session) pushNewJob(result interface{}) {
 	// FIXME: Temporarily add ID for Claymore compliance
 	message := JSONPushMessage{Version: "2.0", Result: result, Id: 0}
-	return clintSession.enc.Encode(&message)
+	select {
+	case <-clintSession.job:
+	default:
+	}
+	select {
+	case clintSession.job <- &message:
+	default:
+	}
 }
 
 func (clintSession *Session) sendTCPError(id *json.RawMessage, reply *ErrorReply) error {
-	clintSession.Lock()
-	defer clintSession.Unlock()
-
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
-	err := clintSession.enc.Encode(&message)
+	err := clintSession.enqueue(&message)
 	if err != nil {
 		return err
 	}
 	return errors.New(reply.Message)
 }
 
+// Idle timeout of session, writes have their own deadline
 func (proxyServer *ProxyServer) setDeadline(conn *net.TCPConn) {
-	conn.SetDeadline(time.Now().Add(proxyServer.timeout))
+	conn.SetReadDeadline(time.Now().Add(proxyServer.timeout))
 }
 
 func (proxyServer *ProxyServer) registerSession(cs *Session) {
@@ -200,23 +293,8 @@ func (proxyServer *ProxyServer) broadcastNewJobs() {
 	log.Infof("Broadcasting new job to %v stratum miners", count)
 
 	start := time.Now()
-	bcast := make(chan int, 1024)
-	n := 0
-
-	for m := range proxyServer.sessions {
-		n++
-		bcast <- n
-
-		go func(cs *Session) {
-			err := cs.pushNewJob(&reply)
-			<-bcast
-			if err != nil {
-				log.Infof("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
-				proxyServer.removeSession(cs)
-			} else {
-				proxyServer.setDeadline(cs.conn)
-			}
-		}(m)
+	for cs := range proxyServer.sessions {
+		cs.pushNewJob(&reply)
 	}
 	log.Infof("Jobs broadcast finished %s", time.Since(start))
 }
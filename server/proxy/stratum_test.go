@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func testSession(t *testing.T) (*Session, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &Session{conn: conn, enc: json.NewEncoder(conn)}
+	cs.out = make(chan interface{}, sessionQueueSize)
+	cs.job = make(chan interface{}, 1)
+	cs.quit = make(chan struct{})
+	return cs, client
+}
+
+func TestPushNewJobReplacesStaleJob(t *testing.T) {
+	s := &ProxyServer{sessions: make(map[*Session]struct{}), timeout: time.Minute}
+	cs, client := testSession(t)
+	defer client.Close()
+	defer cs.conn.Close()
+
+	cs.pushNewJob([]string{"0x1"})
+	cs.pushNewJob([]string{"0x2"})
+	go s.writeTCPClient(cs)
+	defer close(cs.quit)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	line, _, err := bufio.NewReader(client).ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg struct{ Result []string }
+	json.Unmarshal(line, &msg)
+	if len(msg.Result) != 1 || msg.Result[0] != "0x2" {
+		t.Errorf("Must write only the latest job: %s", line)
+	}
+}
+
+func TestSessionQueueOverflow(t *testing.T) {
+	cs, client := testSession(t)
+	defer client.Close()
+	defer cs.conn.Close()
+
+	for i := 0; i < sessionQueueSize; i++ {
+		if err := cs.sendTCPResult(nil, true); err != nil {
+			t.Fatalf("Must queue replies up to queue size: %v", err)
+		}
+	}
+	if err := cs.sendTCPResult(nil, true); err != errSessionQueueFull {
+		t.Errorf("Must refuse replies to session which can't keep up: %v", err)
+	}
+}
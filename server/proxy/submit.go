@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	log "github.com/dmuth/google-go-log4go"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/rpc"
+)
+
+const (
+	submitAccepted = "accepted"
+	submitRejected = "rejected"
+	submitFailed   = "failed"
+)
+
+type submitResult struct {
+	upstream *rpc.RPCClient
+	outcome  string
+	err      error
+	latency  time.Duration
+}
+
+type submitDecision struct {
+	accepted bool
+	err      error
+}
+
+// Active upstream and all healthy backups
+func (proxyServer *ProxyServer) submitUpstreams() []*rpc.RPCClient {
+	active := proxyServer.rpc()
+	result := []*rpc.RPCClient{active}
+	for _, v := range proxyServer.upstreams {
+		if v != active && !v.Sick() {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+/* Submit solution to every healthy upstream in parallel, it's accepted once any node accepts it.
+ * Returns as soon as outcome is known, stats of slower nodes are recorded in background.
+ * Error is returned only if every node failed to reply.
+ */
+func (proxyServer *ProxyServer) submitBlock(params []string, height uint64) (bool, error) {
+	upstreams := proxyServer.submitUpstreams()
+	results := make(chan submitResult, len(upstreams))
+	for _, v := range upstreams {
+		go func(upstream *rpc.RPCClient) {
+			start := time.Now()
+			ok, err := upstream.SubmitBlock(params)
+			result := submitResult{upstream: upstream, outcome: submitAccepted, err: err, latency: time.Since(start)}
+			if err != nil {
+				result.outcome = submitFailed
+			} else if !ok {
+				result.outcome = submitRejected
+			}
+			results <- result
+		}(v)
+	}
+
+	decision := make(chan submitDecision, 1)
+	go proxyServer.collectSubmits(height, len(upstreams), results, decision)
+	d := <-decision
+	return d.accepted, d.err
+}
+
+func (proxyServer *ProxyServer) collectSubmits(height uint64, n int, results chan submitResult, decision chan submitDecision) {
+	decided := false
+	outcomes := make(map[string]int)
+	var err error
+
+	for i := 0; i < n; i++ {
+		result := <-results
+		outcomes[result.outcome]++
+		if result.err != nil {
+			err = result.err
+			log.Infof("Block submission failure at height %v on %s: %v", height, result.upstream.Name, result.err)
+		} else {
+			log.Infof("Block at height %v %s by %s in %v", height, result.outcome, result.upstream.Name, result.latency)
+		}
+		if !decided && result.outcome == submitAccepted {
+			decision <- submitDecision{accepted: true}
+			decided = true
+		}
+		if err := proxyServer.backend.WriteSubmitStats(result.upstream.Name, result.outcome, result.latency); err != nil {
+			log.Errorf("Failed to write submit stats to backend: %v", err)
+		}
+	}
+
+	if !decided {
+		if outcomes[submitRejected] > 0 {
+			decision <- submitDecision{}
+		} else {
+			if err == nil {
+				err = errors.New("no upstream to submit to")
+			}
+			decision <- submitDecision{err: err}
+		}
+	}
+
+	// Nodes mining on a different work package reject foreign solutions, so it's not necessarily a fault
+	if outcomes[submitAccepted] > 0 && outcomes[submitRejected] > 0 {
+		log.Warnf("Upstreams disagree on block at height %v: %v accepted, %v rejected", height, outcomes[submitAccepted], outcomes[submitRejected])
+		if err := proxyServer.backend.WriteSubmitDisagreement(); err != nil {
+			log.Errorf("Failed to write submit stats to backend: %v", err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"fmt"
+	log "github.com/dmuth/google-go-log4go"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/events"
+	"bitbucket.org/vdidenko/dwarf/server/rpc"
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+)
+
+const (
+	policyPriority = "priority"
+	policyLatency  = "latency"
+	policyHeight   = "height"
+)
+
+// Peers is -1 if node doesn't expose it
+type upstreamHealth struct {
+	alive   bool
+	syncing bool
+	peers   int64
+	height  int64
+	latency time.Duration
+}
+
+// Switch is performed only after the same candidate won this many checks in a row
+type upstreamSelector struct {
+	candidate int
+	wins      int
+}
+
+// Empty policy is priority for configs written before policies were added
+func validUpstreamPolicy(policy string) bool {
+	switch policy {
+	case "", policyPriority, policyLatency, policyHeight:
+		return true
+	}
+	return false
+}
+
+func mustValidateUpstreamPolicy(policy string) {
+	if !validUpstreamPolicy(policy) {
+		panic(fmt.Sprintf("proxy: Unknown upstream policy %q", policy))
+	}
+}
+
+/* Only Check and eth_blockNumber decide whether node is alive. Sync state and peers are optional,
+ * node may not expose net or eth_syncing, so failed probe means unknown rather than dead.
+ */
+func probeUpstream(upstream *rpc.RPCClient) upstreamHealth {
+	health := upstreamHealth{peers: -1}
+	start := time.Now()
+	health.alive = upstream.Check()
+	health.latency = time.Since(start)
+	if !health.alive {
+		return health
+	}
+	var err error
+	if health.height, err = upstream.GetBlockNumber(); err != nil {
+		health.alive = false
+		return health
+	}
+	if syncing, err := upstream.Syncing(); err == nil {
+		health.syncing = syncing
+	}
+	if peers, err := upstream.GetPeerCount(); err == nil {
+		health.peers = peers
+	}
+	return health
+}
+
+func (proxyServer *ProxyServer) probeUpstreams() []upstreamHealth {
+	result := make([]upstreamHealth, len(proxyServer.upstreams))
+	var wg sync.WaitGroup
+	for i, v := range proxyServer.upstreams {
+		wg.Add(1)
+		go func(i int, upstream *rpc.RPCClient) {
+			defer wg.Done()
+			result[i] = probeUpstream(upstream)
+		}(i, v)
+	}
+	wg.Wait()
+	return result
+}
+
+// Alive, synced, connected and not lagging behind the highest head more than maxLag blocks
+func eligibleUpstreams(health []upstreamHealth, maxLag, minPeers int64) []bool {
+	maxHeight := int64(0)
+	for _, h := range health {
+		if h.alive && h.height > maxHeight {
+			maxHeight = h.height
+		}
+	}
+	result := make([]bool, len(health))
+	for i, h := range health {
+		result[i] = h.alive && !h.syncing && (h.peers < 0 || h.peers >= minPeers) && h.height >= maxHeight-maxLag
+	}
+	return result
+}
+
+/* Pick the best upstream by policy among eligible ones, ties are resolved by config order.
+ * Falls back to the first alive upstream and then keeps the current one.
+ */
+func selectUpstream(policy string, health []upstreamHealth, eligible []bool, current int) int {
+	best := -1
+	for i, h := range health {
+		if !eligible[i] {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		switch policy {
+		case policyLatency:
+			if h.latency < health[best].latency {
+				best = i
+			}
+		case policyHeight:
+			if h.height > health[best].height {
+				best = i
+			}
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+	for i, h := range health {
+		if h.alive {
+			return i
+		}
+	}
+	return current
+}
+
+// Returns upstream to use, current one is dropped at once if it's not eligible anymore
+func (s *upstreamSelector) next(current, best int, currentEligible bool, switchAfter int) int {
+	if best == current {
+		s.wins = 0
+		return current
+	}
+	if best == s.candidate {
+		s.wins++
+	} else {
+		s.candidate = best
+		s.wins = 1
+	}
+	if !currentEligible || s.wins >= switchAfter {
+		s.wins = 0
+		return best
+	}
+	return current
+}
+
+func (proxyServer *ProxyServer) checkUpstreams() {
+	cfg := proxyServer.config
+	health := proxyServer.probeUpstreams()
+	eligible := eligibleUpstreams(health, cfg.UpstreamMaxLag, cfg.UpstreamMinPeers)
+	current := int(atomic.LoadInt32(&proxyServer.upstream))
+	best := selectUpstream(cfg.UpstreamPolicy, health, eligible, current)
+	candidate := proxyServer.selector.next(current, best, eligible[current], cfg.UpstreamSwitchAfter)
+	if candidate != current {
+		h := health[candidate]
+		log.Infof("Switching to %v upstream, height %v, peers %v, latency %v", proxyServer.upstreams[candidate].Name, h.height, h.peers, h.latency)
+		atomic.StoreInt32(&proxyServer.upstream, int32(candidate))
+		proxyServer.requestRefresh()
+		events.Emit(proxyServer.backend, storage.EventUpstreamSwitched, map[string]interface{}{
+			"from":    proxyServer.upstreams[current].Name,
+			"to":      proxyServer.upstreams[candidate].Name,
+			"height":  h.height,
+			"peers":   h.peers,
+			"latency": int64(h.latency / time.Millisecond),
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bitbucket.org/vdidenko/dwarf/server/rpc"
+)
+
+func TestSelectUpstream(t *testing.T) {
+	health := []upstreamHealth{
+		{alive: true, syncing: true, peers: 10, height: 100, latency: 5 * time.Millisecond},
+		{alive: true, peers: 10, height: 95, latency: time.Millisecond},
+		{alive: true, peers: 0, height: 100, latency: time.Millisecond},
+		{alive: true, peers: 5, height: 99, latency: 30 * time.Millisecond},
+		{alive: true, peers: 5, height: 100, latency: 20 * time.Millisecond},
+		{alive: true, peers: -1, height: 100, latency: 40 * time.Millisecond},
+		{alive: false, peers: -1, height: 0},
+	}
+	eligible := eligibleUpstreams(health, 1, 1)
+	expected := []bool{false, false, false, true, true, true, false}
+	for i := range expected {
+		if eligible[i] != expected[i] {
+			t.Errorf("Wrong eligibility of upstream %v: %v", i, eligible[i])
+		}
+	}
+
+	if i := selectUpstream(policyPriority, health, eligible, 0); i != 3 {
+		t.Errorf("Must pick the first eligible upstream: %v", i)
+	}
+	if i := selectUpstream(policyLatency, health, eligible, 0); i != 4 {
+		t.Errorf("Must pick the fastest eligible upstream: %v", i)
+	}
+	if i := selectUpstream(policyHeight, health, eligible, 0); i != 4 {
+		t.Errorf("Must pick the highest eligible upstream: %v", i)
+	}
+	if i := selectUpstream(policyPriority, health, make([]bool, len(health)), 0); i != 0 {
+		t.Errorf("Must fall back to the first alive upstream: %v", i)
+	}
+	dead := []upstreamHealth{{}, {}, {}}
+	if i := selectUpstream(policyPriority, dead, make([]bool, len(dead)), 2); i != 2 {
+		t.Errorf("Must keep current upstream if none is alive: %v", i)
+	}
+}
+
+func TestValidUpstreamPolicy(t *testing.T) {
+	for _, policy := range []string{"", policyPriority, policyLatency, policyHeight} {
+		if !validUpstreamPolicy(policy) {
+			t.Errorf("Must accept %q policy", policy)
+		}
+	}
+	if validUpstreamPolicy("fastest") {
+		t.Error("Must reject unknown policy")
+	}
+}
+
+func TestUpstreamSelectorHysteresis(t *testing.T) {
+	s := upstreamSelector{}
+	if s.next(0, 1, true, 3) != 0 || s.next(0, 1, true, 3) != 0 {
+		t.Error("Must not switch before candidate wins enough checks")
+	}
+	if s.next(0, 1, true, 3) != 1 {
+		t.Error("Must switch after candidate won enough checks in a row")
+	}
+
+	s = upstreamSelector{}
+	s.next(0, 1, true, 3)
+	s.next(0, 2, true, 3)
+	if s.next(0, 1, true, 3) != 0 {
+		t.Error("Must restart counting when candidate changes")
+	}
+	if s.next(0, 2, false, 3) != 2 {
+		t.Error("Must switch at once if current upstream is not eligible")
+	}
+}
+
+func TestProbeUpstreamWithoutNetNamespace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Method string }
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "eth_getWork":
+			w.Write([]byte(`{"id":0,"result":["0x1","0x2","0x3"]}`))
+		case "eth_blockNumber":
+			w.Write([]byte(`{"id":0,"result":"0x64"}`))
+		default:
+			w.Write([]byte(`{"id":0,"error":{"code":-32601,"message":"method not found"}}`))
+		}
+	}))
+	defer server.Close()
+
+	health := probeUpstream(rpc.NewRPCClient("test", server.URL, "1s", &rpc.Config{}))
+	if !health.alive || health.height != 100 || health.peers != -1 || health.syncing {
+		t.Errorf("Must treat missing optional probes as unknown: %+v", health)
+	}
+	if !eligibleUpstreams([]upstreamHealth{health}, 1, 1)[0] {
+		t.Error("Must keep node with unknown peers eligible")
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* Shares are verified by fixed number of workers, so bursts of shares queue up
+ * instead of taking all CPU from job broadcasts. Submitting a share blocks while the queue is full.
+ */
+type verifyPool struct {
+	jobs    chan verifyJob
+	workers int
+	busy    int32
+	peak    int32
+	count   int64
+	waitNs  int64
+}
+
+type verifyJob struct {
+	run    func()
+	queued time.Time
+	done   chan struct{}
+}
+
+func newVerifyPool(workers, queue int) *verifyPool {
+	p := &verifyPool{jobs: make(chan verifyJob, queue), workers: workers}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *verifyPool) work() {
+	for job := range p.jobs {
+		atomic.AddInt32(&p.busy, 1)
+		atomic.AddInt64(&p.waitNs, int64(time.Since(job.queued)))
+		job.run()
+		atomic.AddInt64(&p.count, 1)
+		atomic.AddInt32(&p.busy, -1)
+		close(job.done)
+	}
+}
+
+// Runs fn on a worker and waits for it
+func (p *verifyPool) do(fn func()) {
+	job := verifyJob{run: fn, queued: time.Now(), done: make(chan struct{})}
+	p.jobs <- job
+	if depth := int32(len(p.jobs)); depth > atomic.LoadInt32(&p.peak) {
+		atomic.StoreInt32(&p.peak, depth)
+	}
+	<-job.done
+}
+
+// Current queue depth, peak depth and average wait in queue since the previous call
+func (p *verifyPool) metrics() map[string]int64 {
+	count := atomic.SwapInt64(&p.count, 0)
+	wait := atomic.SwapInt64(&p.waitNs, 0)
+	avgWait := int64(0)
+	if count > 0 {
+		avgWait = wait / count / int64(time.Millisecond)
+	}
+	return map[string]int64{
+		"verifyWorkers":   int64(p.workers),
+		"verifyBusy":      int64(atomic.LoadInt32(&p.busy)),
+		"verifyQueue":     int64(len(p.jobs)),
+		"verifyQueuePeak": int64(atomic.SwapInt32(&p.peak, 0)),
+		"verified":        count,
+		"verifyWaitMs":    avgWait,
+	}
+}
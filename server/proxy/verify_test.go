@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerifyPool(t *testing.T) {
+	pool := newVerifyPool(2, 10)
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.do(func() {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+			})
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > 2 {
+		t.Errorf("Must not run more verifications than workers: %v", maxRunning)
+	}
+	metrics := pool.metrics()
+	if metrics["verified"] != 8 || metrics["verifyQueue"] != 0 || metrics["verifyQueuePeak"] == 0 {
+		t.Errorf("Wrong metrics: %v", metrics)
+	}
+	if pool.metrics()["verified"] != 0 {
+		t.Error("Must reset counters after report")
+	}
+}
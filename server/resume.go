@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/dmuth/google-go-log4go"
+
+	"bitbucket.org/vdidenko/dwarf/server/storage"
+)
+
+// Usage: resume <unlocker|payouts> [config.json]
+func runResume(args []string) {
+	if len(args) == 0 || (args[0] != "unlocker" && args[0] != "payouts") {
+		log.Error("Usage: resume <unlocker|payouts> [config.json]")
+		os.Exit(2)
+	}
+	module := args[0]
+
+	readConfig(&cfg, configPath(args[1:]))
+	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+
+	if err := backend.RequestResume(module); err != nil {
+		log.Errorf("Failed to request resume of %v: %v", module, err)
+		os.Exit(1)
+	}
+	log.Infof("Requested resume of %v, it will be resumed on the next run if its checks pass", module)
+}
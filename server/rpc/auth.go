@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type AuthConfig struct {
+	// HTTP basic auth
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Static bearer token
+	Token string `json:"token"`
+	// File with hex encoded HS256 secret, fresh JWT bearer token is signed for each request
+	JwtSecret string            `json:"jwtSecret"`
+	Headers   map[string]string `json:"headers"`
+	// Client certificate and key, CA to verify node certificate instead of system pool
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+	TLSCA   string `json:"tlsCA"`
+}
+
+type auth struct {
+	config    AuthConfig
+	jwtSecret []byte
+	tls       *tls.Config
+}
+
+// Panics on unreadable secrets, like other config errors on start
+func newAuth(cfg AuthConfig) *auth {
+	a := &auth{config: cfg}
+	if len(cfg.JwtSecret) > 0 {
+		data, err := ioutil.ReadFile(cfg.JwtSecret)
+		if err != nil {
+			panic("rpc: Can't read JWT secret: " + err.Error())
+		}
+		secret := strings.TrimPrefix(strings.TrimSpace(string(data)), "0x")
+		a.jwtSecret, err = hex.DecodeString(secret)
+		if err != nil || len(a.jwtSecret) != 32 {
+			panic("rpc: JWT secret must be 32 hex encoded bytes")
+		}
+	}
+	if len(cfg.TLSCert) > 0 || len(cfg.TLSCA) > 0 {
+		a.tls = &tls.Config{}
+		if len(cfg.TLSCert) > 0 {
+			cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+			if err != nil {
+				panic("rpc: Can't load client certificate: " + err.Error())
+			}
+			a.tls.Certificates = []tls.Certificate{cert}
+		}
+		if len(cfg.TLSCA) > 0 {
+			data, err := ioutil.ReadFile(cfg.TLSCA)
+			if err != nil {
+				panic("rpc: Can't read CA: " + err.Error())
+			}
+			a.tls.RootCAs = x509.NewCertPool()
+			if !a.tls.RootCAs.AppendCertsFromPEM(data) {
+				panic("rpc: No certificates found in CA file " + cfg.TLSCA)
+			}
+		}
+	}
+	return a
+}
+
+func (a *auth) header() http.Header {
+	header := http.Header{}
+	for k, v := range a.config.Headers {
+		header.Set(k, v)
+	}
+	if len(a.config.Username) > 0 {
+		credentials := base64.StdEncoding.EncodeToString([]byte(a.config.Username + ":" + a.config.Password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+	if len(a.config.Token) > 0 {
+		header.Set("Authorization", "Bearer "+a.config.Token)
+	}
+	if len(a.jwtSecret) > 0 {
+		header.Set("Authorization", "Bearer "+signJWT(a.jwtSecret, time.Now()))
+	}
+	return header
+}
+
+func (a *auth) apply(req *http.Request) {
+	for k, v := range a.header() {
+		req.Header[k] = v
+	}
+}
+
+// Token with "iat" claim only, as required by engine API
+func signJWT(secret []byte, now time.Time) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{"iat": now.Unix()})
+	payload := fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(header), base64.RawURLEncoding.EncodeToString(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+/* Breaker opens after threshold consecutive failures and refuses calls for timeout.
+ * Then a single probe call is let through: success closes breaker, failure opens it again.
+ */
+type breaker struct {
+	sync.Mutex
+	threshold int
+	timeout   time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newBreaker(threshold int, timeout time.Duration) *breaker {
+	return &breaker{threshold: threshold, timeout: timeout}
+}
+
+func (b *breaker) allow() error {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *breaker) success() {
+	b.Lock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+	b.Unlock()
+}
+
+func (b *breaker) failure() {
+	b.Lock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+	b.Unlock()
+}
+
+func (b *breaker) isOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.state != breakerClosed
+}
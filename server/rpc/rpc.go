@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
@@ -10,21 +11,39 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 
 	"bitbucket.org/vdidenko/dwarf/server/util"
 )
 
+type Config struct {
+	// Extra attempts of idempotent reads, with exponential backoff between them
+	Retries         int    `json:"retries"`
+	RetryBackoff    string `json:"retryBackoff"`
+	MaxRetryBackoff string `json:"maxRetryBackoff"`
+	// Open breaker after this number of consecutive failures, probe node again after timeout
+	BreakerThreshold int    `json:"breakerThreshold"`
+	BreakerTimeout   string `json:"breakerTimeout"`
+	// Max number of calls in a single batch request
+	BatchSize int `json:"batchSize"`
+
+	Auth AuthConfig `json:"auth"`
+}
+
 type RPCClient struct {
-	sync.RWMutex
-	Url         string
-	Name        string
-	sick        bool
-	sickRate    int
-	successRate int
-	client      *http.Client
+	Url             string
+	Name            string
+	timeout         time.Duration
+	retries         int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	batchSize       int
+	breaker         *breaker
+	auth            *auth
+	client          *http.Client
+	subscribed      int32
 }
 
 type GetBlockReply struct {
@@ -68,17 +87,48 @@ type JSONRpcResp struct {
 	Error  map[string]interface{} `json:"error"`
 }
 
-func NewRPCClient(name, url, timeout string) *RPCClient {
-	rpcClient := &RPCClient{Name: name, Url: url}
-	timeoutIntv := util.MustParseDuration(timeout)
-	rpcClient.client = &http.Client{
-		Timeout: timeoutIntv,
+// Single call of a batch, Result must be a pointer to unmarshal reply into
+type BatchElem struct {
+	Method string
+	Params interface{}
+	Result interface{}
+	Error  error
+}
+
+// Config is optional, nil keeps defaults: no retries and breaker opening after 5 failures for 10s
+func NewRPCClient(name, url, timeout string, cfg *Config) *RPCClient {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	rpcClient := &RPCClient{Name: name, Url: url, retries: cfg.Retries, batchSize: cfg.BatchSize}
+	rpcClient.timeout = util.MustParseDuration(timeout)
+	rpcClient.retryBackoff = parseDurationOr(cfg.RetryBackoff, 100*time.Millisecond)
+	rpcClient.maxRetryBackoff = parseDurationOr(cfg.MaxRetryBackoff, 5*time.Second)
+	if rpcClient.batchSize <= 0 {
+		rpcClient.batchSize = 100
+	}
+	threshold := cfg.BreakerThreshold
+	if threshold <= 0 {
+		threshold = 5
+	}
+	rpcClient.breaker = newBreaker(threshold, parseDurationOr(cfg.BreakerTimeout, 10*time.Second))
+	rpcClient.auth = newAuth(cfg.Auth)
+	rpcClient.client = &http.Client{}
+	if rpcClient.auth.tls != nil {
+		rpcClient.client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: rpcClient.auth.tls}
 	}
 	return rpcClient
 }
 
+func parseDurationOr(s string, value time.Duration) time.Duration {
+	if len(s) == 0 {
+		return value
+	}
+	return util.MustParseDuration(s)
+}
+
 func (rpcClient *RPCClient) GetWork() ([]string, error) {
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, "eth_getWork", []string{})
+	rpcResp, err := rpcClient.doPost("eth_getWork", []string{}, true)
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +138,7 @@ func (rpcClient *RPCClient) GetWork() ([]string, error) {
 }
 
 func (rpcClient *RPCClient) GetPendingBlock() (*GetBlockReplyPart, error) {
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, "eth_getBlockByNumber", []interface{}{"pending", false})
+	rpcResp, err := rpcClient.doPost("eth_getBlockByNumber", []interface{}{"pending", false}, true)
 	if err != nil {
 		return nil, err
 	}
@@ -116,7 +166,7 @@ func (rpcClient *RPCClient) GetUncleByBlockNumberAndIndex(height int64, index in
 }
 
 func (rpcClient *RPCClient) getBlockBy(method string, params []interface{}) (*GetBlockReply, error) {
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, method, params)
+	rpcResp, err := rpcClient.doPost(method, params, true)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +179,7 @@ func (rpcClient *RPCClient) getBlockBy(method string, params []interface{}) (*Ge
 }
 
 func (rpcClient *RPCClient) GetTxReceipt(hash string) (*TxReceipt, error) {
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, "eth_getTransactionReceipt", []string{hash})
+	rpcResp, err := rpcClient.doPost("eth_getTransactionReceipt", []string{hash}, true)
 	if err != nil {
 		return nil, err
 	}
@@ -141,8 +191,46 @@ func (rpcClient *RPCClient) GetTxReceipt(hash string) (*TxReceipt, error) {
 	return nil, nil
 }
 
+// Blocks with full transactions in order of heights, nil for heights node doesn't have yet
+func (rpcClient *RPCClient) GetBlocksByHeight(heights []int64) ([]*GetBlockReply, error) {
+	replies := make([]*GetBlockReply, len(heights))
+	elems := make([]BatchElem, len(heights))
+	for i, height := range heights {
+		elems[i] = BatchElem{Method: "eth_getBlockByNumber", Params: []interface{}{fmt.Sprintf("0x%x", height), true}, Result: &replies[i]}
+	}
+	return replies, rpcClient.batchResult(elems)
+}
+
+// Receipts in order of hashes, nil for unknown transactions
+func (rpcClient *RPCClient) GetTxReceipts(hashes []string) ([]*TxReceipt, error) {
+	replies := make([]*TxReceipt, len(hashes))
+	elems := make([]BatchElem, len(hashes))
+	for i, hash := range hashes {
+		elems[i] = BatchElem{Method: "eth_getTransactionReceipt", Params: []string{hash}, Result: &replies[i]}
+	}
+	return replies, rpcClient.batchResult(elems)
+}
+
+// Run batch failing on the first error of its calls
+func (rpcClient *RPCClient) batchResult(elems []BatchElem) error {
+	if len(elems) == 0 {
+		return nil
+	}
+	err := rpcClient.BatchCall(context.Background(), elems)
+	if err != nil {
+		return err
+	}
+	for _, elem := range elems {
+		if elem.Error != nil {
+			return elem.Error
+		}
+	}
+	return nil
+}
+
+// Found block is always sent to node, even if breaker is open, outcome still counts against it
 func (rpcClient *RPCClient) SubmitBlock(params []string) (bool, error) {
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, "eth_submitWork", params)
+	rpcResp, err := rpcClient.doPostContext(context.Background(), "eth_submitWork", params, false, true)
 	if err != nil {
 		return false, err
 	}
@@ -152,7 +240,7 @@ func (rpcClient *RPCClient) SubmitBlock(params []string) (bool, error) {
 }
 
 func (rpcClient *RPCClient) GetBalance(address string) (*big.Int, error) {
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, "eth_getBalance", []string{address, "latest"})
+	rpcResp, err := rpcClient.doPost("eth_getBalance", []string{address, "latest"}, true)
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +254,7 @@ func (rpcClient *RPCClient) GetBalance(address string) (*big.Int, error) {
 
 func (rpcClient *RPCClient) Sign(from string) (string, error) {
 	hash := sha256.Sum256([]byte("0x0"))
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, "eth_sign", []string{from, common.ToHex(hash[:])})
+	rpcResp, err := rpcClient.doPost("eth_sign", []string{from, common.ToHex(hash[:])}, false)
 	var reply string
 	if err != nil {
 		return reply, err
@@ -182,7 +270,7 @@ func (rpcClient *RPCClient) Sign(from string) (string, error) {
 }
 
 func (rpcClient *RPCClient) GetPeerCount() (int64, error) {
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, "net_peerCount", nil)
+	rpcResp, err := rpcClient.doPost("net_peerCount", nil, true)
 	if err != nil {
 		return 0, err
 	}
@@ -194,6 +282,32 @@ func (rpcClient *RPCClient) GetPeerCount() (int64, error) {
 	return strconv.ParseInt(strings.Replace(reply, "0x", "", -1), 16, 64)
 }
 
+func (rpcClient *RPCClient) GetBlockNumber() (int64, error) {
+	rpcResp, err := rpcClient.doPost("eth_blockNumber", nil, true)
+	if err != nil {
+		return 0, err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
+
+// Node replies false if it's in sync, otherwise an object with sync progress
+func (rpcClient *RPCClient) Syncing() (bool, error) {
+	rpcResp, err := rpcClient.doPost("eth_syncing", nil, true)
+	if err != nil {
+		return false, err
+	}
+	var reply bool
+	if json.Unmarshal(*rpcResp.Result, &reply) == nil {
+		return reply, nil
+	}
+	return true, nil
+}
+
 func (rpcClient *RPCClient) SendTransaction(from, to, gas, gasPrice, value string, autoGas bool) (string, error) {
 	params := map[string]string{
 		"from":  from,
@@ -204,7 +318,7 @@ func (rpcClient *RPCClient) SendTransaction(from, to, gas, gasPrice, value strin
 		params["gas"] = gas
 		params["gasPrice"] = gasPrice
 	}
-	rpcResp, err := rpcClient.doPost(rpcClient.Url, "eth_sendTransaction", []interface{}{params})
+	rpcResp, err := rpcClient.doPost("eth_sendTransaction", []interface{}{params}, false)
 	var reply string
 	if err != nil {
 		return reply, err
@@ -223,67 +337,151 @@ func (rpcClient *RPCClient) SendTransaction(from, to, gas, gasPrice, value strin
 	return reply, err
 }
 
-func (rpcClient *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
-	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
-	data, _ := json.Marshal(jsonReq)
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	req.Header.Set("Content-Length", (string)(len(data)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := rpcClient.client.Do(req)
-	if err != nil {
-		rpcClient.markSick()
-		return nil, err
-	}
-	defer resp.Body.Close()
+func (rpcClient *RPCClient) doPost(method string, params interface{}, idempotent bool) (*JSONRpcResp, error) {
+	return rpcClient.doPostContext(context.Background(), method, params, idempotent, false)
+}
 
+func (rpcClient *RPCClient) doPostContext(ctx context.Context, method string, params interface{}, idempotent, force bool) (*JSONRpcResp, error) {
+	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
 	var rpcResp *JSONRpcResp
-	err = json.NewDecoder(resp.Body).Decode(&rpcResp)
+	err := rpcClient.post(ctx, jsonReq, &rpcResp, idempotent, force)
 	if err != nil {
-		rpcClient.markSick()
 		return nil, err
 	}
 	if rpcResp.Error != nil {
-		rpcClient.markSick()
-		return nil, errors.New(rpcResp.Error["message"].(string))
+		rpcClient.breaker.failure()
+		message, _ := rpcResp.Error["message"].(string)
+		return nil, errors.New(message)
 	}
-	return rpcResp, err
+	rpcClient.breaker.success()
+	return rpcResp, nil
 }
 
-func (rpcClient *RPCClient) Check() bool {
-	_, err := rpcClient.GetWork()
+// Call within deadline of ctx, reply is unmarshalled into result. Never retried.
+func (rpcClient *RPCClient) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	rpcResp, err := rpcClient.doPostContext(ctx, method, params, false, false)
 	if err != nil {
-		return false
+		return err
+	}
+	if rpcResp.Result == nil {
+		return nil
 	}
-	rpcClient.markAlive()
-	return !rpcClient.Sick()
+	return json.Unmarshal(*rpcResp.Result, result)
 }
 
-func (rpcClient *RPCClient) Sick() bool {
-	rpcClient.RLock()
-	defer rpcClient.RUnlock()
-	return rpcClient.sick
+// Send calls in batches of configured size, errors of individual calls are set on elements
+func (rpcClient *RPCClient) BatchCall(ctx context.Context, elems []BatchElem) error {
+	for start := 0; start < len(elems); start += rpcClient.batchSize {
+		end := start + rpcClient.batchSize
+		if end > len(elems) {
+			end = len(elems)
+		}
+		if err := rpcClient.batchCall(ctx, elems[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rpcClient *RPCClient) batchCall(ctx context.Context, elems []BatchElem) error {
+	jsonReq := make([]map[string]interface{}, len(elems))
+	for i, elem := range elems {
+		jsonReq[i] = map[string]interface{}{"jsonrpc": "2.0", "method": elem.Method, "params": elem.Params, "id": i}
+	}
+	var rpcResp []*JSONRpcResp
+	err := rpcClient.post(ctx, jsonReq, &rpcResp, true, false)
+	if err != nil {
+		return err
+	}
+	// Node replied to the batch, errors of individual calls don't count against it
+	rpcClient.breaker.success()
+	for i := range elems {
+		elems[i].Error = errors.New("missing reply in batch")
+	}
+	for _, resp := range rpcResp {
+		var id int
+		if resp.Id == nil || json.Unmarshal(*resp.Id, &id) != nil || id < 0 || id >= len(elems) {
+			continue
+		}
+		elem := &elems[id]
+		switch {
+		case resp.Error != nil:
+			message, _ := resp.Error["message"].(string)
+			elem.Error = errors.New(message)
+		case resp.Result == nil:
+			elem.Error = nil
+		default:
+			elem.Error = json.Unmarshal(*resp.Result, elem.Result)
+		}
+	}
+	return nil
 }
 
-func (rpcClient *RPCClient) markSick() {
-	rpcClient.Lock()
-	rpcClient.sickRate++
-	rpcClient.successRate = 0
-	if rpcClient.sickRate >= 5 {
-		rpcClient.sick = true
+/* Transport and decoding errors of idempotent calls are retried, each attempt has its own deadline.
+ * Failed attempts are recorded by breaker here, success is recorded by caller once reply is inspected,
+ * so every request to node counts exactly once. Forced requests are sent even if breaker is open.
+ */
+func (rpcClient *RPCClient) post(ctx context.Context, jsonReq interface{}, reply interface{}, idempotent, force bool) error {
+	data, _ := json.Marshal(jsonReq)
+	attempts := 1
+	if idempotent {
+		attempts += rpcClient.retries
+	}
+	backoff := rpcClient.retryBackoff
+	var err error
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > rpcClient.maxRetryBackoff {
+				backoff = rpcClient.maxRetryBackoff
+			}
+		}
+		if !force {
+			if err = rpcClient.breaker.allow(); err != nil {
+				return err
+			}
+		}
+		err = rpcClient.postOnce(ctx, data, reply)
+		if err == nil {
+			return nil
+		}
+		rpcClient.breaker.failure()
 	}
-	rpcClient.Unlock()
+	return err
 }
 
-func (rpcClient *RPCClient) markAlive() {
-	rpcClient.Lock()
-	rpcClient.successRate++
-	if rpcClient.successRate >= 5 {
-		rpcClient.sick = false
-		rpcClient.sickRate = 0
-		rpcClient.successRate = 0
+func (rpcClient *RPCClient) postOnce(ctx context.Context, data []byte, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, rpcClient.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", rpcClient.Url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
 	}
-	rpcClient.Unlock()
+	req = req.WithContext(ctx)
+	rpcClient.auth.apply(req)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := rpcClient.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (rpcClient *RPCClient) Check() bool {
+	_, err := rpcClient.GetWork()
+	return err == nil && !rpcClient.Sick()
+}
+
+func (rpcClient *RPCClient) Sick() bool {
+	return rpcClient.breaker.isOpen()
 }
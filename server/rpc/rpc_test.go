@@ -0,0 +1,207 @@
+package rpc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(2, 50*time.Millisecond)
+	b.failure()
+	if b.allow() != nil {
+		t.Error("Must stay closed below threshold")
+	}
+	b.failure()
+	if b.allow() != ErrCircuitOpen {
+		t.Error("Must open after threshold failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if b.allow() != nil {
+		t.Error("Must let a probe through after timeout")
+	}
+	if b.allow() != ErrCircuitOpen {
+		t.Error("Must allow a single probe while half-open")
+	}
+	b.failure()
+	if b.allow() != ErrCircuitOpen {
+		t.Error("Must open again if probe failed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.allow()
+	b.success()
+	if b.isOpen() || b.allow() != nil {
+		t.Error("Must close if probe succeeded")
+	}
+}
+
+func TestBreakerOpensOnErrorReplies(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"id":0,"error":{"code":-32000,"message":"internal error"}}`))
+	}))
+	defer server.Close()
+
+	client := NewRPCClient("test", server.URL, "1s", &Config{BreakerThreshold: 3, BreakerTimeout: "1m"})
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetPeerCount(); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Must return error reply of node: %v", err)
+		}
+	}
+	if !client.Sick() {
+		t.Error("Must open breaker after threshold error replies in a row")
+	}
+	if _, err := client.GetPeerCount(); err != ErrCircuitOpen || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("Must refuse calls while breaker is open: %v %v", err, requests)
+	}
+}
+
+func TestSubmitBlockWithOpenBreaker(t *testing.T) {
+	var requests, healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.Write([]byte(`{"id":0,"error":{"code":-32000,"message":"internal error"}}`))
+			return
+		}
+		w.Write([]byte(`{"id":0,"result":true}`))
+	}))
+	defer server.Close()
+
+	client := NewRPCClient("test", server.URL, "1s", &Config{BreakerThreshold: 2, BreakerTimeout: "1m"})
+	client.GetPeerCount()
+	client.GetPeerCount()
+	if !client.Sick() {
+		t.Fatal("Must open breaker after threshold error replies in a row")
+	}
+
+	if _, err := client.SubmitBlock([]string{"0x0", "0x0", "0x0"}); err == nil || err == ErrCircuitOpen {
+		t.Errorf("Must send block to node while breaker is open: %v", err)
+	}
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("Must reach node with block submission: %v", requests)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	ok, err := client.SubmitBlock([]string{"0x0", "0x0", "0x0"})
+	if !ok || err != nil {
+		t.Errorf("Must accept block while breaker is open: %v %v", ok, err)
+	}
+	if client.Sick() {
+		t.Error("Must record successful submission in breaker")
+	}
+}
+
+func TestBatchCall(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		var req []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		var reply []map[string]interface{}
+		// Reply in reverse order, client must match by id
+		for i := len(req) - 1; i >= 0; i-- {
+			hash := req[i]["params"].([]interface{})[0].(string)
+			if hash == "0x2" {
+				reply = append(reply, map[string]interface{}{"id": req[i]["id"], "result": nil})
+			} else {
+				reply = append(reply, map[string]interface{}{"id": req[i]["id"], "result": map[string]string{"transactionHash": hash, "gasUsed": "0x1"}})
+			}
+		}
+		json.NewEncoder(w).Encode(reply)
+	}))
+	defer server.Close()
+
+	client := NewRPCClient("test", server.URL, "1s", &Config{BatchSize: 2})
+	receipts, err := client.GetTxReceipts([]string{"0x1", "0x2", "0x3"})
+	if err != nil {
+		t.Fatalf("Must fetch receipts: %v", err)
+	}
+	if receipts[0].TxHash != "0x1" || receipts[1] != nil || receipts[2].TxHash != "0x3" {
+		t.Errorf("Must return receipts in order of hashes: %v", receipts)
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("Must split calls into batches of configured size: %v", requests)
+	}
+}
+
+func TestRetryIdempotentCalls(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.Write([]byte("garbage"))
+			return
+		}
+		w.Write([]byte(`{"id":0,"result":"0x10"}`))
+	}))
+	defer server.Close()
+
+	client := NewRPCClient("test", server.URL, "1s", &Config{Retries: 2, RetryBackoff: "1ms"})
+	n, err := client.GetPeerCount()
+	if err != nil || n != 16 {
+		t.Errorf("Must retry idempotent call: %v %v", n, err)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = client.SubmitBlock([]string{"0x0", "0x0", "0x0"})
+	if err == nil || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("Must not retry block submission: %v", requests)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "auth")
+	defer os.RemoveAll(dir)
+	secret := strings.Repeat("ab", 32)
+	ioutil.WriteFile(filepath.Join(dir, "jwt.hex"), []byte("0x"+secret+"\n"), 0600)
+
+	var header http.Header
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte(`{"id":0,"result":"0x1"}`))
+	}))
+	defer server.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), ca, 0600)
+
+	cfg := &Config{Auth: AuthConfig{
+		JwtSecret: filepath.Join(dir, "jwt.hex"),
+		Headers:   map[string]string{"X-Api-Key": "key"},
+		TLSCA:     filepath.Join(dir, "ca.pem"),
+	}}
+	client := NewRPCClient("test", server.URL, "1s", cfg)
+	if _, err := client.GetPeerCount(); err != nil {
+		t.Fatalf("Must trust node certificate signed by configured CA: %v", err)
+	}
+	if header.Get("X-Api-Key") != "key" {
+		t.Error("Must send custom headers")
+	}
+	key, _ := hex.DecodeString(secret)
+	parts := strings.Split(strings.TrimPrefix(header.Get("Authorization"), "Bearer "), ".")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if len(parts) != 3 || parts[2] != base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Must send JWT signed with secret: %v", parts)
+	}
+
+	cfg = &Config{Auth: AuthConfig{Username: "user", Password: "pass", TLSCA: filepath.Join(dir, "ca.pem")}}
+	NewRPCClient("test", server.URL, "1s", cfg).GetPeerCount()
+	if header.Get("Authorization") != "Basic dXNlcjpwYXNz" {
+		t.Errorf("Must send basic auth: %v", header.Get("Authorization"))
+	}
+}
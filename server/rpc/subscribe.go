@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/dmuth/google-go-log4go"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+	// Node is considered silent if no head arrived within this time
+	subscriptionTimeout = 2 * time.Minute
+)
+
+// Common part of WebSocket and IPC connections
+type jsonConn interface {
+	ReadJSON(v interface{}) error
+	WriteJSON(v interface{}) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+type ipcConn struct {
+	net.Conn
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+func (c *ipcConn) ReadJSON(v interface{}) error  { return c.dec.Decode(v) }
+func (c *ipcConn) WriteJSON(v interface{}) error { return c.enc.Encode(v) }
+
+type subscriptionMsg struct {
+	Id     *json.RawMessage       `json:"id"`
+	Method string                 `json:"method"`
+	Result *json.RawMessage       `json:"result"`
+	Error  map[string]interface{} `json:"error"`
+	Params struct {
+		Subscription string           `json:"subscription"`
+		Result       *json.RawMessage `json:"result"`
+	} `json:"params"`
+}
+
+// ws://, wss:// endpoints are dialed as WebSocket with upstream credentials, anything else is a path of IPC socket
+func (rpcClient *RPCClient) dialSubscription(endpoint string) (jsonConn, error) {
+	if strings.HasPrefix(endpoint, "ws://") || strings.HasPrefix(endpoint, "wss://") {
+		dialer := *websocket.DefaultDialer
+		dialer.TLSClientConfig = rpcClient.auth.tls
+		conn, _, err := dialer.Dial(endpoint, rpcClient.auth.header())
+		return conn, err
+	}
+	conn, err := net.DialTimeout("unix", endpoint, maxReconnectDelay)
+	if err != nil {
+		return nil, err
+	}
+	return &ipcConn{Conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}, nil
+}
+
+/* Keep newHeads subscription open on endpoint, onHead is called on every new head.
+ * Reconnects with backoff forever, Subscribed() reports whether subscription is live.
+ */
+func (rpcClient *RPCClient) SubscribeNewHeads(endpoint string, onHead func()) {
+	delay := minReconnectDelay
+	for {
+		start := time.Now()
+		err := rpcClient.subscribe(endpoint, onHead)
+		atomic.StoreInt32(&rpcClient.subscribed, 0)
+		// Connection was fine for a while, start backoff over
+		if time.Since(start) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		log.Warnf("Subscription to %s on %s lost: %v, reconnecting in %v", endpoint, rpcClient.Name, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (rpcClient *RPCClient) Subscribed() bool {
+	return atomic.LoadInt32(&rpcClient.subscribed) == 1
+}
+
+func (rpcClient *RPCClient) subscribe(endpoint string, onHead func()) error {
+	conn, err := rpcClient.dialSubscription(endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := map[string]interface{}{"jsonrpc": "2.0", "method": "eth_subscribe", "params": []string{"newHeads"}, "id": 1}
+	if err := conn.WriteJSON(req); err != nil {
+		return err
+	}
+
+	var id string
+	for {
+		conn.SetReadDeadline(time.Now().Add(subscriptionTimeout))
+		var msg subscriptionMsg
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		switch {
+		case msg.Error != nil:
+			message, _ := msg.Error["message"].(string)
+			return errors.New(message)
+		case msg.Id != nil && msg.Result != nil && len(id) == 0:
+			if err := json.Unmarshal(*msg.Result, &id); err != nil {
+				return err
+			}
+			atomic.StoreInt32(&rpcClient.subscribed, 1)
+			log.Infof("Subscribed to new heads on %s", rpcClient.Name)
+		case msg.Method == "eth_subscription" && msg.Params.Subscription == id:
+			onHead()
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package rpc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSubscribeNewHeadsIPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "geth.ipc")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var req map[string]interface{}
+		json.NewDecoder(conn).Decode(&req)
+		enc := json.NewEncoder(conn)
+		enc.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": "0xcd0c"})
+		for i := 0; i < 2; i++ {
+			enc.Encode(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"method":  "eth_subscription",
+				"params":  map[string]interface{}{"subscription": "0xcd0c", "result": map[string]string{"number": "0x1"}},
+			})
+		}
+		time.Sleep(time.Second)
+	}()
+
+	heads := make(chan struct{}, 2)
+	client := NewRPCClient("test", "http://127.0.0.1:0", "1s", nil)
+	go client.SubscribeNewHeads(path, func() { heads <- struct{}{} })
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-heads:
+		case <-time.After(time.Second):
+			t.Fatal("Must notify on every new head")
+		}
+	}
+	if !client.Subscribed() {
+		t.Error("Must report live subscription")
+	}
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"gopkg.in/redis.v3"
+
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+var (
+	ErrInvalidAdjustment   = errors.New("adjustment must have non-zero amount, reason and operator")
+	ErrInsufficientBalance = errors.New("debit exceeds miner balance")
+	ErrUnknownMiner        = errors.New("miner not found")
+	ErrPayoutsInProgress   = errors.New("payouts are in progress")
+	ErrAdjustmentConflict  = errors.New("miner was updated concurrently")
+)
+
+// Attempts of adjustment or payer's debit when miner is updated concurrently
+const adjustAttempts = 3
+
+// Manual credit (positive amount) or debit (negative amount) of miner's balance in Shannon
+type Adjustment struct {
+	Id        int64  `json:"id"`
+	Login     string `json:"login"`
+	Amount    int64  `json:"amount"`
+	Reason    string `json:"reason"`
+	Operator  string `json:"operator"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+/* Updates balances of miner and pool atomically. Adjustment is appended to "adjustments" list,
+ * which is never trimmed, and to miner's reward history with "adjustment" state.
+ * Id of an attempt aborted by concurrent update is skipped.
+ */
+func (redisClient *RedisClient) AdjustBalance(login string, amount int64, reason, operator string) (*Adjustment, error) {
+	if amount == 0 || len(reason) == 0 || len(operator) == 0 {
+		return nil, ErrInvalidAdjustment
+	}
+	for i := 0; i < adjustAttempts; i++ {
+		adj, err := redisClient.adjustBalance(login, amount, reason, operator)
+		if err != redis.TxFailedErr {
+			return adj, err
+		}
+	}
+	return nil, ErrAdjustmentConflict
+}
+
+/* Payer reads balance before taking payouts lock, so debit is refused while lock is held.
+ * Lock is watched too, payouts starting after the check abort the transaction.
+ */
+func (redisClient *RedisClient) adjustBalance(login string, amount int64, reason, operator string) (*Adjustment, error) {
+	minerKey := redisClient.formatKey("miners", login)
+	lockKey := redisClient.formatKey("payments", "lock")
+	tx, err := redisClient.client.Watch(minerKey, lockKey)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	if amount < 0 {
+		locked, err := tx.Exists(lockKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return nil, ErrPayoutsInProgress
+		}
+	}
+
+	exist, err := tx.Exists(minerKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, ErrUnknownMiner
+	}
+	balance, err := tx.HGet(minerKey, "balance").Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if balance+amount < 0 {
+		return nil, ErrInsufficientBalance
+	}
+	id, err := redisClient.client.Incr(redisClient.formatKey("adjustments", "seq")).Result()
+	if err != nil {
+		return nil, err
+	}
+	adj := &Adjustment{Id: id, Login: login, Amount: amount, Reason: reason, Operator: operator, Timestamp: util.MakeTimestamp() / 1000}
+	data, err := json.Marshal(adj)
+	if err != nil {
+		return nil, err
+	}
+
+	member := join(int64(0), "adjustment-"+strconv.FormatInt(id, 10))
+	_, err = tx.Exec(func() error {
+		tx.HIncrBy(minerKey, "balance", amount)
+		tx.HIncrBy(redisClient.formatKey("finances"), "balance", amount)
+		tx.HIncrBy(redisClient.formatKey("finances"), "adjusted", amount)
+		tx.LPush(redisClient.formatKey("adjustments"), string(data))
+		tx.ZAdd(redisClient.formatKey("rewards", login), redis.Z{Score: float64(adj.Timestamp), Member: member})
+		tx.HSet(redisClient.formatKey("rewards", login, "data"), member, join(amount, int64(0), int64(0), RewardAdjustment))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return adj, nil
+}
+
+// Newest adjustments first
+func (redisClient *RedisClient) GetAdjustments(offset, limit int64) ([]*Adjustment, error) {
+	raw, err := redisClient.client.LRange(redisClient.formatKey("adjustments"), offset, offset+limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Adjustment, 0, len(raw))
+	for _, v := range raw {
+		var adj Adjustment
+		if json.Unmarshal([]byte(v), &adj) == nil {
+			result = append(result, &adj)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"gopkg.in/redis.v3"
+
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+// Max length of admin audit log, oldest entries are trimmed
+const maxAuditEntries = 10000
+
+// Admin API key, only SHA-256 of the key itself is ever stored
+type AdminKey struct {
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash"`
+	Scopes []string `json:"scopes"`
+}
+
+type AdminAudit struct {
+	Timestamp int64  `json:"timestamp"`
+	Key       string `json:"key"`
+	Ip        string `json:"ip"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Status    int    `json:"status"`
+}
+
+// State of unlocker or payouts module, written on every run
+type ModuleStatus struct {
+	Name     string `json:"name"`
+	Halted   bool   `json:"halted"`
+	LastFail string `json:"lastFail,omitempty"`
+	// Transient failures in a row and time of the next attempt
+	Failures  int   `json:"failures"`
+	RetryAt   int64 `json:"retryAt,omitempty"`
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+type Ban struct {
+	Ip        string `json:"ip"`
+	Reason    string `json:"reason"`
+	BannedAt  int64  `json:"bannedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+func HashAdminKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Keys in "admin:keys" are stored as hash => JSON
+func (redisClient *RedisClient) GetAdminKey(hash string) (*AdminKey, error) {
+	raw, err := redisClient.client.HGet(redisClient.formatKey("admin", "keys"), hash).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var key AdminKey
+	if err := json.Unmarshal([]byte(raw), &key); err != nil {
+		return nil, err
+	}
+	key.Hash = hash
+	return &key, nil
+}
+
+func (redisClient *RedisClient) WriteAdminKey(key *AdminKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return redisClient.client.HSet(redisClient.formatKey("admin", "keys"), key.Hash, string(data)).Err()
+}
+
+func (redisClient *RedisClient) RemoveAdminKey(hash string) (bool, error) {
+	n, err := redisClient.client.HDel(redisClient.formatKey("admin", "keys"), hash).Result()
+	return n > 0, err
+}
+
+func (redisClient *RedisClient) WriteAdminAudit(entry *AdminAudit) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.LPush(redisClient.formatKey("admin", "audit"), string(data))
+		tx.LTrim(redisClient.formatKey("admin", "audit"), 0, maxAuditEntries-1)
+		return nil
+	})
+	return err
+}
+
+// Newest entries first
+func (redisClient *RedisClient) GetAdminAudit(offset, limit int64) ([]*AdminAudit, error) {
+	raw, err := redisClient.client.LRange(redisClient.formatKey("admin", "audit"), offset, offset+limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*AdminAudit, 0, len(raw))
+	for _, v := range raw {
+		var entry AdminAudit
+		if json.Unmarshal([]byte(v), &entry) == nil {
+			result = append(result, &entry)
+		}
+	}
+	return result, nil
+}
+
+func (redisClient *RedisClient) WriteModuleStatus(status *ModuleStatus) error {
+	status.UpdatedAt = util.MakeTimestamp() / 1000
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return redisClient.client.HSet(redisClient.formatKey("modules"), status.Name, string(data)).Err()
+}
+
+func (redisClient *RedisClient) RequestResume(module string) error {
+	return redisClient.client.Set(redisClient.formatKey("modules", "resume", module), "1", 0).Err()
+}
+
+// Returns true once per request
+func (redisClient *RedisClient) TakeResumeRequest(module string) (bool, error) {
+	n, err := redisClient.client.Del(redisClient.formatKey("modules", "resume", module)).Result()
+	return n > 0, err
+}
+
+func (redisClient *RedisClient) GetModuleStatuses() ([]*ModuleStatus, error) {
+	raw, err := redisClient.client.HGetAllMap(redisClient.formatKey("modules")).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	result := make([]*ModuleStatus, 0, len(raw))
+	for _, v := range raw {
+		var status ModuleStatus
+		if json.Unmarshal([]byte(v), &status) == nil {
+			result = append(result, &status)
+		}
+	}
+	return result, nil
+}
+
+// Bans of all proxies are collected in "bans" hash, ip => JSON
+func (redisClient *RedisClient) WriteBan(ip, reason string, timeout int64) error {
+	now := util.MakeTimestamp() / 1000
+	data, err := json.Marshal(Ban{Ip: ip, Reason: reason, BannedAt: now, ExpiresAt: now + timeout})
+	if err != nil {
+		return err
+	}
+	return redisClient.client.HSet(redisClient.formatKey("bans"), ip, string(data)).Err()
+}
+
+// Returns active bans, expired ones are removed
+func (redisClient *RedisClient) GetBans() ([]*Ban, error) {
+	raw, err := redisClient.client.HGetAllMap(redisClient.formatKey("bans")).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	now := util.MakeTimestamp() / 1000
+	result := make([]*Ban, 0, len(raw))
+	for ip, v := range raw {
+		var ban Ban
+		if json.Unmarshal([]byte(v), &ban) != nil || ban.ExpiresAt <= now {
+			redisClient.client.HDel(redisClient.formatKey("bans"), ip)
+			continue
+		}
+		result = append(result, &ban)
+	}
+	return result, nil
+}
+
+// Pool totals in Shannon as maintained by unlocker and payouts
+func (redisClient *RedisClient) GetFinances() (map[string]interface{}, error) {
+	raw, err := redisClient.client.HGetAllMap(redisClient.formatKey("finances")).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			result[k] = n
+		} else {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
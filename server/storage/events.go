@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"gopkg.in/redis.v3"
+
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+const (
+	EventBlockCandidate   = "block.candidate"
+	EventBlockImmature    = "block.immature"
+	EventBlockMatured     = "block.matured"
+	EventBlockOrphaned    = "block.orphaned"
+	EventPaymentSent      = "payment.sent"
+	EventPaymentConfirmed = "payment.confirmed"
+	EventUnlockerHalted   = "unlocker.halted"
+	EventPayoutsHalted    = "payouts.halted"
+	EventUpstreamSwitched = "upstream.switched"
+)
+
+// Max length of outbox and dead letter lists, oldest entries are trimmed
+const maxEvents = 10000
+
+type Event struct {
+	Id        int64                  `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp int64                  `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+/* Event is appended to "events:outbox" for dispatcher and published to "events" channel.
+ * Outbox survives restarts of every module, so events are not lost if dispatcher is down.
+ */
+func (redisClient *RedisClient) WriteEvent(kind string, data map[string]interface{}) (*Event, error) {
+	id, err := redisClient.client.Incr(redisClient.formatKey("events", "seq")).Result()
+	if err != nil {
+		return nil, err
+	}
+	event := &Event{Id: id, Type: kind, Timestamp: util.MakeTimestamp() / 1000, Data: data}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.LPush(redisClient.formatKey("events", "outbox"), string(payload))
+		tx.LTrim(redisClient.formatKey("events", "outbox"), 0, maxEvents-1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Live subscribers only, nothing is kept if nobody listens
+	err = redisClient.client.Publish(redisClient.formatKey("events"), string(payload)).Err()
+	return event, err
+}
+
+/* Moves the oldest outbox event to "events:processing", it stays there until AckEvent.
+ * Returns empty raw value if outbox is empty.
+ */
+func (redisClient *RedisClient) PopEvent() (string, *Event, error) {
+	raw, err := redisClient.client.RPopLPush(redisClient.formatKey("events", "outbox"), redisClient.formatKey("events", "processing")).Result()
+	if err == redis.Nil {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(raw), &event); err != nil {
+		return raw, nil, err
+	}
+	return raw, &event, nil
+}
+
+func (redisClient *RedisClient) AckEvent(raw string) error {
+	return redisClient.client.LRem(redisClient.formatKey("events", "processing"), 1, raw).Err()
+}
+
+// Returns events left in processing by a crashed dispatcher back to outbox
+func (redisClient *RedisClient) RecoverEvents() (int64, error) {
+	var n int64
+	for {
+		_, err := redisClient.client.RPopLPush(redisClient.formatKey("events", "processing"), redisClient.formatKey("events", "outbox")).Result()
+		if err == redis.Nil {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Delivery is opaque for storage, it's kept in "events:retry" sorted by next attempt timestamp
+func (redisClient *RedisClient) ScheduleEventRetry(delivery string, at int64) error {
+	return redisClient.client.ZAdd(redisClient.formatKey("events", "retry"), redis.Z{Score: float64(at), Member: delivery}).Err()
+}
+
+// Claims deliveries due at now, a delivery is returned to a single caller only
+func (redisClient *RedisClient) PopEventRetries(now int64, limit int64) ([]string, error) {
+	key := redisClient.formatKey("events", "retry")
+	due, err := redisClient.client.ZRangeByScore(key, redis.ZRangeByScore{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(due))
+	for _, delivery := range due {
+		n, err := redisClient.client.ZRem(key, delivery).Result()
+		if err != nil {
+			return result, err
+		}
+		if n > 0 {
+			result = append(result, delivery)
+		}
+	}
+	return result, nil
+}
+
+func (redisClient *RedisClient) WriteDeadEvent(delivery string) error {
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.LPush(redisClient.formatKey("events", "dead"), delivery)
+		tx.LTrim(redisClient.formatKey("events", "dead"), 0, maxEvents-1)
+		return nil
+	})
+	return err
+}
+
+func (redisClient *RedisClient) GetDeadEvents(limit int64) ([]string, error) {
+	return redisClient.client.LRange(redisClient.formatKey("events", "dead"), 0, limit-1).Result()
+}
+
+// Calls handler for every event published by WriteEvent, blocks until subscription fails
+func (redisClient *RedisClient) SubscribeEvents(handler func(*Event)) error {
+	pubsub, err := redisClient.client.Subscribe(redisClient.formatKey("events"))
+	if err != nil {
+		return err
+	}
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		var event Event
+		if json.Unmarshal([]byte(msg.Payload), &event) == nil {
+			handler(&event)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+// One downsampling level of a time series, e.g. 10m points kept for 24h
+type SeriesTier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+func (t SeriesTier) resolution() int64 {
+	return int64(t.Resolution / time.Second)
+}
+
+func (t SeriesTier) retention() int64 {
+	return int64(t.Retention / time.Second)
+}
+
+var poolSeriesFields = []string{"hashrate", "miners", "difficulty"}
+var minerSeriesFields = []string{"hashrate", "workersOnline"}
+var workerSeriesFields = []string{"hashrate"}
+
+// Values of one series written by writeSeries, key is without tier resolution suffix
+type seriesPoint struct {
+	key    []interface{}
+	values []int64
+}
+
+// Tiers must be sorted by resolution, finest first
+func (redisClient *RedisClient) WritePoolHistory(tiers []SeriesTier, ts, hashrate, miners, difficulty int64) error {
+	return redisClient.writeSeries(tiers, ts, seriesPoint{[]interface{}{"history", "pool"}, []int64{hashrate, miners, difficulty}})
+}
+
+// Miner and all of its workers series are written in one transaction
+func (redisClient *RedisClient) WriteMinerHistory(tiers []SeriesTier, ts int64, login string, workers map[string]int64) error {
+	hashrate := int64(0)
+	points := []seriesPoint{{}}
+	for id, hr := range workers {
+		hashrate += hr
+		points = append(points, seriesPoint{[]interface{}{"history", login, id}, []int64{hr}})
+	}
+	points[0] = seriesPoint{[]interface{}{"history", login}, []int64{hashrate, int64(len(workers))}}
+
+	workersKey := redisClient.formatKey("history", login, "workers")
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		for id := range workers {
+			tx.SAdd(workersKey, id)
+		}
+		tx.Expire(workersKey, tiers[len(tiers)-1].Retention)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return redisClient.writeSeries(tiers, ts, points...)
+}
+
+/* Finest tier receives raw point for its slot, every coarser slot is an average of
+ * finest points which fall into it, so it's refreshed on every write until slot is over.
+ * Score is slot start.
+ */
+func (redisClient *RedisClient) writeSeries(tiers []SeriesTier, ts int64, points ...seriesPoint) error {
+	finest := tiers[0]
+	slot := ts - ts%finest.resolution()
+	coarser := tiers[1:]
+
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, point := range points {
+			finestKey := redisClient.formatKey(append(point.key, finest.resolution())...)
+			redisClient.writeSeriesPoint(tx, finestKey, finest, ts, slot, point.values)
+			for _, tier := range coarser {
+				from := ts - ts%tier.resolution()
+				option := redis.ZRangeByScore{Min: strconv.FormatInt(from, 10), Max: "+inf"}
+				tx.ZRangeByScoreWithScores(finestKey, option)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(coarser) == 0 {
+		return err
+	}
+
+	// Every point is written by seriesPointCmds commands followed by a range read per coarser tier
+	stride := seriesPointCmds + len(coarser)
+	_, err = tx.Exec(func() error {
+		for n, point := range points {
+			raw := cmds[n*stride+seriesPointCmds : (n+1)*stride]
+			for i, tier := range coarser {
+				rows := convertSeries(raw[i].(*redis.ZSliceCmd), len(point.values))
+				if len(rows) == 0 {
+					continue
+				}
+				avg := make([]int64, len(point.values))
+				for _, row := range rows {
+					for j := range avg {
+						avg[j] += row[j+1]
+					}
+				}
+				for j := range avg {
+					avg[j] /= int64(len(rows))
+				}
+				tierKey := redisClient.formatKey(append(point.key, tier.resolution())...)
+				redisClient.writeSeriesPoint(tx, tierKey, tier, ts, ts-ts%tier.resolution(), avg)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Number of commands queued by writeSeriesPoint
+const seriesPointCmds = 4
+
+func (redisClient *RedisClient) writeSeriesPoint(tx *redis.Multi, key string, tier SeriesTier, now, slot int64, values []int64) {
+	tx.ZRemRangeByScore(key, strconv.FormatInt(slot, 10), strconv.FormatInt(slot, 10))
+	tx.ZAdd(key, redis.Z{Score: float64(slot), Member: seriesMember(slot, values)})
+	tx.ZRemRangeByScore(key, "-inf", fmt.Sprint("(", now-tier.retention()))
+	tx.Expire(key, tier.Retention)
+}
+
+func (redisClient *RedisClient) GetPoolHistory(tier SeriesTier) ([]map[string]int64, error) {
+	cmd := redisClient.client.ZRangeWithScores(redisClient.formatKey("history", "pool", tier.resolution()), 0, -1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertSeriesResults(cmd, poolSeriesFields), nil
+}
+
+func (redisClient *RedisClient) GetMinerHistory(tier SeriesTier, login string) (map[string]interface{}, error) {
+	stats := make(map[string]interface{})
+
+	workers, err := redisClient.client.SMembers(redisClient.formatKey("history", login, "workers")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.ZRangeWithScores(redisClient.formatKey("history", login, tier.resolution()), 0, -1)
+		for _, id := range workers {
+			tx.ZRangeWithScores(redisClient.formatKey("history", login, id, tier.resolution()), 0, -1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats["hashrate"] = convertSeriesResults(cmds[0].(*redis.ZSliceCmd), minerSeriesFields)
+	workersHistory := make(map[string][]map[string]int64)
+	for i, id := range workers {
+		points := convertSeriesResults(cmds[i+1].(*redis.ZSliceCmd), workerSeriesFields)
+		if len(points) > 0 {
+			workersHistory[id] = points
+		}
+	}
+	stats["workers"] = workersHistory
+	return stats, nil
+}
+
+// Average hashrate of each worker of given login over window, from share buckets
+func (redisClient *RedisClient) GetWorkersHashrate(login string, window time.Duration) (map[string]int64, error) {
+	now := util.MakeTimestamp() / 1000
+	seconds := int64(window / time.Second)
+	buckets := bucketRange(now, seconds)
+
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, ts := range buckets {
+			tx.HGetAllMap(redisClient.formatKey("buckets", login, ts))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	result := make(map[string]int64)
+	for _, bucket := range convertBuckets(buckets, cmds) {
+		for id, share := range bucket.shares {
+			result[id] += share
+		}
+	}
+	span := windowSpan(now, seconds)
+	for id, shares := range result {
+		result[id] = shares / span
+	}
+	return result, nil
+}
+
+// Parse members into rows of ts followed by n values
+func convertSeries(raw *redis.ZSliceCmd, n int) [][]int64 {
+	var result [][]int64
+	for _, v := range raw.Val() {
+		row, err := decodeSeries(v.Member.(string))
+		if err != nil || len(row) != n+1 {
+			continue
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+func convertSeriesResults(raw *redis.ZSliceCmd, names []string) []map[string]int64 {
+	var result []map[string]int64
+	for _, row := range convertSeries(raw, len(names)) {
+		point := map[string]int64{"timestamp": row[0]}
+		for i, name := range names {
+			point[name] = row[i+1]
+		}
+		result = append(result, point)
+	}
+	return result
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+var ErrLeaseLost = errors.New("lease is held by another instance")
+
+/* Lease of singleton module. Taking lease over increments fencing token of module,
+ * writes of lease holder are rejected once token is incremented by another instance.
+ */
+type Lease struct {
+	Module string
+	Owner  string
+
+	sync.RWMutex
+	token   int64
+	expires time.Time
+}
+
+func NewLease(module, owner string) *Lease {
+	return &Lease{Module: module, Owner: owner}
+}
+
+// Returns fencing token or 0 if lease is not held or may be expired
+func (l *Lease) Token() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	if time.Now().After(l.expires) {
+		return 0
+	}
+	return l.token
+}
+
+func (l *Lease) set(token int64, expires time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	l.token = token
+	l.expires = expires
+}
+
+// Takes or renews lease, returns false if lease is held by another instance
+func (redisClient *RedisClient) AcquireLease(lease *Lease, ttl time.Duration) (bool, error) {
+	key := redisClient.formatKey("lease", lease.Module)
+	tx, err := redisClient.client.Watch(key)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+
+	expires := time.Now().Add(ttl)
+	holder, err := tx.Get(key).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if err == nil && holder != lease.Owner {
+		lease.set(0, time.Time{})
+		return false, nil
+	}
+
+	token := lease.Token()
+	if err == nil && token > 0 {
+		_, err = tx.Exec(func() error {
+			tx.PExpire(key, ttl)
+			return nil
+		})
+	} else {
+		var cmds []redis.Cmder
+		cmds, err = tx.Exec(func() error {
+			tx.Set(key, lease.Owner, ttl)
+			tx.Incr(redisClient.formatKey("lease", lease.Module, "token"))
+			return nil
+		})
+		if err == nil {
+			token = cmds[1].(*redis.IntCmd).Val()
+		}
+	}
+	if err == redis.TxFailedErr {
+		lease.set(0, time.Time{})
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	lease.set(token, expires)
+	return true, nil
+}
+
+func (redisClient *RedisClient) ReleaseLease(lease *Lease) error {
+	key := redisClient.formatKey("lease", lease.Module)
+	tx, err := redisClient.client.Watch(key)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	lease.set(0, time.Time{})
+	holder, err := tx.Get(key).Result()
+	if err == redis.Nil || holder != lease.Owner {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = tx.Exec(func() error {
+		tx.Del(key)
+		return nil
+	})
+	if err == redis.TxFailedErr {
+		return nil
+	}
+	return err
+}
+
+// Returns owner of module lease or empty string if lease is not held
+func (redisClient *RedisClient) GetLeaseHolder(module string) (string, error) {
+	holder, err := redisClient.client.Get(redisClient.formatKey("lease", module)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return holder, err
+}
+
+// Returns client sharing connections whose balance and block writes are fenced by lease
+func (redisClient *RedisClient) WithLease(lease *Lease) *RedisClient {
+	return &RedisClient{client: redisClient.client, prefix: redisClient.prefix, lease: lease}
+}
+
+/* Starts transaction watching given keys. Fenced transaction also watches fencing token,
+ * so it fails if lease is taken over before it is executed.
+ */
+func (redisClient *RedisClient) multi(keys ...string) (*redis.Multi, error) {
+	if redisClient.lease == nil {
+		if len(keys) == 0 {
+			return redisClient.client.Multi(), nil
+		}
+		return redisClient.client.Watch(keys...)
+	}
+	tokenKey := redisClient.formatKey("lease", redisClient.lease.Module, "token")
+	tx, err := redisClient.client.Watch(append(keys, tokenKey)...)
+	if err != nil {
+		return nil, err
+	}
+	token := redisClient.lease.Token()
+	current, err := tx.Get(tokenKey).Int64()
+	if err != nil && err != redis.Nil {
+		tx.Close()
+		return nil, err
+	}
+	if token == 0 || token != current {
+		tx.Close()
+		return nil, ErrLeaseLost
+	}
+	return tx, nil
+}
+
+// Fenced transaction may be aborted because lease was taken over
+func (redisClient *RedisClient) txError(err error) error {
+	if err != redis.TxFailedErr || redisClient.lease == nil {
+		return err
+	}
+	current, _ := redisClient.client.Get(redisClient.formatKey("lease", redisClient.lease.Module, "token")).Int64()
+	if current != redisClient.lease.Token() {
+		return ErrLeaseLost
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+/* Rewrite legacy members of block, payment and history zsets into versioned records.
+ * Returns number of legacy members per key, nothing is written in dry run mode.
+ * Unlocker and payouts must be stopped, they keep raw members of blocks and payments they work on.
+ */
+func (redisClient *RedisClient) MigrateRecords(dryRun bool) (map[string]int64, error) {
+	result := make(map[string]int64)
+	migrate := func(key string, convert func(redis.Z) (string, error)) error {
+		n, err := redisClient.migrateKey(key, convert, dryRun)
+		if n > 0 {
+			result[key] = n
+		}
+		return err
+	}
+
+	err := migrate(redisClient.formatKey("blocks", "candidates"), func(v redis.Z) (string, error) {
+		block := BlockData{}
+		err := decodeCandidate(v.Member.(string), &block)
+		return block.candidateMember(), err
+	})
+	if err != nil {
+		return result, err
+	}
+	for _, status := range []string{"immature", "matured"} {
+		err = migrate(redisClient.formatKey("blocks", status), func(v redis.Z) (string, error) {
+			block := BlockData{}
+			err := decodeBlock(v.Member.(string), &block)
+			return block.key(), err
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	paymentsPrefix := redisClient.formatKey("payments", "")
+	keys, err := redisClient.scanKeys(redisClient.formatKey("payments", "*"))
+	if err != nil {
+		return result, err
+	}
+	for _, key := range keys {
+		// Payouts lock and anything else stored under payments prefix is not a payments zset
+		if kind, _ := redisClient.client.Type(key).Result(); kind != "zset" {
+			continue
+		}
+		pending := strings.TrimPrefix(key, paymentsPrefix) == "pending"
+		err = migrate(key, func(v redis.Z) (string, error) {
+			r, err := decodePayment(v.Member.(string), pending)
+			if err != nil {
+				return "", err
+			}
+			return paymentMember(r.Tx, r.Address, r.Amount), nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	keys, err = redisClient.scanKeys(redisClient.formatKey("history", "*"))
+	if err != nil {
+		return result, err
+	}
+	for _, key := range keys {
+		if kind, _ := redisClient.client.Type(key).Result(); kind != "zset" {
+			continue
+		}
+		err = migrate(key, func(v redis.Z) (string, error) {
+			row, err := decodeSeries(v.Member.(string))
+			if err != nil {
+				return "", err
+			}
+			return seriesMember(row[0], row[1:]), nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Replace legacy members of a zset keeping their scores, aborts if key is changed concurrently
+func (redisClient *RedisClient) migrateKey(key string, convert func(redis.Z) (string, error), dryRun bool) (int64, error) {
+	tx, err := redisClient.client.Watch(key)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	rows, err := tx.ZRangeWithScores(key, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	var legacy []redis.Z
+	var members []redis.Z
+	for _, v := range rows {
+		if isRecord(v.Member.(string)) {
+			continue
+		}
+		member, err := convert(v)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to convert %v of %v: %v", v.Member, key, err)
+		}
+		legacy = append(legacy, v)
+		members = append(members, redis.Z{Score: v.Score, Member: member})
+	}
+	if dryRun || len(legacy) == 0 {
+		return int64(len(legacy)), nil
+	}
+
+	_, err = tx.Exec(func() error {
+		for _, v := range legacy {
+			tx.ZRem(key, v.Member.(string))
+		}
+		tx.ZAdd(key, members...)
+		return nil
+	})
+	return int64(len(legacy)), err
+}
+
+func (redisClient *RedisClient) scanKeys(pattern string) ([]string, error) {
+	var result []string
+	var c int64
+	for {
+		var keys []string
+		var err error
+		c, keys, err = redisClient.client.Scan(c, pattern, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, keys...)
+		if c == 0 {
+			break
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Upper bound of rows examined by a single filtered query
+const maxQueryScan = 1000
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidStatus = errors.New("invalid block status")
+)
+
+var blockStatuses = []string{"candidates", "immature", "matured"}
+
+type BlocksQuery struct {
+	Status     string
+	Login      string
+	FromHeight int64
+	ToHeight   int64
+	From       int64
+	To         int64
+	Cursor     string
+	Limit      int64
+}
+
+type PaymentsQuery struct {
+	Login  string
+	From   int64
+	To     int64
+	Cursor string
+	Limit  int64
+}
+
+/* Cursor points to a position in a zset walked from highest score down:
+ * "score:skip" means continue from score, skipping rows with this exact score already returned.
+ */
+type cursor struct {
+	score int64
+	skip  int64
+}
+
+func parseCursor(s string, max int64) (*cursor, error) {
+	if len(s) == 0 {
+		return &cursor{score: max}, nil
+	}
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	score, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	skip, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || skip < 0 {
+		return nil, ErrInvalidCursor
+	}
+	if score > max {
+		score, skip = max, 0
+	}
+	return &cursor{score: score, skip: skip}, nil
+}
+
+func (c *cursor) String() string {
+	return join(c.score, c.skip)
+}
+
+func (c *cursor) advance(score int64) {
+	if score == c.score {
+		c.skip++
+	} else {
+		c.score, c.skip = score, 1
+	}
+}
+
+/* Walk zset from cursor down to min score, collecting up to limit rows accepted by match.
+ * Returns next cursor, empty if zset is exhausted.
+ */
+func (redisClient *RedisClient) scanDesc(key string, min, max int64, after string, limit int64, match func(redis.Z) bool) ([]redis.Z, string, error) {
+	c, err := parseCursor(after, max)
+	if err != nil {
+		return nil, "", err
+	}
+	var result []redis.Z
+	scanned := int64(0)
+
+	for {
+		option := redis.ZRangeByScore{
+			Min:    strconv.FormatInt(min, 10),
+			Max:    strconv.FormatInt(c.score, 10),
+			Offset: c.skip,
+			Count:  limit,
+		}
+		rows, err := redisClient.client.ZRevRangeByScoreWithScores(key, option).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, row := range rows {
+			c.advance(int64(row.Score))
+			scanned++
+			if match == nil || match(row) {
+				result = append(result, row)
+			}
+			if int64(len(result)) >= limit || scanned >= maxQueryScan {
+				return result, c.String(), nil
+			}
+		}
+		if int64(len(rows)) < limit {
+			return result, "", nil
+		}
+	}
+}
+
+func (redisClient *RedisClient) QueryBlocks(q *BlocksQuery) ([]*BlockData, string, error) {
+	if !isBlockStatus(q.Status) {
+		return nil, "", ErrInvalidStatus
+	}
+	min, max := q.FromHeight, q.ToHeight
+	if max <= 0 {
+		max = int64(^uint64(0) >> 1)
+	}
+	convert := convertBlock
+	if q.Status == "candidates" {
+		convert = convertCandidate
+	}
+	var blocks []*BlockData
+	match := func(row redis.Z) bool {
+		block := convert(row)
+		if block == nil {
+			return false
+		}
+		if (q.From > 0 && block.Timestamp < q.From) || (q.To > 0 && block.Timestamp > q.To) {
+			return false
+		}
+		if len(q.Login) > 0 && block.Finder != q.Login {
+			return false
+		}
+		blocks = append(blocks, block)
+		return true
+	}
+	_, next, err := redisClient.scanDesc(redisClient.formatKey("blocks", q.Status), min, max, q.Cursor, q.Limit, match)
+	return blocks, next, err
+}
+
+func (redisClient *RedisClient) QueryPayments(q *PaymentsQuery) ([]map[string]interface{}, string, error) {
+	key := redisClient.formatKey("payments", "all")
+	if len(q.Login) > 0 {
+		key = redisClient.formatKey("payments", q.Login)
+	}
+	max := q.To
+	if max <= 0 {
+		max = int64(^uint64(0) >> 1)
+	}
+	rows, next, err := redisClient.scanDesc(key, q.From, max, q.Cursor, q.Limit, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var payments []map[string]interface{}
+	for _, row := range rows {
+		if tx := convertPayment(row); tx != nil {
+			payments = append(payments, tx)
+		}
+	}
+	return payments, next, nil
+}
+
+// Find block by height and hash, candidates are matched by nonce or PoW hash since they have no block hash yet
+func (redisClient *RedisClient) GetBlock(height int64, hash string) (*BlockData, string, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(height, 10), Max: strconv.FormatInt(height, 10)}
+
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, status := range blockStatuses {
+			tx.ZRangeByScoreWithScores(redisClient.formatKey("blocks", status), option)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	for i, status := range blockStatuses {
+		for _, row := range cmds[i].(*redis.ZSliceCmd).Val() {
+			var block *BlockData
+			if status == "candidates" {
+				block = convertCandidate(row)
+			} else {
+				block = convertBlock(row)
+			}
+			if block == nil {
+				continue
+			}
+			if strings.EqualFold(block.Hash, hash) || strings.EqualFold(block.Nonce, hash) || strings.EqualFold(block.PowHash, hash) {
+				return block, status, nil
+			}
+		}
+	}
+	return nil, "", nil
+}
+
+// Round shares and credited rewards of a block, whichever still exist in a backend
+func (redisClient *RedisClient) GetBlockRewards(block *BlockData) (map[string]int64, map[string]int64, error) {
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.HGetAllMap(redisClient.formatRound(block.RoundHeight, block.Nonce))
+		tx.HGetAllMap(redisClient.formatKey("credits", "immature", block.Height, block.Hash))
+		tx.HGetAllMap(redisClient.formatKey("credits", block.Height, block.Hash))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	convert := func(cmd redis.Cmder) map[string]int64 {
+		result := make(map[string]int64)
+		raw, _ := cmd.(*redis.StringStringMapCmd).Result()
+		for login, v := range raw {
+			result[login], _ = strconv.ParseInt(v, 10, 64)
+		}
+		return result
+	}
+	shares := convert(cmds[0])
+	credits := convert(cmds[2])
+	if len(credits) == 0 {
+		credits = convert(cmds[1])
+	}
+	return shares, credits, nil
+}
+
+func isBlockStatus(s string) bool {
+	for _, status := range blockStatuses {
+		if status == s {
+			return true
+		}
+	}
+	return false
+}
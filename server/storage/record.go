@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* Zset members are stored as tagged JSON records, "v" is a layout version.
+ * Members written before versioning are colon-joined strings, readers accept both.
+ */
+const recordVersion = 1
+
+type record interface {
+	version() int
+}
+
+type candidateRecord struct {
+	V          int    `json:"v"`
+	Nonce      string `json:"nonce"`
+	PowHash    string `json:"powHash"`
+	MixDigest  string `json:"mixDigest"`
+	Timestamp  int64  `json:"timestamp"`
+	Difficulty int64  `json:"difficulty"`
+	Shares     int64  `json:"shares"`
+	Finder     string `json:"finder,omitempty"`
+	Worker     string `json:"worker,omitempty"`
+	RoundStart int64  `json:"roundStart,omitempty"`
+}
+
+type blockRecord struct {
+	V           int    `json:"v"`
+	UncleHeight int64  `json:"uncleHeight,omitempty"`
+	Orphan      bool   `json:"orphan,omitempty"`
+	Nonce       string `json:"nonce"`
+	Hash        string `json:"hash"`
+	Timestamp   int64  `json:"timestamp"`
+	Difficulty  int64  `json:"difficulty"`
+	Shares      int64  `json:"shares"`
+	Reward      string `json:"reward"`
+	Finder      string `json:"finder,omitempty"`
+	Worker      string `json:"worker,omitempty"`
+	RoundStart  int64  `json:"roundStart,omitempty"`
+}
+
+type paymentRecord struct {
+	V       int    `json:"v"`
+	Tx      string `json:"tx,omitempty"`
+	Address string `json:"address,omitempty"`
+	Amount  int64  `json:"amount"`
+}
+
+type seriesRecord struct {
+	V         int     `json:"v"`
+	Timestamp int64   `json:"timestamp"`
+	Values    []int64 `json:"values"`
+}
+
+func (r *candidateRecord) version() int { return r.V }
+func (r *blockRecord) version() int     { return r.V }
+func (r *paymentRecord) version() int   { return r.V }
+func (r *seriesRecord) version() int    { return r.V }
+
+func isRecord(member string) bool {
+	return strings.HasPrefix(member, "{")
+}
+
+// Records are plain structs, so encoding is deterministic and members can be matched by value
+func encodeRecord(r record) string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+func decodeRecord(member string, r record) error {
+	err := json.Unmarshal([]byte(member), r)
+	if err != nil {
+		return err
+	}
+	if r.version() < 1 || r.version() > recordVersion {
+		return fmt.Errorf("Unsupported record version %v", r.version())
+	}
+	return nil
+}
+
+func (b *BlockData) candidateMember() string {
+	return encodeRecord(&candidateRecord{
+		V:          recordVersion,
+		Nonce:      b.Nonce,
+		PowHash:    b.PowHash,
+		MixDigest:  b.MixDigest,
+		Timestamp:  b.Timestamp,
+		Difficulty: b.Difficulty,
+		Shares:     b.TotalShares,
+		Finder:     b.Finder,
+		Worker:     b.Worker,
+		RoundStart: b.RoundStart,
+	})
+}
+
+func (b *BlockData) key() string {
+	reward := b.RewardString
+	if b.Reward != nil || len(reward) == 0 {
+		reward = join(b.Reward)
+	}
+	return encodeRecord(&blockRecord{
+		V:           recordVersion,
+		UncleHeight: b.UncleHeight,
+		Orphan:      b.Orphan,
+		Nonce:       b.Nonce,
+		Hash:        b.serializeHash(),
+		Timestamp:   b.Timestamp,
+		Difficulty:  b.Difficulty,
+		Shares:      b.TotalShares,
+		Reward:      reward,
+		Finder:      b.Finder,
+		Worker:      b.Worker,
+		RoundStart:  b.RoundStart,
+	})
+}
+
+func decodeCandidate(member string, block *BlockData) error {
+	if !isRecord(member) {
+		// "nonce:powHash:mixDigest:timestamp:diff:totalShares[:login:worker:roundStart]"
+		fields := strings.Split(member, ":")
+		if len(fields) < 6 {
+			return fmt.Errorf("Malformed candidate %v", member)
+		}
+		block.Nonce = fields[0]
+		block.PowHash = fields[1]
+		block.MixDigest = fields[2]
+		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
+		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
+		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
+		if len(fields) > 8 {
+			block.Finder = fields[6]
+			block.Worker = fields[7]
+			block.RoundStart, _ = strconv.ParseInt(fields[8], 10, 64)
+		}
+		return nil
+	}
+	r := candidateRecord{}
+	if err := decodeRecord(member, &r); err != nil {
+		return err
+	}
+	block.Nonce = r.Nonce
+	block.PowHash = r.PowHash
+	block.MixDigest = r.MixDigest
+	block.Timestamp = r.Timestamp
+	block.Difficulty = r.Difficulty
+	block.TotalShares = r.Shares
+	block.Finder = r.Finder
+	block.Worker = r.Worker
+	block.RoundStart = r.RoundStart
+	return nil
+}
+
+func decodeBlock(member string, block *BlockData) error {
+	if !isRecord(member) {
+		// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei[:login:worker:roundStart]"
+		fields := strings.Split(member, ":")
+		if len(fields) < 8 {
+			return fmt.Errorf("Malformed block %v", member)
+		}
+		block.UncleHeight, _ = strconv.ParseInt(fields[0], 10, 64)
+		block.Orphan, _ = strconv.ParseBool(fields[1])
+		block.Nonce = fields[2]
+		block.Hash = fields[3]
+		block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
+		block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
+		block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
+		block.RewardString = fields[7]
+		if len(fields) > 10 {
+			block.Finder = fields[8]
+			block.Worker = fields[9]
+			block.RoundStart, _ = strconv.ParseInt(fields[10], 10, 64)
+		}
+		return nil
+	}
+	r := blockRecord{}
+	if err := decodeRecord(member, &r); err != nil {
+		return err
+	}
+	block.UncleHeight = r.UncleHeight
+	block.Orphan = r.Orphan
+	block.Nonce = r.Nonce
+	block.Hash = r.Hash
+	block.Timestamp = r.Timestamp
+	block.Difficulty = r.Difficulty
+	block.TotalShares = r.Shares
+	block.RewardString = r.Reward
+	block.Finder = r.Finder
+	block.Worker = r.Worker
+	block.RoundStart = r.RoundStart
+	return nil
+}
+
+func paymentMember(txHash, login string, amount int64) string {
+	return encodeRecord(&paymentRecord{V: recordVersion, Tx: txHash, Address: login, Amount: amount})
+}
+
+/* Legacy layouts are "tx:address:amount" for all payments,
+ * "tx:amount" for miner's payments and "address:amount" for pending ones.
+ */
+func decodePayment(member string, pending bool) (*paymentRecord, error) {
+	r := &paymentRecord{}
+	if isRecord(member) {
+		err := decodeRecord(member, r)
+		return r, err
+	}
+	fields := strings.Split(member, ":")
+	switch {
+	case len(fields) == 3:
+		r.Tx = fields[0]
+		r.Address = fields[1]
+		r.Amount, _ = strconv.ParseInt(fields[2], 10, 64)
+	case len(fields) == 2 && pending:
+		r.Address = fields[0]
+		r.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+	case len(fields) == 2:
+		r.Tx = fields[0]
+		r.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+	default:
+		return nil, fmt.Errorf("Malformed payment %v", member)
+	}
+	return r, nil
+}
+
+func seriesMember(ts int64, values []int64) string {
+	return encodeRecord(&seriesRecord{V: recordVersion, Timestamp: ts, Values: values})
+}
+
+// Legacy layout is "ts:value1:value2:..."
+func decodeSeries(member string) ([]int64, error) {
+	if isRecord(member) {
+		r := seriesRecord{}
+		if err := decodeRecord(member, &r); err != nil {
+			return nil, err
+		}
+		return append([]int64{r.Timestamp}, r.Values...), nil
+	}
+	fields := strings.Split(member, ":")
+	row := make([]int64, len(fields))
+	for i, field := range fields {
+		row[i], _ = strconv.ParseInt(field, 10, 64)
+	}
+	return row, nil
+}
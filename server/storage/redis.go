@@ -12,6 +12,9 @@ import (
 	"bitbucket.org/vdidenko/dwarf/server/util"
 )
 
+// Size of a share bucket in seconds
+const bucketSize = 60
+
 type Config struct {
 	Endpoint string `json:"endpoint"`
 	Password string `json:"password"`
@@ -22,6 +25,8 @@ type Config struct {
 type RedisClient struct {
 	client *redis.Client
 	prefix string
+	// Set for clients of unlocker and payouts, see WithLease
+	lease *Lease
 }
 
 type BlockData struct {
@@ -41,6 +46,11 @@ type BlockData struct {
 	ImmatureReward string   `json:"-"`
 	RewardString   string   `json:"reward"`
 	RoundHeight    int64    `json:"-"`
+	Finder         string   `json:"finder,omitempty"`
+	Worker         string   `json:"worker,omitempty"`
+	RoundStart     int64    `json:"roundStart,omitempty"`
+	RoundDuration  int64    `json:"roundDuration,omitempty"`
+	Effort         float64  `json:"effort,omitempty"`
 	candidateKey   string
 	immatureKey    string
 }
@@ -62,8 +72,14 @@ func (b *BlockData) RoundKey() string {
 	return join(b.RoundHeight, b.Hash)
 }
 
-func (b *BlockData) key() string {
-	return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
+// Fill fields derived from round start and shares
+func (b *BlockData) setRoundStats() {
+	if b.RoundStart > 0 && b.Timestamp >= b.RoundStart {
+		b.RoundDuration = b.Timestamp - b.RoundStart
+	}
+	if b.Difficulty > 0 {
+		b.Effort = float64(b.TotalShares) / float64(b.Difficulty)
+	}
 }
 
 type Miner struct {
@@ -76,6 +92,47 @@ type Miner struct {
 type Worker struct {
 	Miner
 	TotalHR int64 `json:"hr2"`
+	// Share outcomes in small and large windows
+	Shares      ShareStats `json:"shares"`
+	TotalShares ShareStats `json:"shares2"`
+	// Last hashrate reported by mining software within small window
+	ReportedHR int64  `json:"reportedHashrate"`
+	ClientId   string `json:"clientId,omitempty"`
+}
+
+// Outcomes of submitted shares
+const (
+	ShareValid     = "valid"
+	ShareStale     = "stale"
+	ShareDuplicate = "duplicate"
+	ShareInvalid   = "invalid"
+)
+
+type ShareStats struct {
+	Valid     int64 `json:"valid"`
+	Stale     int64 `json:"stale"`
+	Duplicate int64 `json:"duplicate"`
+	Invalid   int64 `json:"invalid"`
+}
+
+func (s *ShareStats) add(kind string, n int64) {
+	switch kind {
+	case ShareValid:
+		s.Valid += n
+	case ShareStale:
+		s.Stale += n
+	case ShareDuplicate:
+		s.Duplicate += n
+	case ShareInvalid:
+		s.Invalid += n
+	}
+}
+
+func (s *ShareStats) merge(other ShareStats) {
+	s.Valid += other.Valid
+	s.Stale += other.Stale
+	s.Duplicate += other.Duplicate
+	s.Invalid += other.Invalid
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
@@ -118,6 +175,16 @@ func (redisClient *RedisClient) GetWhitelist() ([]string, error) {
 	return cmd.Val(), nil
 }
 
+// Blacklist is reloaded by proxies on policy refresh
+func (redisClient *RedisClient) AddBlacklist(address string) error {
+	return redisClient.client.SAdd(redisClient.formatKey("blacklist"), address).Err()
+}
+
+func (redisClient *RedisClient) RemoveBlacklist(address string) (bool, error) {
+	n, err := redisClient.client.SRem(redisClient.formatKey("blacklist"), address).Result()
+	return n > 0, err
+}
+
 func (redisClient *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
 	tx := redisClient.client.Multi()
 	defer tx.Close()
@@ -134,6 +201,20 @@ func (redisClient *RedisClient) WriteNodeState(id string, height uint64, diff *b
 	return err
 }
 
+// Proxy runtime metrics are kept next to node state as "<id>:<name>" fields
+func (redisClient *RedisClient) WriteNodeMetrics(id string, metrics map[string]int64) error {
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		for name, value := range metrics {
+			tx.HSet(redisClient.formatKey("nodes"), join(id, name), strconv.FormatInt(value, 10))
+		}
+		return nil
+	})
+	return err
+}
+
 func (redisClient *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	cmd := redisClient.client.HGetAllMap(redisClient.formatKey("nodes"))
 	if cmd.Err() != nil {
@@ -159,6 +240,49 @@ func (redisClient *RedisClient) GetNodeStates() ([]map[string]interface{}, error
 	return v, nil
 }
 
+/* Block submission outcome per upstream node: "<name>:accepted", "<name>:rejected", "<name>:failed"
+ * counters and last latency in ms, "disagreements" counts solutions accepted by some nodes and rejected by others.
+ */
+func (redisClient *RedisClient) WriteSubmitStats(name, outcome string, latency time.Duration) error {
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.HIncrBy(redisClient.formatKey("submits"), join(name, outcome), 1)
+		tx.HSet(redisClient.formatKey("submits"), join(name, "latency"), strconv.FormatInt(int64(latency/time.Millisecond), 10))
+		return nil
+	})
+	return err
+}
+
+func (redisClient *RedisClient) WriteSubmitDisagreement() error {
+	return redisClient.client.HIncrBy(redisClient.formatKey("submits"), "disagreements", 1).Err()
+}
+
+func (redisClient *RedisClient) GetSubmitStats() (map[string]interface{}, error) {
+	raw, err := redisClient.client.HGetAllMap(redisClient.formatKey("submits")).Result()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]interface{})
+	nodes := make(map[string]map[string]int64)
+	for key, value := range raw {
+		n, _ := strconv.ParseInt(value, 10, 64)
+		i := strings.LastIndex(key, ":")
+		if i < 0 {
+			stats[key] = n
+			continue
+		}
+		name := key[:i]
+		if _, ok := nodes[name]; !ok {
+			nodes[name] = make(map[string]int64)
+		}
+		nodes[name][key[i+1:]] = n
+	}
+	stats["nodes"] = nodes
+	return stats, nil
+}
+
 func (redisClient *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
 	// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
 	redisClient.client.ZRemRangeByScore(redisClient.formatKey("pow"), "-inf", fmt.Sprint("(", height-8))
@@ -178,11 +302,10 @@ func (redisClient *RedisClient) WriteShare(login, id string, params []string, di
 	tx := redisClient.client.Multi()
 	defer tx.Close()
 
-	ms := util.MakeTimestamp()
-	ts := ms / 1000
+	ts := util.MakeTimestamp() / 1000
 
 	_, err = tx.Exec(func() error {
-		redisClient.writeShare(tx, ms, ts, login, id, diff, window)
+		redisClient.writeShare(tx, ts, login, id, diff, window)
 		tx.HIncrBy(redisClient.formatKey("stats"), "roundShares", diff)
 		return nil
 	})
@@ -201,11 +324,12 @@ func (redisClient *RedisClient) WriteBlock(login, id string, params []string, di
 	tx := redisClient.client.Multi()
 	defer tx.Close()
 
-	ms := util.MakeTimestamp()
-	ts := ms / 1000
+	ts := util.MakeTimestamp() / 1000
+	// Previous block closes the round, executed immediately
+	roundStart, _ := tx.HGet(redisClient.formatKey("stats"), "lastBlockFound").Int64()
 
 	cmds, err := tx.Exec(func() error {
-		redisClient.writeShare(tx, ms, ts, login, id, diff, window)
+		redisClient.writeShare(tx, ts, login, id, diff, window)
 		tx.HSet(redisClient.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
 		tx.HDel(redisClient.formatKey("stats"), "roundShares")
 		tx.ZIncrBy(redisClient.formatKey("finders"), 1, login)
@@ -217,25 +341,112 @@ func (redisClient *RedisClient) WriteBlock(login, id string, params []string, di
 	if err != nil {
 		return false, err
 	} else {
-		sharesMap, _ := cmds[10].(*redis.StringStringMapCmd).Result()
+		sharesMap, _ := cmds[len(cmds)-1].(*redis.StringStringMapCmd).Result()
 		totalShares := int64(0)
 		for _, v := range sharesMap {
 			n, _ := strconv.ParseInt(v, 10, 64)
 			totalShares += n
 		}
-		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares)
-		cmd := redisClient.client.ZAdd(redisClient.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+		block := BlockData{
+			Nonce:       params[0],
+			PowHash:     params[1],
+			MixDigest:   params[2],
+			Timestamp:   ts,
+			Difficulty:  roundDiff,
+			TotalShares: totalShares,
+			Finder:      login,
+			Worker:      id,
+			RoundStart:  roundStart,
+		}
+		cmd := redisClient.client.ZAdd(redisClient.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: block.candidateMember()})
 		return false, cmd.Err()
 	}
 }
 
-func (redisClient *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
+// Shares are summed into per-minute buckets instead of being stored one by one:
+// "buckets:<minute>" keeps login => shares and "buckets:<login>:<minute>" keeps worker => shares.
+// Buckets expire on their own, so there is nothing to trim for them.
+func (redisClient *RedisClient) writeShare(tx *redis.Multi, ts int64, login, id string, diff int64, expire time.Duration) {
+	minute := bucketStart(ts)
 	tx.HIncrBy(redisClient.formatKey("shares", "roundCurrent"), login, diff)
-	tx.ZAdd(redisClient.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	tx.ZAdd(redisClient.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
-	tx.Expire(redisClient.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
+	tx.HIncrBy(redisClient.formatKey("buckets", minute), login, diff)
+	tx.Expire(redisClient.formatKey("buckets", minute), expire)
+	tx.HIncrBy(redisClient.formatKey("buckets", login, minute), id, diff)
+	tx.Expire(redisClient.formatKey("buckets", login, minute), expire)
+	tx.HSet(redisClient.formatKey("lastbeat"), login, strconv.FormatInt(ts, 10))
+	tx.HSet(redisClient.formatKey("lastbeat", login), id, strconv.FormatInt(ts, 10))
+	tx.Expire(redisClient.formatKey("lastbeat", login), expire) // Will delete workers of miners that gone
 	tx.HSet(redisClient.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+	redisClient.writeShareStat(tx, ts, login, id, ShareValid, expire)
+}
+
+// Share outcomes are counted in per-minute buckets too, "sharestats:<login>:<minute>" keeps "<worker>:<outcome>" => count
+func (redisClient *RedisClient) writeShareStat(tx *redis.Multi, ts int64, login, id, kind string, expire time.Duration) {
+	minute := bucketStart(ts)
+	tx.HIncrBy(redisClient.formatKey("sharestats", login, minute), join(id, kind), 1)
+	tx.Expire(redisClient.formatKey("sharestats", login, minute), expire)
+}
+
+// Counts rejected share, valid ones are counted on write
+func (redisClient *RedisClient) WriteShareStat(login, id, kind string, expire time.Duration) error {
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+	_, err := tx.Exec(func() error {
+		redisClient.writeShareStat(tx, ts, login, id, kind, expire)
+		return nil
+	})
+	return err
+}
+
+// Hashrate reported by mining software, "reported:<login>" keeps worker => "<hashrate>:<clientId>:<timestamp>"
+func (redisClient *RedisClient) WriteReportedHashrate(login, id string, hashrate int64, clientId string, expire time.Duration) error {
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+	_, err := tx.Exec(func() error {
+		tx.HSet(redisClient.formatKey("reported", login), id, join(hashrate, clientId, ts))
+		tx.Expire(redisClient.formatKey("reported", login), expire)
+		return nil
+	})
+	return err
+}
+
+// Returns start of the minute bucket for given unix timestamp
+func bucketStart(ts int64) int64 {
+	return ts - ts%bucketSize
+}
+
+// Returns start of the oldest bucket lying entirely within window up to now.
+// Partial bucket before it holds shares older than window and must not be counted.
+func windowStart(now, window int64) int64 {
+	start := bucketStart(now - window)
+	if start < now-window {
+		start += bucketSize
+	}
+	if start > now {
+		start = bucketStart(now)
+	}
+	return start
+}
+
+// Seconds actually covered by buckets of window, hashrate must be divided by it rather than by window
+func windowSpan(now, window int64) int64 {
+	if span := now - windowStart(now, window); span > 0 {
+		return span
+	}
+	return 1
+}
+
+// Returns all bucket timestamps covering window up to now, oldest first
+func bucketRange(now, window int64) []int64 {
+	var result []int64
+	for ts := windowStart(now, window); ts <= now; ts += bucketSize {
+		result = append(result, ts)
+	}
+	return result
 }
 
 func (redisClient *RedisClient) formatKey(args ...interface{}) string {
@@ -323,7 +534,7 @@ func (redisClient *RedisClient) GetPayees() ([]string, error) {
 			return nil, err
 		}
 		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
+			login := strings.TrimPrefix(row, redisClient.formatKey("miners", ""))
 			payees[login] = struct{}{}
 		}
 		if c == 0 {
@@ -348,8 +559,20 @@ func (redisClient *RedisClient) GetBalance(login string) (int64, error) {
 
 func (redisClient *RedisClient) LockPayouts(login string, amount int64) error {
 	key := redisClient.formatKey("payments", "lock")
-	result := redisClient.client.SetNX(key, join(login, amount), 0).Val()
-	if !result {
+	tx, err := redisClient.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.SetNX(key, join(login, amount), 0)
+		return nil
+	})
+	if err != nil {
+		return redisClient.txError(err)
+	}
+	if !cmds[0].(*redis.BoolCmd).Val() {
 		return fmt.Errorf("Unable to acquire lock '%s'", key)
 	}
 	return nil
@@ -382,33 +605,56 @@ func (redisClient *RedisClient) GetPendingPayments() []*PendingPayment {
 	raw := redisClient.client.ZRevRangeWithScores(redisClient.formatKey("payments", "pending"), 0, -1)
 	var result []*PendingPayment
 	for _, v := range raw.Val() {
-		// timestamp -> "address:amount"
-		payment := PendingPayment{}
-		payment.Timestamp = int64(v.Score)
-		fields := strings.Split(v.Member.(string), ":")
-		payment.Address = fields[0]
-		payment.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+		r, err := decodePayment(v.Member.(string), true)
+		if err != nil {
+			continue
+		}
+		payment := PendingPayment{Timestamp: int64(v.Score), Address: r.Address, Amount: r.Amount}
 		result = append(result, &payment)
 	}
 	return result
 }
 
-// Deduct miner's balance for payment
+/* Deduct miner's balance for payment. Balance is watched, so debit made by adjustment after
+ * payer read the balance is noticed and payment is refused if balance is less than amount.
+ */
 func (redisClient *RedisClient) UpdateBalance(login string, amount int64) error {
-	tx := redisClient.client.Multi()
+	for i := 0; i < adjustAttempts; i++ {
+		err := redisClient.updateBalance(login, amount)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return ErrAdjustmentConflict
+}
+
+func (redisClient *RedisClient) updateBalance(login string, amount int64) error {
+	minerKey := redisClient.formatKey("miners", login)
+	tx, err := redisClient.multi(minerKey)
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
+	balance, err := tx.HGet(minerKey, "balance").Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if balance < amount {
+		return ErrInsufficientBalance
+	}
+
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(redisClient.formatKey("miners", login), "balance", (amount * -1))
-		tx.HIncrBy(redisClient.formatKey("miners", login), "pending", amount)
+	_, err = tx.Exec(func() error {
+		tx.HIncrBy(minerKey, "balance", (amount * -1))
+		tx.HIncrBy(minerKey, "pending", amount)
 		tx.HIncrBy(redisClient.formatKey("finances"), "balance", (amount * -1))
 		tx.HIncrBy(redisClient.formatKey("finances"), "pending", amount)
-		tx.ZAdd(redisClient.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+		tx.ZAdd(redisClient.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: paymentMember("", login, amount)})
 		return nil
 	})
-	return err
+	return redisClient.txError(err)
 }
 
 func (redisClient *RedisClient) RollbackBalance(login string, amount int64) error {
@@ -420,59 +666,68 @@ func (redisClient *RedisClient) RollbackBalance(login string, amount int64) erro
 		tx.HIncrBy(redisClient.formatKey("miners", login), "pending", (amount * -1))
 		tx.HIncrBy(redisClient.formatKey("finances"), "balance", amount)
 		tx.HIncrBy(redisClient.formatKey("finances"), "pending", (amount * -1))
-		tx.ZRem(redisClient.formatKey("payments", "pending"), join(login, amount))
+		tx.ZRem(redisClient.formatKey("payments", "pending"), paymentMember("", login, amount), join(login, amount))
 		return nil
 	})
 	return err
 }
 
 func (redisClient *RedisClient) WritePayment(login, txHash string, amount int64) error {
-	tx := redisClient.client.Multi()
+	tx, err := redisClient.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HIncrBy(redisClient.formatKey("miners", login), "pending", (amount * -1))
 		tx.HIncrBy(redisClient.formatKey("miners", login), "paid", amount)
 		tx.HIncrBy(redisClient.formatKey("finances"), "pending", (amount * -1))
 		tx.HIncrBy(redisClient.formatKey("finances"), "paid", amount)
-		tx.ZAdd(redisClient.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZAdd(redisClient.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-		tx.ZRem(redisClient.formatKey("payments", "pending"), join(login, amount))
+		tx.ZAdd(redisClient.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: paymentMember(txHash, login, amount)})
+		tx.ZAdd(redisClient.formatKey("payments", login), redis.Z{Score: float64(ts), Member: paymentMember(txHash, "", amount)})
+		tx.ZRem(redisClient.formatKey("payments", "pending"), paymentMember("", login, amount), join(login, amount))
 		tx.Del(redisClient.formatKey("payments", "lock"))
 		return nil
 	})
-	return err
+	return redisClient.txError(err)
 }
 
-func (redisClient *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
-	tx := redisClient.client.Multi()
+func (redisClient *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards, roundShares map[string]int64) error {
+	tx, err := redisClient.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	ts := util.MakeTimestamp() / 1000
+
+	_, err = tx.Exec(func() error {
 		redisClient.writeImmatureBlock(tx, block)
 		total := int64(0)
 		for login, amount := range roundRewards {
 			total += amount
 			tx.HIncrBy(redisClient.formatKey("miners", login), "immature", amount)
 			tx.HSetNX(redisClient.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+			redisClient.writeReward(tx, ts, login, block, amount, roundShares[login], RewardImmature)
 		}
 		tx.HIncrBy(redisClient.formatKey("finances"), "immature", total)
 		return nil
 	})
-	return err
+	return redisClient.txError(err)
 }
 
-func (redisClient *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
+func (redisClient *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards, roundShares map[string]int64) error {
 	creditKey := redisClient.formatKey("credits", "immature", block.RoundHeight, block.Hash)
-	tx, err := redisClient.client.Watch(creditKey)
-	// Must decrement immatures using existing log entry
-	immatureCredits := tx.HGetAllMap(creditKey)
+	tx, err := redisClient.multi(creditKey)
 	if err != nil {
 		return err
 	}
 	defer tx.Close()
+	// Must decrement immatures using existing log entry
+	immatureCredits := tx.HGetAllMap(creditKey)
 
 	ts := util.MakeTimestamp() / 1000
 	value := join(block.Hash, ts, block.Reward)
@@ -496,6 +751,7 @@ func (redisClient *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards
 			// NOTICE: Maybe expire round reward entry in 604800 (a week)?
 			tx.HIncrBy(redisClient.formatKey("miners", login), "balance", amount)
 			tx.HSetNX(redisClient.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+			redisClient.writeReward(tx, ts, login, block, amount, roundShares[login], RewardMatured)
 		}
 		tx.Del(creditKey)
 		tx.HIncrBy(redisClient.formatKey("finances"), "balance", total)
@@ -505,21 +761,24 @@ func (redisClient *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards
 		tx.HIncrBy(redisClient.formatKey("finances"), "totalMined", block.RewardInShannon())
 		return nil
 	})
-	return err
+	return redisClient.txError(err)
 }
 
 func (redisClient *RedisClient) WriteOrphan(block *BlockData) error {
 	creditKey := redisClient.formatKey("credits", "immature", block.RoundHeight, block.Hash)
-	tx, err := redisClient.client.Watch(creditKey)
-	// Must decrement immatures using existing log entry
-	immatureCredits := tx.HGetAllMap(creditKey)
+	tx, err := redisClient.multi(creditKey)
 	if err != nil {
 		return err
 	}
 	defer tx.Close()
+	// Must decrement immatures using existing log entry
+	immatureCredits := tx.HGetAllMap(creditKey)
+
+	rewards := redisClient.getRewardsData(tx, block, immatureCredits.Val())
 
 	_, err = tx.Exec(func() error {
 		redisClient.writeMaturedBlock(tx, block)
+		redisClient.writeOrphanedRewards(tx, block, rewards)
 
 		// Decrement immature balances
 		totalImmature := int64(0)
@@ -532,20 +791,23 @@ func (redisClient *RedisClient) WriteOrphan(block *BlockData) error {
 		tx.HIncrBy(redisClient.formatKey("finances"), "immature", (totalImmature * -1))
 		return nil
 	})
-	return err
+	return redisClient.txError(err)
 }
 
 func (redisClient *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
-	tx := redisClient.client.Multi()
+	tx, err := redisClient.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		for _, block := range blocks {
 			redisClient.writeImmatureBlock(tx, block)
 		}
 		return nil
 	})
-	return err
+	return redisClient.txError(err)
 }
 
 func (redisClient *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
@@ -609,42 +871,77 @@ func convertStringMap(m map[string]string) map[string]interface{} {
 	return result
 }
 
-// WARNING: Must run it periodically to flush out of window hashrate entries
+// WARNING: Must run it periodically to flush gone miners out of lastbeat index
 func (redisClient *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
 	now := util.MakeTimestamp() / 1000
-	max := fmt.Sprint("(", now-int64(window/time.Second))
-	total, err := redisClient.client.ZRemRangeByScore(redisClient.formatKey("hashrate"), "-inf", max).Result()
+	max := now - int64(largeWindow/time.Second)
+
+	// Raw share sets are not written anymore, drop the legacy pool-wide one
+	_, err := redisClient.client.Del(redisClient.formatKey("hashrate")).Result()
 	if err != nil {
-		return total, err
+		return 0, err
 	}
 
-	var c int64
-	miners := make(map[string]struct{})
-	max = fmt.Sprint("(", now-int64(largeWindow/time.Second))
+	lastBeats, err := redisClient.client.HGetAllMap(redisClient.formatKey("lastbeat")).Result()
+	if err != nil {
+		return 0, err
+	}
+	var stale, active []string
+	for login, v := range lastBeats {
+		ts, _ := strconv.ParseInt(v, 10, 64)
+		if ts < max {
+			stale = append(stale, login)
+		} else {
+			active = append(active, login)
+		}
+	}
+	if err := redisClient.flushStaleWorkers(active, max); err != nil {
+		return 0, err
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+	return redisClient.client.HDel(redisClient.formatKey("lastbeat"), stale...).Result()
+}
 
-	for {
-		var keys []string
-		var err error
-		c, keys, err = redisClient.client.Scan(c, redisClient.formatKey("hashrate", "*"), 100).Result()
-		if err != nil {
-			return total, err
+// Key of active miner never expires, so workers gone long ago must be removed field by field
+func (redisClient *RedisClient) flushStaleWorkers(logins []string, max int64) error {
+	if len(logins) == 0 {
+		return nil
+	}
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, login := range logins {
+			tx.HGetAllMap(redisClient.formatKey("lastbeat", login))
 		}
-		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
-			if _, ok := miners[login]; !ok {
-				n, err := redisClient.client.ZRemRangeByScore(redisClient.formatKey("hashrate", login), "-inf", max).Result()
-				if err != nil {
-					return total, err
-				}
-				miners[login] = struct{}{}
-				total += n
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	stale := make(map[string][]string)
+	for i, login := range logins {
+		workers, _ := cmds[i].(*redis.StringStringMapCmd).Result()
+		for id, v := range workers {
+			ts, _ := strconv.ParseInt(v, 10, 64)
+			if ts < max {
+				stale[login] = append(stale[login], id)
 			}
 		}
-		if c == 0 {
-			break
-		}
 	}
-	return total, nil
+	if len(stale) == 0 {
+		return nil
+	}
+	_, err = tx.Exec(func() error {
+		for login, ids := range stale {
+			tx.HDel(redisClient.formatKey("lastbeat", login), ids...)
+		}
+		return nil
+	})
+	return err
 }
 
 func (redisClient *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
@@ -656,9 +953,10 @@ func (redisClient *RedisClient) CollectStats(smallWindow time.Duration, maxBlock
 
 	now := util.MakeTimestamp() / 1000
 
+	buckets := bucketRange(now, window)
+
 	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(redisClient.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
-		tx.ZRangeWithScores(redisClient.formatKey("hashrate"), 0, -1)
+		tx.HGetAllMap(redisClient.formatKey("lastbeat"))
 		tx.HGetAllMap(redisClient.formatKey("stats"))
 		tx.ZRevRangeWithScores(redisClient.formatKey("blocks", "candidates"), 0, -1)
 		tx.ZRevRangeWithScores(redisClient.formatKey("blocks", "immature"), 0, -1)
@@ -668,32 +966,36 @@ func (redisClient *RedisClient) CollectStats(smallWindow time.Duration, maxBlock
 		tx.ZCard(redisClient.formatKey("blocks", "matured"))
 		tx.ZCard(redisClient.formatKey("payments", "all"))
 		tx.ZRevRangeWithScores(redisClient.formatKey("payments", "all"), 0, maxPayments-1)
+		for _, ts := range buckets {
+			tx.HGetAllMap(redisClient.formatKey("buckets", ts))
+		}
 		return nil
 	})
 
-	if err != nil {
+	if err != nil && err != redis.Nil {
 		return nil, err
 	}
 
-	result, _ := cmds[2].(*redis.StringStringMapCmd).Result()
+	result, _ := cmds[1].(*redis.StringStringMapCmd).Result()
 	stats["stats"] = convertStringMap(result)
-	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
+	candidates := convertCandidateResults(cmds[2].(*redis.ZSliceCmd))
 	stats["candidates"] = candidates
-	stats["candidatesTotal"] = cmds[6].(*redis.IntCmd).Val()
+	stats["candidatesTotal"] = cmds[5].(*redis.IntCmd).Val()
 
-	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
+	immature := convertBlockResults(cmds[3].(*redis.ZSliceCmd))
 	stats["immature"] = immature
-	stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
+	stats["immatureTotal"] = cmds[6].(*redis.IntCmd).Val()
 
-	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
+	matured := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
 	stats["matured"] = matured
-	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
+	stats["maturedTotal"] = cmds[7].(*redis.IntCmd).Val()
 
-	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
+	payments := convertPaymentsResults(cmds[9].(*redis.ZSliceCmd))
 	stats["payments"] = payments
-	stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
+	stats["paymentsTotal"] = cmds[8].(*redis.IntCmd).Val()
 
-	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
+	lastBeats, _ := cmds[0].(*redis.StringStringMapCmd).Result()
+	totalHashrate, miners := convertMinersStats(now, window, convertBuckets(buckets, cmds[10:]), lastBeats)
 	stats["miners"] = miners
 	stats["minersTotal"] = len(miners)
 	stats["hashrate"] = totalHashrate
@@ -710,21 +1012,35 @@ func (redisClient *RedisClient) CollectWorkersStats(sWindow, lWindow time.Durati
 
 	now := util.MakeTimestamp() / 1000
 
+	buckets := bucketRange(now, largeWindow)
+
 	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(redisClient.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
-		tx.ZRangeWithScores(redisClient.formatKey("hashrate", login), 0, -1)
+		tx.HGetAllMap(redisClient.formatKey("lastbeat", login))
+		tx.HGetAllMap(redisClient.formatKey("reported", login))
+		for _, ts := range buckets {
+			tx.HGetAllMap(redisClient.formatKey("buckets", login, ts))
+		}
+		for _, ts := range buckets {
+			tx.HGetAllMap(redisClient.formatKey("sharestats", login, ts))
+		}
 		return nil
 	})
 
-	if err != nil {
+	if err != nil && err != redis.Nil {
 		return nil, err
 	}
 
 	totalHashrate := int64(0)
 	currentHashrate := int64(0)
+	reportedHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
-	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
+	lastBeats, _ := cmds[0].(*redis.StringStringMapCmd).Result()
+	reported, _ := cmds[1].(*redis.StringStringMapCmd).Result()
+	workers := convertWorkersStats(now, smallWindow, convertBuckets(buckets, cmds[2:2+len(buckets)]), lastBeats)
+	addReportedHashrate(workers, reported, now-smallWindow)
+	addShareStats(workers, convertBuckets(buckets, cmds[2+len(buckets):]), windowStart(now, smallWindow))
+	var shares, totalShares ShareStats
 
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
@@ -733,14 +1049,14 @@ func (redisClient *RedisClient) CollectWorkersStats(sWindow, lWindow time.Durati
 		}
 
 		boundary := timeOnline
-		if timeOnline >= smallWindow {
-			boundary = smallWindow
+		if span := windowSpan(now, smallWindow); timeOnline >= span {
+			boundary = span
 		}
 		worker.HR = worker.HR / boundary
 
 		boundary = timeOnline
-		if timeOnline >= largeWindow {
-			boundary = largeWindow
+		if span := windowSpan(now, largeWindow); timeOnline >= span {
+			boundary = span
 		}
 		worker.TotalHR = worker.TotalHR / boundary
 
@@ -753,6 +1069,9 @@ func (redisClient *RedisClient) CollectWorkersStats(sWindow, lWindow time.Durati
 
 		currentHashrate += worker.HR
 		totalHashrate += worker.TotalHR
+		reportedHashrate += worker.ReportedHR
+		shares.merge(worker.Shares)
+		totalShares.merge(worker.TotalShares)
 		workers[id] = worker
 	}
 	stats["workers"] = workers
@@ -761,6 +1080,9 @@ func (redisClient *RedisClient) CollectWorkersStats(sWindow, lWindow time.Durati
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
+	stats["reportedHashrate"] = reportedHashrate
+	stats["shares"] = shares
+	stats["shares2"] = totalShares
 	return stats, nil
 }
 
@@ -821,139 +1143,218 @@ func (redisClient *RedisClient) CollectLuckStats(windows []int) (map[string]inte
 func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
 	for _, v := range raw.Val() {
-		// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
-		block := BlockData{}
-		block.Height = int64(v.Score)
-		block.RoundHeight = block.Height
-		fields := strings.Split(v.Member.(string), ":")
-		block.Nonce = fields[0]
-		block.PowHash = fields[1]
-		block.MixDigest = fields[2]
-		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
-		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
-		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
-		block.candidateKey = v.Member.(string)
-		result = append(result, &block)
+		if block := convertCandidate(v); block != nil {
+			result = append(result, block)
+		}
 	}
 	return result
 }
 
+// Returns nil if member can't be decoded
+func convertCandidate(v redis.Z) *BlockData {
+	block := BlockData{}
+	if decodeCandidate(v.Member.(string), &block) != nil {
+		return nil
+	}
+	block.Height = int64(v.Score)
+	block.RoundHeight = block.Height
+	block.setRoundStats()
+	block.candidateKey = v.Member.(string)
+	return &block
+}
+
 func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
 	for _, row := range rows {
 		for _, v := range row.Val() {
-			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
-			block := BlockData{}
-			block.Height = int64(v.Score)
-			block.RoundHeight = block.Height
-			fields := strings.Split(v.Member.(string), ":")
-			block.UncleHeight, _ = strconv.ParseInt(fields[0], 10, 64)
-			block.Uncle = block.UncleHeight > 0
-			block.Orphan, _ = strconv.ParseBool(fields[1])
-			block.Nonce = fields[2]
-			block.Hash = fields[3]
-			block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
-			block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
-			block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
-			block.RewardString = fields[7]
-			block.ImmatureReward = fields[7]
-			block.immatureKey = v.Member.(string)
-			result = append(result, &block)
+			if block := convertBlock(v); block != nil {
+				result = append(result, block)
+			}
 		}
 	}
 	return result
 }
 
+// Returns nil if member can't be decoded
+func convertBlock(v redis.Z) *BlockData {
+	block := BlockData{}
+	if decodeBlock(v.Member.(string), &block) != nil {
+		return nil
+	}
+	block.Height = int64(v.Score)
+	block.RoundHeight = block.Height
+	block.Uncle = block.UncleHeight > 0
+	block.ImmatureReward = block.RewardString
+	block.setRoundStats()
+	block.immatureKey = v.Member.(string)
+	return &block
+}
+
+type shareBucket struct {
+	ts     int64
+	shares map[string]int64
+}
+
+// Pair bucket timestamps with HGETALL replies, oldest first
+func convertBuckets(buckets []int64, cmds []redis.Cmder) []shareBucket {
+	result := make([]shareBucket, 0, len(buckets))
+	for i, ts := range buckets {
+		raw, _ := cmds[i].(*redis.StringStringMapCmd).Result()
+		if len(raw) == 0 {
+			continue
+		}
+		bucket := shareBucket{ts: ts, shares: make(map[string]int64, len(raw))}
+		for id, v := range raw {
+			bucket.shares[id], _ = strconv.ParseInt(v, 10, 64)
+		}
+		result = append(result, bucket)
+	}
+	return result
+}
+
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
-// TS => diff, id, ms
-func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
-	now := util.MakeTimestamp() / 1000
+// from large window buckets, small window is a tail of it
+func convertWorkersStats(now, window int64, buckets []shareBucket, lastBeats map[string]string) map[string]Worker {
 	workers := make(map[string]Worker)
 
-	for _, v := range raw.Val() {
-		parts := strings.Split(v.Member.(string), ":")
-		share, _ := strconv.ParseInt(parts[0], 10, 64)
-		id := parts[1]
-		score := int64(v.Score)
-		worker := workers[id]
+	for _, bucket := range buckets {
+		for id, share := range bucket.shares {
+			worker := workers[id]
+
+			// Add for large window
+			worker.TotalHR += share
+
+			// Add for small window if matches
+			if bucket.ts >= windowStart(now, window) {
+				worker.HR += share
+			}
 
-		// Add for large window
-		worker.TotalHR += share
+			if worker.startedAt > bucket.ts || worker.startedAt == 0 {
+				worker.startedAt = bucket.ts
+			}
+			workers[id] = worker
+		}
+	}
+	for id, worker := range workers {
+		worker.LastBeat = lastBeat(lastBeats, id, buckets)
+		workers[id] = worker
+	}
+	return workers
+}
 
-		// Add for small window if matches
-		if score >= now-window {
-			worker.HR += share
+// Small window starts at since bucket, large window is the whole range
+func addShareStats(workers map[string]Worker, buckets []shareBucket, since int64) {
+	for _, bucket := range buckets {
+		for field, n := range bucket.shares {
+			i := strings.LastIndex(field, ":")
+			if i < 0 {
+				continue
+			}
+			id, kind := field[:i], field[i+1:]
+			worker := workers[id]
+			worker.TotalShares.add(kind, n)
+			if bucket.ts >= since {
+				worker.Shares.add(kind, n)
+			}
+			workers[id] = worker
 		}
+	}
+}
 
-		if worker.LastBeat < score {
-			worker.LastBeat = score
+// Reports older than since are stale, rig reporting without shares is still listed to spot it
+func addReportedHashrate(workers map[string]Worker, reported map[string]string, since int64) {
+	for id, value := range reported {
+		parts := strings.Split(value, ":")
+		if len(parts) != 3 {
+			continue
 		}
-		if worker.startedAt > score || worker.startedAt == 0 {
-			worker.startedAt = score
+		hashrate, _ := strconv.ParseInt(parts[0], 10, 64)
+		ts, _ := strconv.ParseInt(parts[2], 10, 64)
+		if ts < since {
+			continue
 		}
+		worker := workers[id]
+		worker.ReportedHR = hashrate
+		worker.ClientId = parts[1]
 		workers[id] = worker
 	}
-	return workers
 }
 
-func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
-	now := util.MakeTimestamp() / 1000
+func convertMinersStats(now, window int64, buckets []shareBucket, lastBeats map[string]string) (int64, map[string]Miner) {
 	miners := make(map[string]Miner)
 	totalHashrate := int64(0)
 
-	for _, v := range raw.Val() {
-		parts := strings.Split(v.Member.(string), ":")
-		share, _ := strconv.ParseInt(parts[0], 10, 64)
-		id := parts[1]
-		score := int64(v.Score)
-		miner := miners[id]
-		miner.HR += share
+	for _, bucket := range buckets {
+		for login, share := range bucket.shares {
+			miner := miners[login]
+			miner.HR += share
 
-		if miner.LastBeat < score {
-			miner.LastBeat = score
-		}
-		if miner.startedAt > score || miner.startedAt == 0 {
-			miner.startedAt = score
+			if miner.startedAt > bucket.ts || miner.startedAt == 0 {
+				miner.startedAt = bucket.ts
+			}
+			miners[login] = miner
 		}
-		miners[id] = miner
 	}
 
-	for id, miner := range miners {
+	for login, miner := range miners {
 		timeOnline := now - miner.startedAt
 		if timeOnline < 600 {
 			timeOnline = 600
 		}
 
 		boundary := timeOnline
-		if timeOnline >= window {
-			boundary = window
+		if span := windowSpan(now, window); timeOnline >= span {
+			boundary = span
 		}
 		miner.HR = miner.HR / boundary
+		miner.LastBeat = lastBeat(lastBeats, login, buckets)
 
 		if miner.LastBeat < (now - window/2) {
 			miner.Offline = true
 		}
 		totalHashrate += miner.HR
-		miners[id] = miner
+		miners[login] = miner
 	}
 	return totalHashrate, miners
 }
 
+// Exact last share time from index, falls back to the end of the latest bucket with shares
+func lastBeat(lastBeats map[string]string, id string, buckets []shareBucket) int64 {
+	if v, ok := lastBeats[id]; ok {
+		ts, _ := strconv.ParseInt(v, 10, 64)
+		return ts
+	}
+	for i := len(buckets) - 1; i >= 0; i-- {
+		if _, ok := buckets[i].shares[id]; ok {
+			return buckets[i].ts + bucketSize - 1
+		}
+	}
+	return 0
+}
+
 func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
 	var result []map[string]interface{}
 	for _, v := range raw.Val() {
-		tx := make(map[string]interface{})
-		tx["timestamp"] = int64(v.Score)
-		fields := strings.Split(v.Member.(string), ":")
-		tx["tx"] = fields[0]
-		// Individual or whole payments row
-		if len(fields) < 3 {
-			tx["amount"], _ = strconv.ParseInt(fields[1], 10, 64)
-		} else {
-			tx["address"] = fields[1]
-			tx["amount"], _ = strconv.ParseInt(fields[2], 10, 64)
+		if tx := convertPayment(v); tx != nil {
+			result = append(result, tx)
 		}
-		result = append(result, tx)
 	}
 	return result
 }
+
+// Returns nil if member can't be decoded
+func convertPayment(v redis.Z) map[string]interface{} {
+	r, err := decodePayment(v.Member.(string), false)
+	if err != nil {
+		return nil
+	}
+	tx := make(map[string]interface{})
+	tx["timestamp"] = int64(v.Score)
+	tx["tx"] = r.Tx
+	tx["amount"] = r.Amount
+	// Individual or whole payments row
+	if len(r.Address) > 0 {
+		tx["address"] = r.Address
+	}
+	return tx
+}
@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"fmt"
+	"math/big"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/redis.v3"
 )
@@ -159,7 +163,7 @@ func TestUpdateBalance(t *testing.T) {
 		t.Error("Must not touch pool paid")
 	}
 
-	rank := r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Val()
+	rank := r.client.ZRank(r.formatKey("payments:pending"), paymentMember("", "x", amount)).Val()
 	if rank != 0 {
 		t.Error("Must add pending payment")
 	}
@@ -202,7 +206,7 @@ func TestRollbackBalance(t *testing.T) {
 		t.Error("Must deduct pool pending")
 	}
 
-	err := r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Err()
+	err := r.client.ZRank(r.formatKey("payments:pending"), paymentMember("", "x", amount)).Err()
 	if err != redis.Nil {
 		t.Errorf("Must remove pending payment")
 	}
@@ -249,15 +253,15 @@ func TestWritePayment(t *testing.T) {
 		t.Errorf("Must release lock")
 	}
 
-	err = r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Err()
+	err = r.client.ZRank(r.formatKey("payments:pending"), paymentMember("", "x", amount)).Err()
 	if err != redis.Nil {
 		t.Error("Must remove pending payment")
 	}
-	err = r.client.ZRank(r.formatKey("payments:all"), join("0x0", "x", amount)).Err()
+	err = r.client.ZRank(r.formatKey("payments:all"), paymentMember("0x0", "x", amount)).Err()
 	if err == redis.Nil {
 		t.Error("Must add payment to set")
 	}
-	err = r.client.ZRank(r.formatKey("payments:x"), join("0x0", amount)).Err()
+	err = r.client.ZRank(r.formatKey("payments:x"), paymentMember("0x0", "", amount)).Err()
 	if err == redis.Nil {
 		t.Error("Must add payment to set")
 	}
@@ -268,7 +272,7 @@ func TestGetPendingPayments(t *testing.T) {
 
 	r.client.HMSetMap(
 		r.formatKey("miners:x"),
-		map[string]string{"paid": "100", "balance": "750", "pending": "250"},
+		map[string]string{"paid": "100", "balance": "1000", "pending": "250"},
 	)
 
 	amount := int64(1000)
@@ -321,9 +325,510 @@ func TestCollectLuckStats(t *testing.T) {
 	}
 }
 
+func TestCollectStats(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "rig-1", []string{"0x0", "0x0", "0x1"}, 600, 1008, time.Hour)
+	r.WriteShare("x", "rig-2", []string{"0x0", "0x0", "0x2"}, 1200, 1008, time.Hour)
+	r.WriteShare("z", "rig-1", []string{"0x0", "0x0", "0x3"}, 6000, 1008, time.Hour)
+
+	stats, err := r.CollectStats(30*time.Minute, 10, 10)
+	if err != nil {
+		t.Fatalf("Must collect stats: %v", err)
+	}
+	if stats["minersTotal"] != 2 {
+		t.Errorf("Must count miners from buckets: %v", stats["minersTotal"])
+	}
+	miners := stats["miners"].(map[string]Miner)
+	if miners["x"].HR != 3 || miners["z"].HR != 10 {
+		t.Errorf("Must sum shares per miner: %v", miners)
+	}
+	if miners["x"].Offline || miners["x"].LastBeat == 0 {
+		t.Error("Miner must be online")
+	}
+	if stats["hashrate"] != int64(13) {
+		t.Errorf("Must sum pool hashrate: %v", stats["hashrate"])
+	}
+}
+
+func TestCollectWorkersStats(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "rig-1", []string{"0x0", "0x0", "0x1"}, 600, 1008, time.Hour)
+	r.WriteShare("x", "rig-1", []string{"0x0", "0x0", "0x2"}, 600, 1008, time.Hour)
+	r.WriteShare("x", "rig-2", []string{"0x0", "0x0", "0x3"}, 1800, 1008, time.Hour)
+	clientId := "0x" + strings.Repeat("ab", 32)
+	r.WriteShareStat("x", "rig-2", ShareStale, time.Hour)
+	r.WriteShareStat("x", "rig-2", ShareInvalid, time.Hour)
+	r.WriteReportedHashrate("x", "rig-1", 1500, clientId, time.Hour)
+	r.WriteReportedHashrate("x", "rig-3", 700, clientId, time.Hour)
+	r.client.HSet(r.formatKey("reported", "x"), "rig-2", "900:"+clientId+":1")
+
+	stats, err := r.CollectWorkersStats(30*time.Minute, 3*time.Hour, "x")
+	if err != nil {
+		t.Fatalf("Must collect workers stats: %v", err)
+	}
+	workers := stats["workers"].(map[string]Worker)
+	if len(workers) != 3 {
+		t.Errorf("Must return all workers: %v", workers)
+	}
+	if workers["rig-1"].ReportedHR != 1500 || workers["rig-1"].ClientId != clientId || workers["rig-2"].ReportedHR != 0 {
+		t.Errorf("Must return fresh reported hashrate per worker: %v", workers)
+	}
+	if !workers["rig-3"].Offline || workers["rig-3"].ReportedHR != 700 {
+		t.Errorf("Must list reporting worker without shares as offline: %v", workers["rig-3"])
+	}
+	if workers["rig-1"].Shares.Valid != 2 || workers["rig-2"].Shares.Stale != 1 || workers["rig-2"].Shares.Invalid != 1 {
+		t.Errorf("Must count share outcomes per worker: %v", workers)
+	}
+	if stats["shares2"].(ShareStats).Valid != 3 || stats["shares"].(ShareStats).Stale != 1 {
+		t.Errorf("Must sum share outcomes of account: %v %v", stats["shares"], stats["shares2"])
+	}
+	if stats["reportedHashrate"] != int64(2200) {
+		t.Errorf("Must sum reported hashrate: %v", stats["reportedHashrate"])
+	}
+	if workers["rig-1"].HR != 2 || workers["rig-2"].HR != 3 {
+		t.Errorf("Must sum shares per worker: %v", workers)
+	}
+	if stats["currentHashrate"] != int64(5) || stats["workersOnline"] != int64(2) {
+		t.Errorf("Must sum workers hashrate: %v", stats)
+	}
+}
+
+func TestFlushStaleStats(t *testing.T) {
+	reset()
+
+	r.client.HSet(r.formatKey("lastbeat"), "x", "1")
+	r.WriteShare("z", "rig-1", []string{"0x0", "0x0", "0x1"}, 600, 1008, time.Hour)
+
+	n, _ := r.FlushStaleStats(30*time.Minute, 3*time.Hour)
+	if n != 1 {
+		t.Errorf("Must remove gone miner: %v", n)
+	}
+	if r.client.HExists(r.formatKey("lastbeat"), "x").Val() {
+		t.Error("Must remove stale lastbeat entry")
+	}
+	if !r.client.HExists(r.formatKey("lastbeat"), "z").Val() {
+		t.Error("Must keep active lastbeat entry")
+	}
+
+	r.client.HSet(r.formatKey("lastbeat", "z"), "rig-gone", "1")
+	r.FlushStaleStats(30*time.Minute, 3*time.Hour)
+	if r.client.HExists(r.formatKey("lastbeat", "z"), "rig-gone").Val() {
+		t.Error("Must remove stale worker of active miner")
+	}
+	if !r.client.HExists(r.formatKey("lastbeat", "z"), "rig-1").Val() {
+		t.Error("Must keep active worker")
+	}
+}
+
+func TestBucketRange(t *testing.T) {
+	buckets := bucketRange(1830, 1800)
+	if buckets[0] != 60 || buckets[len(buckets)-1] != 1800 {
+		t.Errorf("Must skip partial bucket before window: %v", buckets)
+	}
+	if span := windowSpan(1830, 1800); span != 1770 {
+		t.Errorf("Must divide by covered seconds: %v", span)
+	}
+	if span := windowSpan(1800, 1800); span != 1800 {
+		t.Errorf("Must cover whole window on bucket edge: %v", span)
+	}
+}
+
+func TestWritePoolHistory(t *testing.T) {
+	reset()
+
+	tiers := []SeriesTier{
+		SeriesTier{Resolution: 10 * time.Minute, Retention: 24 * time.Hour},
+		SeriesTier{Resolution: time.Hour, Retention: 720 * time.Hour},
+	}
+	r.WritePoolHistory(tiers, 3600, 100, 1, 10)
+	r.WritePoolHistory(tiers, 4200, 300, 3, 30)
+
+	points, _ := r.GetPoolHistory(tiers[0])
+	if len(points) != 2 || points[1]["hashrate"] != 300 || points[1]["timestamp"] != 4200 {
+		t.Errorf("Must keep raw points in finest tier: %v", points)
+	}
+	points, _ = r.GetPoolHistory(tiers[1])
+	if len(points) != 1 || points[0]["hashrate"] != 200 || points[0]["miners"] != 2 || points[0]["timestamp"] != 3600 {
+		t.Errorf("Must average points in coarse tier: %v", points)
+	}
+}
+
+func TestWriteMinerHistory(t *testing.T) {
+	reset()
+
+	tiers := []SeriesTier{
+		SeriesTier{Resolution: 10 * time.Minute, Retention: 24 * time.Hour},
+		SeriesTier{Resolution: time.Hour, Retention: 720 * time.Hour},
+	}
+	r.WriteMinerHistory(tiers, 3600, "x", map[string]int64{"rig-1": 100, "rig-2": 50})
+	r.WriteMinerHistory(tiers, 4200, "x", map[string]int64{"rig-1": 300, "rig-2": 150})
+
+	stats, _ := r.GetMinerHistory(tiers[1], "x")
+	points := stats["hashrate"].([]map[string]int64)
+	if len(points) != 1 || points[0]["hashrate"] != 300 || points[0]["workersOnline"] != 2 {
+		t.Errorf("Must average miner points in coarse tier: %v", points)
+	}
+	workers := stats["workers"].(map[string][]map[string]int64)
+	if len(workers["rig-1"]) != 1 || workers["rig-1"][0]["hashrate"] != 200 || workers["rig-2"][0]["hashrate"] != 100 {
+		t.Errorf("Must average every worker series: %v", workers)
+	}
+}
+
+func TestRewardsHistory(t *testing.T) {
+	reset()
+
+	block := &BlockData{Height: 10, RoundHeight: 10, Hash: "0xa", Nonce: "0x1", TotalShares: 100, Reward: big.NewInt(0)}
+	r.WriteImmatureBlock(block, map[string]int64{"x": 75, "z": 25}, map[string]int64{"x": 75, "z": 25})
+	orphan := &BlockData{Height: 11, RoundHeight: 11, Hash: "0xb", Nonce: "0x2", TotalShares: 100}
+	r.WriteImmatureBlock(orphan, map[string]int64{"x": 50}, map[string]int64{"x": 100})
+
+	r.WriteMaturedBlock(block, map[string]int64{"x": 80, "z": 20}, map[string]int64{"x": 75, "z": 25})
+	r.WriteOrphan(orphan)
+
+	rewards, total, _ := r.GetRewards("x", 0, 10)
+	if total != 2 || len(rewards) != 2 {
+		t.Fatalf("Must return all rewards: %v", rewards)
+	}
+	states := map[string]*RewardData{}
+	for _, reward := range rewards {
+		states[reward.Hash] = reward
+	}
+	if states["0xa"].State != RewardMatured || states["0xa"].Amount != 80 || states["0xa"].Percent != 75 {
+		t.Errorf("Must mark reward as matured: %v", states["0xa"])
+	}
+	if states["0xb"].State != RewardOrphaned || states["0xb"].Amount != 50 {
+		t.Errorf("Must mark reward as orphaned: %v", states["0xb"])
+	}
+
+	sums, _ := r.GetRewardsSums("x", []time.Duration{time.Hour})
+	if sums[0] != 80 {
+		t.Errorf("Must not sum orphaned rewards: %v", sums)
+	}
+}
+
+func TestQueryBlocks(t *testing.T) {
+	reset()
+
+	for _, h := range []int64{10, 11, 11, 12, 13} {
+		member := fmt.Sprintf("0:false:0x%d:0xh%d%d:%d:1:1:0", h, h, r.client.ZCard(r.formatKey("blocks", "matured")).Val(), h*100)
+		r.client.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(h), Member: member})
+	}
+
+	var heights []int64
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		blocks, next, err := r.QueryBlocks(&BlocksQuery{Status: "matured", FromHeight: 11, Cursor: cursor, Limit: 2})
+		if err != nil {
+			t.Fatalf("Must query blocks: %v", err)
+		}
+		for _, block := range blocks {
+			heights = append(heights, block.Height)
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	if fmt.Sprint(heights) != "[13 12 11 11]" {
+		t.Errorf("Must walk all blocks down to height once: %v", heights)
+	}
+
+	blocks, _, _ := r.QueryBlocks(&BlocksQuery{Status: "matured", From: 1100, To: 1200, Limit: 10})
+	if len(blocks) != 3 {
+		t.Errorf("Must filter blocks by time: %v", blocks)
+	}
+	if _, _, err := r.QueryBlocks(&BlocksQuery{Status: "matured", Cursor: "x", Limit: 10}); err != ErrInvalidCursor {
+		t.Errorf("Must reject malformed cursor: %v", err)
+	}
+
+	block, status, _ := r.GetBlock(12, "0xh123")
+	if block == nil || status != "matured" || block.Height != 12 {
+		t.Errorf("Must find block by height and hash: %v", block)
+	}
+}
+
+func TestWriteBlockFinder(t *testing.T) {
+	reset()
+
+	r.client.HSet(r.formatKey("stats"), "lastBlockFound", "1000")
+	r.WriteShare("z", "rig", []string{"0x0", "0x0", "0x0"}, 50, 10, time.Minute)
+	r.WriteBlock("x", "rig1", []string{"0x1", "0x1", "0x1"}, 50, 200, 10, time.Minute)
+	legacy := "0x2:0x2:0x2:1500:100:100"
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 9, Member: legacy})
+
+	candidates, _ := r.GetCandidates(10)
+	if len(candidates) != 2 {
+		t.Fatalf("Must return all candidates: %v", candidates)
+	}
+	if candidates[0].Finder != "" || candidates[0].RoundDuration != 0 || candidates[0].Effort != 1 {
+		t.Errorf("Must read legacy candidate: %v", candidates[0])
+	}
+	block := candidates[1]
+	if block.Finder != "x" || block.Worker != "rig1" || block.RoundStart != 1000 || block.RoundDuration != block.Timestamp-1000 {
+		t.Errorf("Must record finder and round start: %v", block)
+	}
+	if block.Effort != 0.5 {
+		t.Errorf("Must compute round effort: %v", block.Effort)
+	}
+
+	block.Hash = "0xa"
+	block.Reward = big.NewInt(0)
+	r.WriteImmatureBlock(block, map[string]int64{}, map[string]int64{})
+	immature, _ := r.GetImmatureBlocks(10)
+	if len(immature) != 1 || immature[0].Finder != "x" || immature[0].Worker != "rig1" || immature[0].RoundStart != 1000 {
+		t.Errorf("Must keep finder on immature block: %v", immature)
+	}
+}
+
+func TestMigrateRecords(t *testing.T) {
+	reset()
+
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 9, Member: "0x2:0x2:0x2:1500:100:100:x:rig:1000"})
+	r.client.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: 8, Member: "0:0:0x1:0xa:1400:100:50:5000"})
+	r.client.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: 1, Member: "0x0:x:100"})
+	r.client.ZAdd(r.formatKey("payments", "x"), redis.Z{Score: 1, Member: "0x0:100"})
+	r.client.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: 2, Member: "x:200"})
+	r.client.ZAdd(r.formatKey("history", "pool", int64(600)), redis.Z{Score: 600, Member: "600:10:1:5"})
+	r.client.Set(r.formatKey("payments", "lock"), "x:200", 0)
+	r.client.HSet(r.formatKey("payments", "stats"), "total", "1")
+
+	result, err := r.MigrateRecords(true)
+	if err != nil || len(result) != 6 {
+		t.Fatalf("Must count legacy records of every key: %v %v", result, err)
+	}
+	if r.client.ZRank(r.formatKey("payments", "x"), "0x0:100").Err() != nil {
+		t.Error("Must not rewrite records in dry run")
+	}
+
+	r.MigrateRecords(false)
+	result, _ = r.MigrateRecords(true)
+	if len(result) != 0 {
+		t.Errorf("Must rewrite all legacy records: %v", result)
+	}
+
+	candidates, _ := r.GetCandidates(10)
+	if len(candidates) != 1 || candidates[0].Finder != "x" || candidates[0].RoundStart != 1000 || candidates[0].TotalShares != 100 {
+		t.Errorf("Must keep candidate fields: %v", candidates)
+	}
+	blocks := convertBlockResults(r.client.ZRangeWithScores(r.formatKey("blocks", "matured"), 0, -1))
+	if len(blocks) != 1 || blocks[0].Hash != "0xa" || blocks[0].RewardString != "5000" || blocks[0].Height != 8 {
+		t.Errorf("Must keep block fields: %v", blocks)
+	}
+	pending := r.GetPendingPayments()
+	if len(pending) != 1 || pending[0].Address != "x" || pending[0].Amount != 200 {
+		t.Errorf("Must keep pending payment: %v", pending)
+	}
+	payments, _, _ := r.QueryPayments(&PaymentsQuery{Login: "x", Limit: 10})
+	if len(payments) != 1 || payments[0]["tx"] != "0x0" || payments[0]["amount"] != int64(100) {
+		t.Errorf("Must keep miner payment: %v", payments)
+	}
+	history, _ := r.GetPoolHistory(SeriesTier{Resolution: 10 * time.Minute})
+	if len(history) != 1 || history[0]["hashrate"] != 10 || history[0]["difficulty"] != 5 {
+		t.Errorf("Must keep history point: %v", history)
+	}
+}
+
+func TestSubmitStats(t *testing.T) {
+	reset()
+
+	r.WriteSubmitStats("main", "accepted", 120*time.Millisecond)
+	r.WriteSubmitStats("main", "accepted", 80*time.Millisecond)
+	r.WriteSubmitStats("backup", "rejected", time.Second)
+	r.WriteSubmitDisagreement()
+
+	stats, _ := r.GetSubmitStats()
+	nodes := stats["nodes"].(map[string]map[string]int64)
+	if nodes["main"]["accepted"] != 2 || nodes["main"]["latency"] != 80 {
+		t.Errorf("Must count accepted blocks and keep last latency: %v", nodes["main"])
+	}
+	if nodes["backup"]["rejected"] != 1 || stats["disagreements"] != int64(1) {
+		t.Errorf("Must count rejections and disagreements: %v", stats)
+	}
+}
+
 func reset() {
 	keys := r.client.Keys(r.prefix + ":*").Val()
 	for _, k := range keys {
 		r.client.Del(k)
 	}
 }
+
+func TestSubscriptions(t *testing.T) {
+	reset()
+
+	sub, err := r.AddSubscription("x", SubscriptionWebhook, "http://example.net/hook", 2)
+	if err != nil {
+		t.Fatalf("Must add subscription: %v", err)
+	}
+	if again, _ := r.AddSubscription("x", SubscriptionWebhook, "http://example.net/hook", 2); again.Id != sub.Id {
+		t.Error("Must keep id of the same target")
+	}
+	r.AddSubscription("x", SubscriptionEmail, "miner@example.net", 2)
+	if _, err := r.AddSubscription("x", SubscriptionEmail, "other@example.net", 2); err != ErrTooManySubscriptions {
+		t.Errorf("Must limit subscriptions per login: %v", err)
+	}
+	subs, _ := r.GetSubscriptions("x")
+	logins, _ := r.GetSubscribers()
+	if len(subs) != 2 || len(logins) != 1 {
+		t.Errorf("Must list subscriptions and subscribers: %v %v", subs, logins)
+	}
+
+	r.RemoveSubscription("x", sub.Id)
+	r.RemoveSubscription("x", subscriptionId(SubscriptionEmail, "miner@example.net"))
+	if logins, _ := r.GetSubscribers(); len(logins) != 0 {
+		t.Errorf("Must forget login without subscriptions: %v", logins)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	reset()
+
+	hash := HashAdminKey("secret")
+	r.WriteAdminKey(&AdminKey{Name: "ops", Hash: hash, Scopes: []string{"read", "ops"}})
+	key, err := r.GetAdminKey(hash)
+	if err != nil || key == nil || key.Name != "ops" || len(key.Scopes) != 2 {
+		t.Errorf("Must find admin key by hash: %v %v", key, err)
+	}
+	if key, _ := r.GetAdminKey(HashAdminKey("wrong")); key != nil {
+		t.Error("Must not find unknown key")
+	}
+
+	for i := 0; i < 3; i++ {
+		r.WriteAdminAudit(&AdminAudit{Key: "ops", Path: fmt.Sprintf("/api/admin/%v", i), Status: 200})
+	}
+	audit, _ := r.GetAdminAudit(1, 2)
+	if len(audit) != 2 || audit[0].Path != "/api/admin/1" {
+		t.Errorf("Must page audit log from newest entry: %v", audit)
+	}
+
+	r.WriteBan("10.0.0.1", "malformed", 60)
+	r.WriteBan("10.0.0.2", "flood", -1)
+	bans, _ := r.GetBans()
+	if len(bans) != 1 || bans[0].Ip != "10.0.0.1" || bans[0].Reason != "malformed" {
+		t.Errorf("Must return only active bans: %v", bans)
+	}
+	if r.client.HExists(r.formatKey("bans"), "10.0.0.2").Val() {
+		t.Error("Must remove expired ban")
+	}
+
+	r.WriteModuleStatus(&ModuleStatus{Name: "payouts", Halted: true, LastFail: "boom"})
+	statuses, _ := r.GetModuleStatuses()
+	if len(statuses) != 1 || !statuses[0].Halted || statuses[0].LastFail != "boom" {
+		t.Errorf("Must keep module status: %v", statuses)
+	}
+}
+
+func TestLeaseFencing(t *testing.T) {
+	reset()
+
+	a, b := NewLease("payouts", "a"), NewLease("payouts", "b")
+	if ok, err := r.AcquireLease(a, time.Minute); !ok || err != nil {
+		t.Fatalf("Lease must be acquired: %v", err)
+	}
+	if ok, _ := r.AcquireLease(b, time.Minute); ok {
+		t.Fatal("Lease must not be acquired while held")
+	}
+	if ok, _ := r.AcquireLease(a, time.Minute); !ok || a.Token() != 1 {
+		t.Fatalf("Lease must be renewed with the same token: %v", a.Token())
+	}
+	fenced := r.WithLease(a)
+	if err := fenced.LockPayouts("x", 100); err != nil {
+		t.Fatalf("Leader write must pass: %v", err)
+	}
+	r.UnlockPayouts()
+
+	// Leader stopped renewing and lease has expired
+	r.client.Del(r.formatKey("lease", "payouts"))
+	if ok, _ := r.AcquireLease(b, time.Minute); !ok || b.Token() != 2 {
+		t.Fatalf("Lease must be taken over with new token: %v", b.Token())
+	}
+	if err := fenced.LockPayouts("x", 100); err != ErrLeaseLost {
+		t.Errorf("Deposed leader write must be rejected: %v", err)
+	}
+	if err := fenced.UpdateBalance("x", 100); err != ErrLeaseLost {
+		t.Errorf("Deposed leader write must be rejected: %v", err)
+	}
+	if ok, _ := r.AcquireLease(a, time.Minute); ok || a.Token() != 0 {
+		t.Error("Deposed leader must not renew lease")
+	}
+	if err := r.WithLease(b).LockPayouts("x", 100); err != nil {
+		t.Errorf("New leader write must pass: %v", err)
+	}
+	r.ReleaseLease(b)
+	if ok, _ := r.AcquireLease(a, time.Minute); !ok || a.Token() != 3 {
+		t.Errorf("Released lease must be acquired with new token: %v", a.Token())
+	}
+}
+
+func TestAdjustBalance(t *testing.T) {
+	reset()
+
+	if _, err := r.AdjustBalance("x", 100, "outage", "ops"); err != ErrUnknownMiner {
+		t.Errorf("Unknown miner must not be adjusted: %v", err)
+	}
+	r.client.HSet(r.formatKey("miners", "x"), "balance", "500")
+	r.client.HSet(r.formatKey("finances"), "balance", "1000")
+
+	if _, err := r.AdjustBalance("x", 100, "", "ops"); err != ErrInvalidAdjustment {
+		t.Errorf("Adjustment without reason must be rejected: %v", err)
+	}
+	if _, err := r.AdjustBalance("x", -501, "clawback", "ops"); err != ErrInsufficientBalance {
+		t.Errorf("Debit over balance must be rejected: %v", err)
+	}
+	if _, err := r.AdjustBalance("x", 200, "outage", "ops"); err != nil {
+		t.Fatalf("Credit must be applied: %v", err)
+	}
+	r.LockPayouts("x", 100)
+	if _, err := r.AdjustBalance("x", -50, "clawback", "ops"); err != ErrPayoutsInProgress {
+		t.Errorf("Debit must be rejected while payouts are locked: %v", err)
+	}
+	r.UnlockPayouts()
+	adj, err := r.AdjustBalance("x", -50, "clawback", "ops")
+	if err != nil || adj.Id != 2 {
+		t.Fatalf("Debit must be applied: %v, %v", adj, err)
+	}
+
+	if balance, _ := r.GetBalance("x"); balance != 650 {
+		t.Errorf("Miner balance must be 650, got %v", balance)
+	}
+	finances, _ := r.GetFinances()
+	if finances["balance"] != int64(1150) || finances["adjusted"] != int64(150) {
+		t.Errorf("Finances must be adjusted: %v", finances)
+	}
+	log, _ := r.GetAdjustments(0, 10)
+	if len(log) != 2 || log[0].Amount != -50 || log[1].Reason != "outage" || log[1].Operator != "ops" {
+		t.Errorf("Adjustments must be logged newest first: %v", log)
+	}
+	rewards, total, _ := r.GetRewards("x", 0, 10)
+	if total != 2 || rewards[0].State != RewardAdjustment || rewards[0].Amount+rewards[1].Amount != 150 {
+		t.Errorf("Adjustments must be in reward history: %v", rewards)
+	}
+	sums, _ := r.GetRewardsSums("x", []time.Duration{time.Hour})
+	if sums[0] != 0 {
+		t.Errorf("Adjustments must not count as earnings: %v", sums)
+	}
+}
+
+func TestUpdateBalanceAfterDebit(t *testing.T) {
+	reset()
+
+	r.client.HSet(r.formatKey("miners", "x"), "balance", "500")
+	r.client.HSet(r.formatKey("finances"), "balance", "1000")
+
+	amount, _ := r.GetBalance("x")
+	if _, err := r.AdjustBalance("x", -200, "clawback", "ops"); err != nil {
+		t.Fatalf("Debit must be applied before payouts are locked: %v", err)
+	}
+	r.LockPayouts("x", amount)
+	if err := r.UpdateBalance("x", amount); err != ErrInsufficientBalance {
+		t.Errorf("Payment of stale balance must be refused: %v", err)
+	}
+	if balance, _ := r.GetBalance("x"); balance != 300 {
+		t.Errorf("Miner balance must not go below zero, got %v", balance)
+	}
+	if pending := r.GetPendingPayments(); len(pending) != 0 {
+		t.Errorf("Refused payment must not be pending: %v", pending)
+	}
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+const (
+	RewardImmature = "immature"
+	RewardMatured  = "matured"
+	RewardOrphaned = "orphaned"
+	// Manual credit or debit, see AdjustBalance
+	RewardAdjustment = "adjustment"
+)
+
+type RewardData struct {
+	Height      int64   `json:"height"`
+	Hash        string  `json:"hash"`
+	Amount      int64   `json:"amount"`
+	Percent     float64 `json:"percent"`
+	State       string  `json:"state"`
+	Timestamp   int64   `json:"timestamp"`
+	Shares      int64   `json:"-"`
+	TotalShares int64   `json:"-"`
+}
+
+/* Per login reward index:
+ * "rewards:<login>" is a zset of "height:hash" scored by credit time,
+ * "rewards:<login>:data" hash keeps "height:hash" => "amount:shares:totalShares:state".
+ */
+func (redisClient *RedisClient) writeReward(tx *redis.Multi, ts int64, login string, block *BlockData, amount, shares int64, state string) {
+	member := join(block.Height, block.Hash)
+	tx.ZAddNX(redisClient.formatKey("rewards", login), redis.Z{Score: float64(ts), Member: member})
+	tx.HSet(redisClient.formatKey("rewards", login, "data"), member, join(amount, shares, block.TotalShares, state))
+}
+
+// Must be called before transaction execution, returns current rewards to be rewritten as orphaned
+func (redisClient *RedisClient) getRewardsData(tx *redis.Multi, block *BlockData, logins map[string]string) map[string]string {
+	member := join(block.Height, block.Hash)
+	result := make(map[string]string)
+	for login := range logins {
+		value, err := tx.HGet(redisClient.formatKey("rewards", login, "data"), member).Result()
+		if err == nil {
+			result[login] = value
+		}
+	}
+	return result
+}
+
+func (redisClient *RedisClient) writeOrphanedRewards(tx *redis.Multi, block *BlockData, rewards map[string]string) {
+	member := join(block.Height, block.Hash)
+	for login, value := range rewards {
+		fields := strings.Split(value, ":")
+		fields[len(fields)-1] = RewardOrphaned
+		tx.HSet(redisClient.formatKey("rewards", login, "data"), member, strings.Join(fields, ":"))
+	}
+}
+
+func (redisClient *RedisClient) GetRewards(login string, offset, limit int64) ([]*RewardData, int64, error) {
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.ZRevRangeWithScores(redisClient.formatKey("rewards", login), offset, offset+limit-1)
+		tx.ZCard(redisClient.formatKey("rewards", login))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	rewards, err := redisClient.convertRewardsResults(login, cmds[0].(*redis.ZSliceCmd))
+	return rewards, cmds[1].(*redis.IntCmd).Val(), err
+}
+
+// Sum of immature and matured rewards credited within each of windows, adjustments are not earnings
+func (redisClient *RedisClient) GetRewardsSums(login string, windows []time.Duration) ([]int64, error) {
+	sums := make([]int64, len(windows))
+	if len(windows) == 0 {
+		return sums, nil
+	}
+	now := util.MakeTimestamp() / 1000
+	max := windows[0]
+	for _, window := range windows {
+		if window > max {
+			max = window
+		}
+	}
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(now-int64(max/time.Second), 10), Max: "+inf"}
+	cmd := redisClient.client.ZRangeByScoreWithScores(redisClient.formatKey("rewards", login), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	rewards, err := redisClient.convertRewardsResults(login, cmd)
+	if err != nil {
+		return nil, err
+	}
+	for _, reward := range rewards {
+		if reward.State == RewardOrphaned || reward.State == RewardAdjustment {
+			continue
+		}
+		for i, window := range windows {
+			if reward.Timestamp >= now-int64(window/time.Second) {
+				sums[i] += reward.Amount
+			}
+		}
+	}
+	return sums, nil
+}
+
+func (redisClient *RedisClient) convertRewardsResults(login string, raw *redis.ZSliceCmd) ([]*RewardData, error) {
+	var result []*RewardData
+	rows := raw.Val()
+	if len(rows) == 0 {
+		return result, nil
+	}
+	members := make([]string, len(rows))
+	for i, v := range rows {
+		members[i] = v.Member.(string)
+	}
+	values, err := redisClient.client.HMGet(redisClient.formatKey("rewards", login, "data"), members...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range rows {
+		reward := RewardData{Timestamp: int64(v.Score)}
+		fields := strings.Split(members[i], ":")
+		reward.Height, _ = strconv.ParseInt(fields[0], 10, 64)
+		reward.Hash = fields[1]
+		if value, ok := values[i].(string); ok {
+			// "amount:shares:totalShares:state"
+			fields = strings.Split(value, ":")
+			reward.Amount, _ = strconv.ParseInt(fields[0], 10, 64)
+			reward.Shares, _ = strconv.ParseInt(fields[1], 10, 64)
+			reward.TotalShares, _ = strconv.ParseInt(fields[2], 10, 64)
+			reward.State = fields[3]
+		}
+		if reward.TotalShares > 0 {
+			reward.Percent = float64(reward.Shares) / float64(reward.TotalShares) * 100
+		}
+		result = append(result, &reward)
+	}
+	return result, nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"gopkg.in/redis.v3"
+
+	"bitbucket.org/vdidenko/dwarf/server/util"
+)
+
+const (
+	SubscriptionWebhook = "webhook"
+	SubscriptionEmail   = "email"
+)
+
+var ErrTooManySubscriptions = errors.New("too many subscriptions")
+
+// Notification target of a login, "subscriptions:<login>" keeps id => JSON
+type Subscription struct {
+	Id        string `json:"id"`
+	Kind      string `json:"kind"`
+	Target    string `json:"target"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// Same target registered twice gets the same id
+func subscriptionId(kind, target string) string {
+	sum := sha256.Sum256([]byte(kind + ":" + target))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (redisClient *RedisClient) AddSubscription(login, kind, target string, max int64) (*Subscription, error) {
+	sub := &Subscription{Id: subscriptionId(kind, target), Kind: kind, Target: target, CreatedAt: util.MakeTimestamp() / 1000}
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return nil, err
+	}
+	key := redisClient.formatKey("subscriptions", login)
+
+	tx := redisClient.client.Multi()
+	defer tx.Close()
+
+	// Executed immediately, limit is only checked for new targets
+	n, err := tx.HLen(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	exist, err := tx.HExists(key, sub.Id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !exist && n >= max {
+		return nil, ErrTooManySubscriptions
+	}
+
+	_, err = tx.Exec(func() error {
+		tx.HSet(key, sub.Id, string(data))
+		tx.SAdd(redisClient.formatKey("subscribers"), login)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (redisClient *RedisClient) RemoveSubscription(login, id string) (bool, error) {
+	key := redisClient.formatKey("subscriptions", login)
+	n, err := redisClient.client.HDel(key, id).Result()
+	if err != nil {
+		return false, err
+	}
+	if left, _ := redisClient.client.HLen(key).Result(); left == 0 {
+		redisClient.client.SRem(redisClient.formatKey("subscribers"), login)
+	}
+	return n > 0, nil
+}
+
+func (redisClient *RedisClient) GetSubscriptions(login string) ([]*Subscription, error) {
+	raw, err := redisClient.client.HGetAllMap(redisClient.formatKey("subscriptions", login)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	result := make([]*Subscription, 0, len(raw))
+	for _, v := range raw {
+		var sub Subscription
+		if json.Unmarshal([]byte(v), &sub) == nil {
+			result = append(result, &sub)
+		}
+	}
+	return result, nil
+}
+
+func (redisClient *RedisClient) GetSubscribers() ([]string, error) {
+	logins, err := redisClient.client.SMembers(redisClient.formatKey("subscribers")).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return logins, nil
+}
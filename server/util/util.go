@@ -2,6 +2,7 @@ package util
 
 import (
 	"math/big"
+	"net"
 	"regexp"
 	"strconv"
 	"time"
@@ -66,6 +67,12 @@ func StringInSlice(a string, list []string) bool {
 	return false
 }
 
+// Loopback, private, link-local, multicast and unspecified addresses are not public
+func IsPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
 func MustParseDuration(s string) time.Duration {
 	value, err := time.ParseDuration(s)
 	if err != nil {